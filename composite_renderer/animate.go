@@ -0,0 +1,130 @@
+package composite_renderer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"time"
+)
+
+// AnimationOptions are how the frames of an animation are shown.
+type AnimationOptions struct {
+	// FrameDelay is how long each frame is shown for, which GIFs store in hundredths of a second
+	FrameDelay time.Duration
+
+	// Labels are written in the bottom left corner of the frame with the same index, e.g. the value
+	// that was changed for it
+	Labels []string
+
+	// MaxBytes is the largest the GIF can be, e.g. to fit Discord's upload limit. Larger GIFs are
+	// shrunk until they fit, or ErrOverBudget is returned. 0 means there is no limit.
+	MaxBytes int
+}
+
+// AnimateImages makes a looping animated GIF, with a frame for each image. Every frame is the size of the
+// largest image, and smaller images are centred on a black background. GIFs only have 256 colours, so the
+// frames are dithered.
+func (r *rendererImpl) AnimateImages(imageBufs []*bytes.Buffer, options AnimationOptions) (*bytes.Buffer, error) {
+	if len(imageBufs) == 0 {
+		return nil, errors.New("invalid number of images")
+	}
+
+	delay := int(options.FrameDelay / (10 * time.Millisecond))
+	if delay < 1 {
+		return nil, errors.New("invalid frame delay")
+	}
+
+	images := make([]image.Image, len(imageBufs))
+
+	frameWidth := 0
+	frameHeight := 0
+
+	for i, buf := range imageBufs {
+		img, _, err := image.Decode(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		images[i] = img
+
+		if img.Bounds().Dx() > frameWidth {
+			frameWidth = img.Bounds().Dx()
+		}
+
+		if img.Bounds().Dy() > frameHeight {
+			frameHeight = img.Bounds().Dy()
+		}
+	}
+
+	for {
+		animationBuf, err := encodeAnimation(images, frameWidth, frameHeight, delay, options.Labels)
+		if err != nil {
+			return nil, err
+		}
+
+		if options.MaxBytes <= 0 || animationBuf.Len() <= options.MaxBytes {
+			return animationBuf, nil
+		}
+
+		// the frames are shrunk the same way as images that are over a size budget
+		if int(float64(frameWidth)*budgetScale) < minBudgetSize && int(float64(frameHeight)*budgetScale) < minBudgetSize {
+			return nil, ErrOverBudget
+		}
+
+		for i, img := range images {
+			bounds := img.Bounds()
+
+			images[i] = scaleImage(img, int(float64(bounds.Dx())*budgetScale), int(float64(bounds.Dy())*budgetScale))
+		}
+
+		frameWidth = int(float64(frameWidth) * budgetScale)
+		frameHeight = int(float64(frameHeight) * budgetScale)
+	}
+}
+
+// encodeAnimation draws each image onto a frame of the size, with its label, and encodes them as a GIF.
+func encodeAnimation(images []image.Image, frameWidth, frameHeight, delay int, labels []string) (*bytes.Buffer, error) {
+	frameBounds := image.Rect(0, 0, frameWidth, frameHeight)
+	scale := textScale(frameWidth)
+
+	animation := &gif.GIF{
+		Image: make([]*image.Paletted, len(images)),
+		Delay: make([]int, len(images)),
+	}
+
+	for i, img := range images {
+		bounds := img.Bounds()
+
+		frame := image.NewRGBA(frameBounds)
+
+		draw.Draw(frame, frameBounds, image.NewUniform(backgroundColor), image.Point{}, draw.Src)
+
+		// letterbox images that are smaller than the frame
+		offset := image.Pt((frameWidth-bounds.Dx())/2, (frameHeight-bounds.Dy())/2)
+
+		draw.Draw(frame, image.Rectangle{Min: offset, Max: offset.Add(bounds.Size())}, img, bounds.Min, draw.Over)
+
+		if i < len(labels) && labels[i] != "" {
+			drawLabel(frame, frameBounds, labels[i], scale)
+		}
+
+		paletted := image.NewPaletted(frameBounds, palette.Plan9)
+
+		draw.FloydSteinberg.Draw(paletted, frameBounds, frame, image.Point{})
+
+		animation.Image[i] = paletted
+		animation.Delay[i] = delay
+	}
+
+	animationBuf := new(bytes.Buffer)
+
+	err := gif.EncodeAll(animationBuf, animation)
+	if err != nil {
+		return nil, err
+	}
+
+	return animationBuf, nil
+}
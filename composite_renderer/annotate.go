@@ -0,0 +1,157 @@
+package composite_renderer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// textScaleWidth is how wide a grid is for each step up in text size, so that the text stays
+	// readable once Discord shrinks the grid down to fit the message
+	textScaleWidth = 512
+
+	// badgePadding and captionPadding are the space around the badge numbers and the caption, before scaling
+	badgePadding   = 3
+	captionPadding = 6
+)
+
+var (
+	backgroundColor = color.Black
+	textColor       = color.White
+	badgeColor      = color.RGBA{A: 170}
+
+	textFace = basicfont.Face7x13
+)
+
+// textScale is how many times bigger than the font the text on a grid of the width is drawn.
+func textScale(width int) int {
+	scale := width / textScaleWidth
+	if scale < 1 {
+		return 1
+	}
+
+	return scale
+}
+
+func lineHeight(scale int) int {
+	return textFace.Height * scale
+}
+
+func textWidth(text string, scale int) int {
+	return font.MeasureString(textFace, text).Ceil() * scale
+}
+
+// drawText writes the text with its top left corner at the point. The font is a small bitmap font, so
+// it's drawn at its own size and then scaled up, keeping its pixels sharp.
+func drawText(dst draw.Image, text string, point image.Point, scale int) {
+	width := font.MeasureString(textFace, text).Ceil()
+	if width == 0 {
+		return
+	}
+
+	textImage := image.NewRGBA(image.Rect(0, 0, width, textFace.Height))
+
+	drawer := &font.Drawer{
+		Dst:  textImage,
+		Src:  image.NewUniform(textColor),
+		Face: textFace,
+		Dot:  fixed.P(0, textFace.Ascent),
+	}
+	drawer.DrawString(text)
+
+	target := image.Rect(0, 0, width*scale, textFace.Height*scale).Add(point)
+
+	xdraw.NearestNeighbor.Scale(dst, target, textImage, textImage.Bounds(), draw.Over, nil)
+}
+
+// drawBadge numbers a tile in its top left corner.
+func drawBadge(dst draw.Image, tile image.Rectangle, number, scale int) {
+	label := strconv.Itoa(number)
+	padding := badgePadding * scale
+
+	badge := image.Rect(0, 0, textWidth(label, scale)+padding*2, lineHeight(scale)+padding*2).
+		Add(tile.Min).
+		Add(image.Pt(padding*2, padding*2))
+
+	draw.Draw(dst, badge, image.NewUniform(badgeColor), image.Point{}, draw.Over)
+
+	drawText(dst, label, badge.Min.Add(image.Pt(padding, padding)), scale)
+}
+
+// drawLabel writes the text in the bottom left corner of the frame, on the same background as the badges.
+func drawLabel(dst draw.Image, frame image.Rectangle, text string, scale int) {
+	padding := badgePadding * scale
+
+	label := image.Rect(0, 0, textWidth(text, scale)+padding*2, lineHeight(scale)+padding*2)
+	label = label.Add(image.Pt(frame.Min.X+padding*2, frame.Max.Y-padding*2-label.Dy()))
+
+	draw.Draw(dst, label, image.NewUniform(badgeColor), image.Point{}, draw.Over)
+
+	drawText(dst, text, label.Min.Add(image.Pt(padding, padding)), scale)
+}
+
+// wrapText splits the lines into more lines where they are too wide for the width, between words if possible.
+func wrapText(lines []string, width, scale int) []string {
+	var wrapped []string
+
+	for _, line := range lines {
+		current := ""
+
+		for _, word := range strings.Fields(line) {
+			candidate := word
+			if current != "" {
+				candidate = current + " " + word
+			}
+
+			if current != "" && textWidth(candidate, scale) > width {
+				wrapped = append(wrapped, current)
+				candidate = word
+			}
+
+			// words that are too long for a line on their own are broken up
+			for textWidth(candidate, scale) > width && len([]rune(candidate)) > 1 {
+				runes := []rune(candidate)
+
+				fit := len(runes) - 1
+				for fit > 1 && textWidth(string(runes[:fit]), scale) > width {
+					fit--
+				}
+
+				wrapped = append(wrapped, string(runes[:fit]))
+				candidate = string(runes[fit:])
+			}
+
+			current = candidate
+		}
+
+		wrapped = append(wrapped, current)
+	}
+
+	return wrapped
+}
+
+// captionHeight is how tall the footer for the wrapped caption lines is.
+func captionHeight(lines []string, scale int) int {
+	if len(lines) == 0 {
+		return 0
+	}
+
+	return len(lines)*lineHeight(scale) + captionPadding*scale*2
+}
+
+// drawCaption writes the wrapped caption lines into the footer.
+func drawCaption(dst draw.Image, footer image.Rectangle, lines []string, scale int) {
+	padding := captionPadding * scale
+
+	for idx, line := range lines {
+		drawText(dst, line, footer.Min.Add(image.Pt(padding, padding+idx*lineHeight(scale))), scale)
+	}
+}
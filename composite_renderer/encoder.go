@@ -0,0 +1,174 @@
+package composite_renderer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// DefaultJPEGQuality is the quality JPEGs are written at, unless another is chosen
+	DefaultJPEGQuality = 90
+
+	// budgetQualityStep and minBudgetQuality are how a size budget steps down the JPEG quality
+	budgetQualityStep = 10
+	minBudgetQuality  = 50
+
+	// budgetScale is how much a size budget shrinks an image by, once the quality can't go any lower,
+	// and minBudgetSize is the smallest it will shrink an image's longest side to
+	budgetScale   = 0.75
+	minBudgetSize = 256
+)
+
+// ErrOverBudget is returned when an image can't be made small enough to fit in a size budget.
+var ErrOverBudget = errors.New("the image can't be made small enough")
+
+// EncodedImage is an image that is ready to be uploaded.
+type EncodedImage struct {
+	Data        []byte
+	ContentType string
+	Extension   string
+}
+
+// Encoder encodes an image that the renderer or the API produced, for uploading it.
+type Encoder interface {
+	Encode(image []byte) (*EncodedImage, error)
+}
+
+type pngEncoderImpl struct{}
+
+// NewPNGEncoder keeps images as PNGs. PNGs are passed through as they are, so that the parameters
+// written into them are kept.
+func NewPNGEncoder() Encoder {
+	return &pngEncoderImpl{}
+}
+
+func (e *pngEncoderImpl) Encode(imageData []byte) (*EncodedImage, error) {
+	if bytes.HasPrefix(imageData, []byte("\x89PNG\r\n\x1a\n")) {
+		return &EncodedImage{Data: imageData, ContentType: "image/png", Extension: ".png"}, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, err
+	}
+
+	return encodePNG(img)
+}
+
+func encodePNG(img image.Image) (*EncodedImage, error) {
+	buf := new(bytes.Buffer)
+
+	err := png.Encode(buf, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedImage{Data: buf.Bytes(), ContentType: "image/png", Extension: ".png"}, nil
+}
+
+type jpegEncoderImpl struct {
+	quality int
+}
+
+// NewJPEGEncoder writes images as lossy JPEGs with the quality, from 1 to 100. JPEGs don't keep
+// the parameters that are written into PNGs, so they need to be copied over with png_info.
+func NewJPEGEncoder(quality int) (Encoder, error) {
+	if quality < 1 || quality > 100 {
+		return nil, fmt.Errorf("JPEG quality must be from 1 to 100, not %d", quality)
+	}
+
+	return &jpegEncoderImpl{quality: quality}, nil
+}
+
+func (e *jpegEncoderImpl) Encode(imageData []byte) (*EncodedImage, error) {
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeJPEG(img, e.quality)
+}
+
+func encodeJPEG(img image.Image, quality int) (*EncodedImage, error) {
+	buf := new(bytes.Buffer)
+
+	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedImage{Data: buf.Bytes(), ContentType: "image/jpeg", Extension: ".jpg"}, nil
+}
+
+type sizeBudgetEncoderImpl struct {
+	encoder  Encoder
+	maxBytes int
+}
+
+// NewSizeBudgetEncoder uses the encoder, unless that makes the image bigger than maxBytes. Then it
+// steps down through lower JPEG qualities, and after that shrinks the image, until it fits.
+func NewSizeBudgetEncoder(encoder Encoder, maxBytes int) (Encoder, error) {
+	if encoder == nil {
+		return nil, errors.New("missing encoder")
+	}
+
+	if maxBytes <= 0 {
+		return nil, errors.New("the size budget must be more than 0")
+	}
+
+	return &sizeBudgetEncoderImpl{encoder: encoder, maxBytes: maxBytes}, nil
+}
+
+func (e *sizeBudgetEncoderImpl) Encode(imageData []byte) (*EncodedImage, error) {
+	encoded, err := e.encoder.Encode(imageData)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encoded.Data) <= e.maxBytes {
+		return encoded, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		for quality := DefaultJPEGQuality; quality >= minBudgetQuality; quality -= budgetQualityStep {
+			encoded, err = encodeJPEG(img, quality)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(encoded.Data) <= e.maxBytes {
+				return encoded, nil
+			}
+		}
+
+		bounds := img.Bounds()
+
+		width := int(float64(bounds.Dx()) * budgetScale)
+		height := int(float64(bounds.Dy()) * budgetScale)
+
+		if width < minBudgetSize && height < minBudgetSize {
+			return nil, ErrOverBudget
+		}
+
+		img = scaleImage(img, width, height)
+	}
+}
+
+func scaleImage(img image.Image, width, height int) image.Image {
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	xdraw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+
+	return scaled
+}
@@ -3,5 +3,7 @@ package composite_renderer
 import "bytes"
 
 type Renderer interface {
-	TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, error)
+	TileImages(imageBufs []*bytes.Buffer, options TileOptions) (*bytes.Buffer, error)
+	TileMask(imageBuf *bytes.Buffer, layout TileLayout, tileIndex int) (*bytes.Buffer, error)
+	AnimateImages(imageBufs []*bytes.Buffer, options AnimationOptions) (*bytes.Buffer, error)
 }
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"image"
+	"image/color"
 	"image/draw"
+	_ "image/jpeg"
 	"image/png"
+	"math"
 )
 
 type rendererImpl struct{}
@@ -16,12 +19,46 @@ func New(cfg Config) (Renderer, error) {
 	return &rendererImpl{}, nil
 }
 
-func (r *rendererImpl) TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, error) {
-	if len(imageBufs) != 4 {
+// GridLayout works out how many columns and rows a grid of count images has. Grids are as square as
+// possible, with any extra column on the right, e.g. 2 images are 2x1, 4 are 2x2, 6 are 3x2 and 9 are 3x3.
+func GridLayout(count int) (int, int) {
+	if count <= 0 {
+		return 0, 0
+	}
+
+	columns := int(math.Ceil(math.Sqrt(float64(count))))
+	rows := (count + columns - 1) / columns
+
+	return columns, rows
+}
+
+// TileOptions are the extras that can be drawn onto a grid.
+type TileOptions struct {
+	// Badges numbers each tile in its top left corner, in the same order as the grid's buttons
+	Badges bool
+
+	// Gutter is the space, in pixels, around and between the tiles
+	Gutter int
+
+	// Caption is written in a footer below the tiles, one line after another, wrapped to fit
+	Caption []string
+}
+
+// TileImages lays the images out in a grid, left to right and top to bottom. Every tile is the size of
+// the largest image, and smaller images are centred in their tile on a black background.
+func (r *rendererImpl) TileImages(imageBufs []*bytes.Buffer, options TileOptions) (*bytes.Buffer, error) {
+	if len(imageBufs) == 0 {
 		return nil, errors.New("invalid number of images")
 	}
 
-	images := make([]image.Image, 4)
+	if options.Gutter < 0 {
+		return nil, errors.New("invalid gutter")
+	}
+
+	images := make([]image.Image, len(imageBufs))
+
+	tileWidth := 0
+	tileHeight := 0
 
 	for i, buf := range imageBufs {
 		img, _, err := image.Decode(buf)
@@ -30,22 +67,54 @@ func (r *rendererImpl) TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, err
 		}
 
 		images[i] = img
-	}
 
-	firstBounds := images[0].Bounds()
+		if img.Bounds().Dx() > tileWidth {
+			tileWidth = img.Bounds().Dx()
+		}
 
-	for _, img := range images {
-		if img.Bounds() != firstBounds {
-			return nil, errors.New("images are not the same size")
+		if img.Bounds().Dy() > tileHeight {
+			tileHeight = img.Bounds().Dy()
 		}
 	}
 
-	retImage := image.NewRGBA(image.Rect(0, 0, firstBounds.Max.X*2, firstBounds.Max.Y*2))
+	columns, rows := GridLayout(len(images))
+	gutter := options.Gutter
+
+	gridWidth := columns*tileWidth + (columns+1)*gutter
+	gridHeight := rows*tileHeight + (rows+1)*gutter
 
-	draw.Draw(retImage, images[0].Bounds().Add(image.Pt(0, 0)), images[0], image.Point{}, draw.Over)
-	draw.Draw(retImage, images[1].Bounds().Add(image.Pt(firstBounds.Max.X, 0)), images[1], image.Point{}, draw.Over)
-	draw.Draw(retImage, images[2].Bounds().Add(image.Pt(0, firstBounds.Max.Y)), images[2], image.Point{}, draw.Over)
-	draw.Draw(retImage, images[3].Bounds().Add(image.Pt(firstBounds.Max.X, firstBounds.Max.Y)), images[3], image.Point{}, draw.Over)
+	scale := textScale(gridWidth)
+
+	var caption []string
+	if len(options.Caption) > 0 {
+		caption = wrapText(options.Caption, gridWidth-captionPadding*scale*2, scale)
+	}
+
+	retImage := image.NewRGBA(image.Rect(0, 0, gridWidth, gridHeight+captionHeight(caption, scale)))
+
+	draw.Draw(retImage, retImage.Bounds(), image.NewUniform(backgroundColor), image.Point{}, draw.Src)
+
+	for i, img := range images {
+		bounds := img.Bounds()
+
+		tile := image.Rect(0, 0, tileWidth, tileHeight).Add(image.Pt(
+			gutter+(i%columns)*(tileWidth+gutter),
+			gutter+(i/columns)*(tileHeight+gutter),
+		))
+
+		// letterbox images that are smaller than the tile
+		offset := tile.Min.Add(image.Pt((tileWidth-bounds.Dx())/2, (tileHeight-bounds.Dy())/2))
+
+		draw.Draw(retImage, image.Rectangle{Min: offset, Max: offset.Add(bounds.Size())}, img, bounds.Min, draw.Over)
+
+		if options.Badges {
+			drawBadge(retImage, tile, i+1, scale)
+		}
+	}
+
+	if len(caption) > 0 {
+		drawCaption(retImage, image.Rect(0, gridHeight, gridWidth, retImage.Bounds().Max.Y), caption, scale)
+	}
 
 	imageBuf := new(bytes.Buffer)
 
@@ -56,3 +125,74 @@ func (r *rendererImpl) TileImages(imageBufs []*bytes.Buffer) (*bytes.Buffer, err
 
 	return imageBuf, nil
 }
+
+// TileLayout is how the tiles of a grid image are laid out.
+type TileLayout struct {
+	Columns int
+	Rows    int
+
+	// TileWidth and TileHeight are the size of each tile, which is the size of the largest image. Any
+	// space left around the tiles is taken to be the grid's gutters, with its caption below them. Without
+	// a tile size, the whole image is split evenly between the tiles.
+	TileWidth  int
+	TileHeight int
+}
+
+// TileMask creates an inpainting mask for a grid image, which is white over the selected tile
+// (1-indexed, left to right, top to bottom) and black everywhere else.
+func (r *rendererImpl) TileMask(imageBuf *bytes.Buffer, layout TileLayout, tileIndex int) (*bytes.Buffer, error) {
+	columns := layout.Columns
+	rows := layout.Rows
+
+	if columns <= 0 || rows <= 0 {
+		return nil, errors.New("invalid grid layout")
+	}
+
+	if tileIndex < 1 || tileIndex > columns*rows {
+		return nil, errors.New("invalid tile index")
+	}
+
+	config, _, err := image.DecodeConfig(imageBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	tileWidth := config.Width / columns
+	tileHeight := config.Height / rows
+	gutter := 0
+
+	if layout.TileWidth > 0 && layout.TileHeight > 0 {
+		tileWidth = layout.TileWidth
+		tileHeight = layout.TileHeight
+
+		// the gutters are as wide around the tiles as between them, and the caption only adds height
+		gutter = (config.Width - columns*tileWidth) / (columns + 1)
+
+		if gutter < 0 || rows*tileHeight+(rows+1)*gutter > config.Height {
+			return nil, errors.New("the tiles don't fit in the image")
+		}
+	}
+
+	tileX := (tileIndex - 1) % columns
+	tileY := (tileIndex - 1) / columns
+
+	maskImage := image.NewGray(image.Rect(0, 0, config.Width, config.Height))
+
+	draw.Draw(maskImage, maskImage.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	tileRect := image.Rect(0, 0, tileWidth, tileHeight).Add(image.Pt(
+		gutter+tileX*(tileWidth+gutter),
+		gutter+tileY*(tileHeight+gutter),
+	))
+
+	draw.Draw(maskImage, tileRect, image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	maskBuf := new(bytes.Buffer)
+
+	err = png.Encode(maskBuf, maskImage)
+	if err != nil {
+		return nil, err
+	}
+
+	return maskBuf, nil
+}
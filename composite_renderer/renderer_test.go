@@ -0,0 +1,288 @@
+package composite_renderer
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var updateGoldens = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+func TestGridLayout(t *testing.T) {
+	tests := []struct {
+		count   int
+		columns int
+		rows    int
+	}{
+		{count: 0, columns: 0, rows: 0},
+		{count: 1, columns: 1, rows: 1},
+		{count: 2, columns: 2, rows: 1},
+		{count: 3, columns: 2, rows: 2},
+		{count: 4, columns: 2, rows: 2},
+		{count: 5, columns: 3, rows: 2},
+		{count: 6, columns: 3, rows: 2},
+		{count: 7, columns: 3, rows: 3},
+		{count: 9, columns: 3, rows: 3},
+		{count: 10, columns: 4, rows: 3},
+	}
+
+	for _, test := range tests {
+		columns, rows := GridLayout(test.count)
+
+		if columns != test.columns || rows != test.rows {
+			t.Errorf("GridLayout(%d) = %dx%d, want %dx%d", test.count, columns, rows, test.columns, test.rows)
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	// each character of the font is 7 pixels wide
+	tests := []struct {
+		name  string
+		lines []string
+		width int
+		scale int
+		want  []string
+	}{
+		{
+			name:  "fits",
+			lines: []string{"a short line"},
+			width: 100,
+			scale: 1,
+			want:  []string{"a short line"},
+		},
+		{
+			name:  "between words",
+			lines: []string{"one two three"},
+			width: 7 * 8,
+			scale: 1,
+			want:  []string{"one two", "three"},
+		},
+		{
+			name:  "long word",
+			lines: []string{"abcdefghij"},
+			width: 7 * 4,
+			scale: 1,
+			want:  []string{"abcd", "efgh", "ij"},
+		},
+		{
+			name:  "scaled",
+			lines: []string{"one two"},
+			width: 7 * 2 * 4,
+			scale: 2,
+			want:  []string{"one", "two"},
+		},
+		{
+			name:  "each line separately",
+			lines: []string{"one", "two"},
+			width: 100,
+			scale: 1,
+			want:  []string{"one", "two"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := wrapText(test.lines, test.width, test.scale)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrapText() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTileImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		golden  string
+		options TileOptions
+	}{
+		{
+			name:   "plain",
+			golden: "grid_plain.png",
+		},
+		{
+			name:    "numbered",
+			golden:  "grid_numbered.png",
+			options: TileOptions{Badges: true},
+		},
+		{
+			name:   "captioned",
+			golden: "grid_captioned.png",
+			options: TileOptions{
+				Badges:  true,
+				Gutter:  8,
+				Caption: []string{"Model: test, Sampler: Euler a, Steps: 20, CFG scale: 9", "Seeds 1: 1, 2: 2, 3: 3"},
+			},
+		},
+	}
+
+	renderer, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grid, err := renderer.TileImages(testImages(t), test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			compareGolden(t, test.golden, grid.Bytes())
+		})
+	}
+}
+
+// testImages are three differently coloured images, one of them smaller than the others, so that the
+// grids have an empty tile and a letterboxed one.
+func testImages(t *testing.T) []*bytes.Buffer {
+	t.Helper()
+
+	sizes := []image.Point{{X: 64, Y: 64}, {X: 64, Y: 64}, {X: 48, Y: 32}}
+	colors := []color.RGBA{{R: 200, A: 255}, {G: 200, A: 255}, {B: 200, A: 255}}
+
+	buffers := make([]*bytes.Buffer, len(sizes))
+
+	for idx, size := range sizes {
+		img := image.NewRGBA(image.Rectangle{Max: size})
+
+		draw.Draw(img, img.Bounds(), image.NewUniform(colors[idx]), image.Point{}, draw.Src)
+
+		buf := new(bytes.Buffer)
+
+		err := png.Encode(buf, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buffers[idx] = buf
+	}
+
+	return buffers
+}
+
+// compareGolden checks that the image has the same pixels as the golden image in testdata. Running the
+// tests with -update writes the image as the new golden image instead.
+func compareGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+
+	if *updateGoldens {
+		err := os.WriteFile(path, got, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotImage, err := png.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantImage, err := png.Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotImage.Bounds() != wantImage.Bounds() {
+		t.Fatalf("image is %v, want %v", gotImage.Bounds(), wantImage.Bounds())
+	}
+
+	bounds := gotImage.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gotR, gotG, gotB, gotA := gotImage.At(x, y).RGBA()
+			wantR, wantG, wantB, wantA := wantImage.At(x, y).RGBA()
+
+			if gotR != wantR || gotG != wantG || gotB != wantB || gotA != wantA {
+				t.Fatalf("pixel at %d,%d differs from %s, rerun with -update if the change is intended", x, y, path)
+			}
+		}
+	}
+}
+
+func TestTileMask(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		layout TileLayout
+		tile   int
+		want   image.Rectangle
+	}{
+		{
+			name:   "split evenly",
+			golden: "grid_plain.png",
+			layout: TileLayout{Columns: 2, Rows: 2},
+			tile:   2,
+			want:   image.Rect(64, 0, 128, 64),
+		},
+		{
+			name:   "tile size",
+			golden: "grid_numbered.png",
+			layout: TileLayout{Columns: 2, Rows: 2, TileWidth: 64, TileHeight: 64},
+			tile:   3,
+			want:   image.Rect(0, 64, 64, 128),
+		},
+		{
+			name:   "gutters and caption",
+			golden: "grid_captioned.png",
+			layout: TileLayout{Columns: 2, Rows: 2, TileWidth: 64, TileHeight: 64},
+			tile:   2,
+			want:   image.Rect(80, 8, 144, 72),
+		},
+	}
+
+	renderer, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grid, err := os.ReadFile(filepath.Join("testdata", test.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			maskBuf, err := renderer.TileMask(bytes.NewBuffer(grid), test.layout, test.tile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mask, err := png.Decode(maskBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bounds := mask.Bounds()
+
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					gray, _, _, _ := mask.At(x, y).RGBA()
+
+					if masked := gray > 0; masked != image.Pt(x, y).In(test.want) {
+						t.Fatalf("pixel at %d,%d is masked: %v, want the mask to be %v", x, y, masked, test.want)
+					}
+				}
+			}
+		})
+	}
+}
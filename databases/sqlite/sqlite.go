@@ -82,6 +82,102 @@ const addGenerationBatchSizeColumnQuery string = `
 ALTER TABLE image_generations ADD COLUMN batch_count INTEGER NOT NULL DEFAULT 0;
 `
 
+const addGenerationImageToImageColumnsQuery string = `
+ALTER TABLE image_generations ADD COLUMN init_image_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE image_generations ADD COLUMN resize_mode INTEGER NOT NULL DEFAULT 0;
+`
+
+const addGenerationInpaintColumnsQuery string = `
+ALTER TABLE image_generations ADD COLUMN mask_image_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE image_generations ADD COLUMN mask_tile INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE image_generations ADD COLUMN mask_blur INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE image_generations ADD COLUMN inpainting_fill INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE image_generations ADD COLUMN inpaint_full_res INTEGER NOT NULL DEFAULT 0;
+`
+
+const addGenerationPromptOptionColumnsQuery string = `
+ALTER TABLE image_generations ADD COLUMN hires_upscaler TEXT NOT NULL DEFAULT '';
+ALTER TABLE image_generations ADD COLUMN model TEXT NOT NULL DEFAULT '';
+`
+
+const addGenerationModelHashColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN model_hash TEXT NOT NULL DEFAULT '';
+`
+
+const addSettingsModelColumnQuery string = `
+ALTER TABLE default_settings ADD COLUMN model TEXT NOT NULL DEFAULT '';
+`
+
+const addSettingsSamplingColumnsQuery string = `
+ALTER TABLE default_settings ADD COLUMN sampler_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE default_settings ADD COLUMN steps INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN cfg_scale REAL NOT NULL DEFAULT 0;
+ALTER TABLE default_settings ADD COLUMN restore_faces INTEGER;
+ALTER TABLE default_settings ADD COLUMN denoising_strength REAL NOT NULL DEFAULT 0;
+`
+
+const addSettingsNegativePromptColumnQuery string = `
+ALTER TABLE default_settings ADD COLUMN negative_prompt TEXT;
+`
+
+const addGenerationBackendColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN backend TEXT NOT NULL DEFAULT '';
+`
+
+const createQueueItemsTableIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS queue_items (
+id INTEGER NOT NULL PRIMARY KEY,
+payload TEXT NOT NULL,
+status TEXT NOT NULL,
+attempts INTEGER NOT NULL,
+created_at DATETIME NOT NULL
+);`
+
+const addQueueItemMemberColumnQuery string = `
+ALTER TABLE queue_items ADD COLUMN member_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS queue_item_member_index ON queue_items(member_id, created_at);
+`
+
+const createUserLimitsTableIfNotExistsQuery string = `
+CREATE TABLE IF NOT EXISTS user_limits (
+member_id TEXT NOT NULL PRIMARY KEY,
+max_queued INTEGER,
+max_per_hour INTEGER
+);`
+
+const addSettingsShowPreviewsColumnQuery string = `
+ALTER TABLE default_settings ADD COLUMN show_previews INTEGER;
+`
+
+const addGenerationImagePathColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN image_path TEXT NOT NULL DEFAULT '';
+`
+
+const addGenerationUpscaledImagePathColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN upscaled_image_path TEXT NOT NULL DEFAULT '';
+`
+
+const addSettingsGridStyleColumnQuery string = `
+ALTER TABLE default_settings ADD COLUMN grid_style TEXT;
+`
+
+const addSettingsAttachmentModeColumnQuery string = `
+ALTER TABLE default_settings ADD COLUMN attachment_mode TEXT;
+`
+
+const createGenerationImagePathIndexQuery string = `
+CREATE INDEX IF NOT EXISTS generation_image_path_index ON image_generations(image_path);
+`
+
+const addGenerationSourceImagePathColumnsQuery string = `
+ALTER TABLE image_generations ADD COLUMN init_image_path TEXT NOT NULL DEFAULT '';
+ALTER TABLE image_generations ADD COLUMN mask_image_path TEXT NOT NULL DEFAULT '';
+`
+
+const addGenerationGridMessageColumnQuery string = `
+ALTER TABLE image_generations ADD COLUMN grid_message_id TEXT NOT NULL DEFAULT '';
+`
+
 type migration struct {
 	migrationName  string
 	migrationQuery string
@@ -97,6 +193,25 @@ var migrations = []migration{
 	{migrationName: "create default settings table", migrationQuery: createDefaultSettingsTableIfNotExistsQuery},
 	{migrationName: "add settings batch columns", migrationQuery: addSettingsBatchColumnsQuery},
 	{migrationName: "add generation batch count column", migrationQuery: addGenerationBatchSizeColumnQuery},
+	{migrationName: "add generation img2img columns", migrationQuery: addGenerationImageToImageColumnsQuery},
+	{migrationName: "add generation inpaint columns", migrationQuery: addGenerationInpaintColumnsQuery},
+	{migrationName: "add generation prompt option columns", migrationQuery: addGenerationPromptOptionColumnsQuery},
+	{migrationName: "add generation model hash column", migrationQuery: addGenerationModelHashColumnQuery},
+	{migrationName: "add settings model column", migrationQuery: addSettingsModelColumnQuery},
+	{migrationName: "add settings sampling columns", migrationQuery: addSettingsSamplingColumnsQuery},
+	{migrationName: "add settings negative prompt column", migrationQuery: addSettingsNegativePromptColumnQuery},
+	{migrationName: "add generation backend column", migrationQuery: addGenerationBackendColumnQuery},
+	{migrationName: "create queue items table", migrationQuery: createQueueItemsTableIfNotExistsQuery},
+	{migrationName: "add queue item member column", migrationQuery: addQueueItemMemberColumnQuery},
+	{migrationName: "create user limits table", migrationQuery: createUserLimitsTableIfNotExistsQuery},
+	{migrationName: "add settings show previews column", migrationQuery: addSettingsShowPreviewsColumnQuery},
+	{migrationName: "add generation image path column", migrationQuery: addGenerationImagePathColumnQuery},
+	{migrationName: "add generation upscaled image path column", migrationQuery: addGenerationUpscaledImagePathColumnQuery},
+	{migrationName: "add settings grid style column", migrationQuery: addSettingsGridStyleColumnQuery},
+	{migrationName: "add settings attachment mode column", migrationQuery: addSettingsAttachmentModeColumnQuery},
+	{migrationName: "add generation image path index", migrationQuery: createGenerationImagePathIndexQuery},
+	{migrationName: "add generation source image path columns", migrationQuery: addGenerationSourceImagePathColumnsQuery},
+	{migrationName: "add generation grid message column", migrationQuery: addGenerationGridMessageColumnQuery},
 }
 
 func New(ctx context.Context) (*sql.DB, error) {
@@ -47,6 +47,22 @@ func (b *botImpl) imagineSettingsCommandString() string {
 	return b.imagineCommand + "_settings"
 }
 
+func (b *botImpl) imagineImageCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.imagineCommand + "_img"
+	}
+
+	return b.imagineCommand + "_img"
+}
+
+func (b *botImpl) imagineInpaintCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.imagineCommand + "_inpaint"
+	}
+
+	return b.imagineCommand + "_inpaint"
+}
+
 func New(cfg Config) (Bot, error) {
 	if cfg.BotToken == "" {
 		return nil, errors.New("missing bot token")
@@ -96,6 +112,36 @@ func New(cfg Config) (Bot, error) {
 		return nil, err
 	}
 
+	err = bot.addImagineImageCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addImagineInpaintCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addImagineLimitsCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addImagineQueueCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addImagineInfoCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	err = bot.addImagineSweepCommand()
+	if err != nil {
+		return nil, err
+	}
+
 	botSession.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		switch i.Type {
 		case discordgo.InteractionApplicationCommand:
@@ -104,13 +150,36 @@ func New(cfg Config) (Bot, error) {
 				bot.processImagineCommand(s, i)
 			case bot.imagineSettingsCommandString():
 				bot.processImagineSettingsCommand(s, i)
+			case bot.imagineImageCommandString():
+				bot.processImagineImageCommand(s, i)
+			case bot.imagineInpaintCommandString():
+				bot.processImagineInpaintCommand(s, i)
+			case bot.imagineLimitsCommandString():
+				bot.processImagineLimitsCommand(s, i)
+			case bot.imagineQueueCommandString():
+				bot.processImagineQueueCommand(s, i)
+			case bot.imagineInfoCommandString():
+				bot.processImagineInfoCommand(s, i)
+			case bot.imagineInfoMessageCommandString():
+				bot.processImagineInfoMessageCommand(s, i)
+			case bot.imagineSweepCommandString():
+				bot.processImagineSweepCommand(s, i)
 			default:
 				log.Printf("Unknown command '%v'", i.ApplicationCommandData().Name)
 			}
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			switch i.ApplicationCommandData().Name {
+			case bot.imagineCommandString(), bot.imagineSweepCommandString():
+				bot.processImagineAutocomplete(s, i)
+			default:
+				log.Printf("Unknown autocomplete command '%v'", i.ApplicationCommandData().Name)
+			}
 		case discordgo.InteractionMessageComponent:
 			switch customID := i.MessageComponentData().CustomID; {
 			case customID == "imagine_reroll":
 				bot.processImagineReroll(s, i)
+			case customID == "imagine_reimagine":
+				bot.processImagineReimagine(s, i)
 			case strings.HasPrefix(customID, "imagine_upscale_"):
 				interactionIndex := strings.TrimPrefix(customID, "imagine_upscale_")
 
@@ -133,7 +202,16 @@ func New(cfg Config) (Bot, error) {
 				}
 
 				bot.processImagineVariation(s, i, interactionIndexInt)
-			case customID == "imagine_dimension_setting_menu":
+			case strings.HasPrefix(customID, "imagine_cancel_"):
+				itemID, intErr := strconv.ParseInt(strings.TrimPrefix(customID, "imagine_cancel_"), 10, 64)
+				if intErr != nil {
+					log.Printf("Error parsing queue item ID: %v", intErr)
+
+					return
+				}
+
+				bot.processImagineCancel(s, i, itemID)
+			case strings.HasPrefix(customID, "imagine_dimension_setting_menu"):
 				if len(i.MessageComponentData().Values) == 0 {
 					log.Printf("No values for imagine dimension setting menu")
 
@@ -160,7 +238,7 @@ func New(cfg Config) (Bot, error) {
 				}
 
 				bot.processImagineDimensionSetting(s, i, widthInt, heightInt)
-			case customID == "imagine_batch_count_setting_menu":
+			case strings.HasPrefix(customID, "imagine_batch_count_setting_menu"):
 				if len(i.MessageComponentData().Values) == 0 {
 					log.Printf("No values for imagine batch count setting menu")
 
@@ -193,7 +271,7 @@ func New(cfg Config) (Bot, error) {
 				}
 
 				bot.processImagineBatchSetting(s, i, batchCountInt, batchSizeInt)
-			case customID == "imagine_batch_size_setting_menu":
+			case strings.HasPrefix(customID, "imagine_batch_size_setting_menu"):
 				if len(i.MessageComponentData().Values) == 0 {
 					log.Printf("No values for imagine batch count setting menu")
 
@@ -226,9 +304,94 @@ func New(cfg Config) (Bot, error) {
 				}
 
 				bot.processImagineBatchSetting(s, i, batchCountInt, batchSizeInt)
+			case strings.HasPrefix(customID, "imagine_model_setting_menu"):
+				if len(i.MessageComponentData().Values) == 0 {
+					log.Printf("No values for imagine model setting menu")
+
+					return
+				}
+
+				bot.processImagineModelSetting(s, i, i.MessageComponentData().Values[0])
+			case strings.HasPrefix(customID, "imagine_settings_page_"):
+				page, _, _ := strings.Cut(strings.TrimPrefix(customID, "imagine_settings_page_"), ":")
+
+				bot.processImagineSettingsPage(s, i, settingsPage(page))
+			case strings.HasPrefix(customID, "imagine_sampler_setting_menu"):
+				if len(i.MessageComponentData().Values) == 0 {
+					log.Printf("No values for imagine sampler setting menu")
+
+					return
+				}
+
+				bot.processImagineSamplerSetting(s, i, i.MessageComponentData().Values[0])
+			case strings.HasPrefix(customID, "imagine_steps_setting_menu"):
+				if len(i.MessageComponentData().Values) == 0 {
+					log.Printf("No values for imagine steps setting menu")
+
+					return
+				}
+
+				steps, intErr := strconv.Atoi(i.MessageComponentData().Values[0])
+				if intErr != nil {
+					log.Printf("Error parsing steps: %v", intErr)
+
+					return
+				}
+
+				bot.processImagineStepsSetting(s, i, steps)
+			case strings.HasPrefix(customID, "imagine_cfg_scale_setting_menu"):
+				if len(i.MessageComponentData().Values) == 0 {
+					log.Printf("No values for imagine CFG scale setting menu")
+
+					return
+				}
+
+				cfgScale, floatErr := strconv.ParseFloat(i.MessageComponentData().Values[0], 64)
+				if floatErr != nil {
+					log.Printf("Error parsing CFG scale: %v", floatErr)
+
+					return
+				}
+
+				bot.processImagineCfgScaleSetting(s, i, cfgScale)
+			case strings.HasPrefix(customID, "imagine_restore_faces_setting_button"):
+				bot.processImagineRestoreFacesSetting(s, i)
+			case strings.HasPrefix(customID, "imagine_show_previews_setting_button"):
+				bot.processImagineShowPreviewsSetting(s, i)
+			case strings.HasPrefix(customID, "imagine_grid_style_setting_button"):
+				bot.processImagineGridStyleSetting(s, i)
+			case strings.HasPrefix(customID, "imagine_attachment_mode_setting_menu"):
+				if len(i.MessageComponentData().Values) == 0 {
+					log.Printf("No values for imagine attachment mode setting menu")
+
+					return
+				}
+
+				bot.processImagineAttachmentModeSetting(s, i, entities.AttachmentMode(i.MessageComponentData().Values[0]))
+			case strings.HasPrefix(customID, "imagine_advanced_settings_button"):
+				bot.processImagineAdvancedSettingsButton(s, i)
+			case strings.HasPrefix(customID, "imagine_negative_prompt_setting_menu"):
+				if len(i.MessageComponentData().Values) == 0 {
+					log.Printf("No values for imagine negative prompt setting menu")
+
+					return
+				}
+
+				bot.processImagineNegativePromptSetting(s, i, i.MessageComponentData().Values[0])
+			case strings.HasPrefix(customID, "imagine_negative_prompt_settings_button"):
+				bot.processImagineNegativePromptSettingsButton(s, i)
 			default:
 				log.Printf("Unknown message component '%v'", i.MessageComponentData().CustomID)
 			}
+		case discordgo.InteractionModalSubmit:
+			switch customID := i.ModalSubmitData().CustomID; {
+			case strings.HasPrefix(customID, "imagine_advanced_settings_modal"):
+				bot.processImagineAdvancedSettingsModal(s, i)
+			case strings.HasPrefix(customID, "imagine_negative_prompt_settings_modal"):
+				bot.processImagineNegativePromptSettingsModal(s, i)
+			default:
+				log.Printf("Unknown modal '%v'", customID)
+			}
 		}
 	})
 
@@ -262,6 +425,11 @@ func (b *botImpl) teardown() error {
 	return b.botSession.Close()
 }
 
+const (
+	negativePromptModeAppend  = "append"
+	negativePromptModeReplace = "replace"
+)
+
 func (b *botImpl) addImagineCommand() error {
 	log.Printf("Adding command '%s'...", b.imagineCommandString())
 
@@ -275,6 +443,32 @@ func (b *botImpl) addImagineCommand() error {
 				Description: "The text prompt to imagine",
 				Required:    true,
 			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "model",
+				Description:  "The model checkpoint to imagine with, instead of the default",
+				Autocomplete: true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "negative_prompt",
+				Description: "What to avoid in the image, added to the default negative prompt",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "negative_prompt_mode",
+				Description: "Whether the negative prompt is added to the default one, or replaces it",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{
+						Name:  "Add to the default negative prompt",
+						Value: negativePromptModeAppend,
+					},
+					{
+						Name:  "Replace the default negative prompt",
+						Value: negativePromptModeReplace,
+					},
+				},
+			},
 		},
 	})
 	if err != nil {
@@ -288,15 +482,157 @@ func (b *botImpl) addImagineCommand() error {
 	return nil
 }
 
-func (b *botImpl) addImagineSettingsCommand() error {
-	log.Printf("Adding command '%s'...", b.imagineSettingsCommandString())
+func (b *botImpl) addImagineImageCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineImageCommandString())
+
+	minDenoisingStrength := float64(0)
+
+	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name:        b.imagineImageCommandString(),
+		Description: "Ask the bot to imagine something, starting from an image",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "The text prompt to imagine",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionAttachment,
+				Name:        "image",
+				Description: "The image to start from",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionNumber,
+				Name:        "denoising_strength",
+				Description: "How much the image is allowed to change, from 0 to 1 (default 0.7)",
+				MinValue:    &minDenoisingStrength,
+				MaxValue:    1,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "resize_mode",
+				Description: "How to fit the image to the output size",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{
+						Name:  "Just resize",
+						Value: 0,
+					},
+					{
+						Name:  "Crop and resize",
+						Value: 1,
+					},
+					{
+						Name:  "Resize and fill",
+						Value: 2,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineImageCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	return nil
+}
+
+const (
+	defaultMaskBlur       = 4
+	defaultInpaintingFill = 1
+)
+
+func (b *botImpl) addImagineInpaintCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineInpaintCommandString())
+
+	minDenoisingStrength := float64(0)
+	minMaskBlur := float64(0)
+	minTile := float64(1)
 
 	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
-		Name:        b.imagineSettingsCommandString(),
-		Description: "Change the default settings for the imagine command",
+		Name:        b.imagineInpaintCommandString(),
+		Description: "Ask the bot to repaint part of an image",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "The text prompt to imagine in the masked area",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionAttachment,
+				Name:        "image",
+				Description: "The image to repaint",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionAttachment,
+				Name:        "mask",
+				Description: "A black and white mask, where white is the area to repaint",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "tile",
+				Description: "Repaint a single tile of a grid image, instead of using a mask",
+				MinValue:    &minTile,
+				MaxValue:    imagine_queue.MaxGridImages,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "grid",
+				Description: "A link to my reply with the grid, to find the tile in",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "mask_blur",
+				Description: fmt.Sprintf("How much to blur the edges of the mask (default %d)", defaultMaskBlur),
+				MinValue:    &minMaskBlur,
+				MaxValue:    64,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "inpaint_full_res",
+				Description: "Repaint the masked area at full resolution",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "inpainting_fill",
+				Description: "What to fill the masked area with before repainting (default original)",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{
+						Name:  "Fill",
+						Value: 0,
+					},
+					{
+						Name:  "Original",
+						Value: 1,
+					},
+					{
+						Name:  "Latent noise",
+						Value: 2,
+					},
+					{
+						Name:  "Latent nothing",
+						Value: 3,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionNumber,
+				Name:        "denoising_strength",
+				Description: "How much the masked area is allowed to change, from 0 to 1 (default 0.7)",
+				MinValue:    &minDenoisingStrength,
+				MaxValue:    1,
+			},
+		},
 	})
 	if err != nil {
-		log.Printf("Error creating '%s' command: %v", b.imagineSettingsCommandString(), err)
+		log.Printf("Error creating '%s' command: %v", b.imagineInpaintCommandString(), err)
 
 		return err
 	}
@@ -307,18 +643,24 @@ func (b *botImpl) addImagineSettingsCommand() error {
 }
 
 func (b *botImpl) processImagineReroll(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	position, queueError := b.imagineQueue.AddImagine(&imagine_queue.QueueItem{
+	queueItem := &imagine_queue.QueueItem{
 		Type:               imagine_queue.ItemTypeReroll,
 		DiscordInteraction: i.Interaction,
-	})
+	}
+
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
 	if queueError != nil {
 		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("I'm reimagining that for you... You are currently #%d in line.", position),
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
 		},
 	})
 	if err != nil {
@@ -327,19 +669,25 @@ func (b *botImpl) processImagineReroll(s *discordgo.Session, i *discordgo.Intera
 }
 
 func (b *botImpl) processImagineUpscale(s *discordgo.Session, i *discordgo.InteractionCreate, upscaleIndex int) {
-	position, queueError := b.imagineQueue.AddImagine(&imagine_queue.QueueItem{
+	queueItem := &imagine_queue.QueueItem{
 		Type:               imagine_queue.ItemTypeUpscale,
 		InteractionIndex:   upscaleIndex,
 		DiscordInteraction: i.Interaction,
-	})
+	}
+
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
 	if queueError != nil {
 		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("I'm upscaling that for you... You are currently #%d in line.", position),
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
 		},
 	})
 	if err != nil {
@@ -348,19 +696,25 @@ func (b *botImpl) processImagineUpscale(s *discordgo.Session, i *discordgo.Inter
 }
 
 func (b *botImpl) processImagineVariation(s *discordgo.Session, i *discordgo.InteractionCreate, variationIndex int) {
-	position, queueError := b.imagineQueue.AddImagine(&imagine_queue.QueueItem{
+	queueItem := &imagine_queue.QueueItem{
 		Type:               imagine_queue.ItemTypeVariation,
 		InteractionIndex:   variationIndex,
 		DiscordInteraction: i.Interaction,
-	})
+	}
+
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
 	if queueError != nil {
 		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("I'm imagining more variations for you... You are currently #%d in line.", position),
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
 		},
 	})
 	if err != nil {
@@ -376,31 +730,49 @@ func (b *botImpl) processImagineCommand(s *discordgo.Session, i *discordgo.Inter
 		optionMap[opt.Name] = opt
 	}
 
-	var position int
-	var queueError error
-	var prompt string
+	var model string
+
+	if option, ok := optionMap["model"]; ok {
+		model = option.StringValue()
+	}
+
+	var negativePrompt string
+
+	if option, ok := optionMap["negative_prompt"]; ok {
+		negativePrompt = option.StringValue()
+	}
+
+	replaceNegativePrompt := false
+
+	if option, ok := optionMap["negative_prompt_mode"]; ok {
+		replaceNegativePrompt = option.StringValue() == negativePromptModeReplace
+	}
+
+	queueItem := &imagine_queue.QueueItem{
+		Type:                  imagine_queue.ItemTypeImagine,
+		DiscordInteraction:    i.Interaction,
+		Model:                 model,
+		NegativePrompt:        negativePrompt,
+		ReplaceNegativePrompt: replaceNegativePrompt,
+	}
 
 	if option, ok := optionMap["prompt"]; ok {
-		prompt = option.StringValue()
+		queueItem.Prompt = option.StringValue()
+	}
 
-		position, queueError = b.imagineQueue.AddImagine(&imagine_queue.QueueItem{
-			Prompt:             prompt,
-			Type:               imagine_queue.ItemTypeImagine,
-			DiscordInteraction: i.Interaction,
-		})
-		if queueError != nil {
-			log.Printf("Error adding imagine to queue: %v\n", queueError)
-		}
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
+	if queueError != nil {
+		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
 	}
 
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf(
-				"I'm dreaming something up for you. You are currently #%d in line.\n<@%s> asked me to imagine \"%s\".",
-				position,
-				i.Member.User.ID,
-				prompt),
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
 		},
 	})
 	if err != nil {
@@ -408,102 +780,62 @@ func (b *botImpl) processImagineCommand(s *discordgo.Session, i *discordgo.Inter
 	}
 }
 
-func settingsMessageComponents(settings *entities.DefaultSettings) []discordgo.MessageComponent {
-	minValues := 1
-
-	return []discordgo.MessageComponent{
-		discordgo.ActionsRow{
-			Components: []discordgo.MessageComponent{
-				discordgo.SelectMenu{
-					CustomID:  "imagine_dimension_setting_menu",
-					MinValues: &minValues,
-					MaxValues: 1,
-					Options: []discordgo.SelectMenuOption{
-						{
-							Label:   "Size: 512x512",
-							Value:   "512_512",
-							Default: settings.Width == 512 && settings.Height == 512,
-						},
-						{
-							Label:   "Size: 768x768",
-							Value:   "768_768",
-							Default: settings.Width == 768 && settings.Height == 768,
-						},
-					},
-				},
-			},
-		},
-		discordgo.ActionsRow{
-			Components: []discordgo.MessageComponent{
-				discordgo.SelectMenu{
-					CustomID:  "imagine_batch_count_setting_menu",
-					MinValues: &minValues,
-					MaxValues: 1,
-					Options: []discordgo.SelectMenuOption{
-						{
-							Label:   "Batch count: 1",
-							Value:   "1",
-							Default: settings.BatchCount == 1,
-						},
-						{
-							Label:   "Batch count: 2",
-							Value:   "2",
-							Default: settings.BatchCount == 2,
-						},
-						{
-							Label:   "Batch count: 4",
-							Value:   "4",
-							Default: settings.BatchCount == 4,
-						},
-					},
-				},
-			},
-		},
-		discordgo.ActionsRow{
-			Components: []discordgo.MessageComponent{
-				discordgo.SelectMenu{
-					CustomID:  "imagine_batch_size_setting_menu",
-					MinValues: &minValues,
-					MaxValues: 1,
-					Options: []discordgo.SelectMenuOption{
-						{
-							Label:   "Batch size: 1",
-							Value:   "1",
-							Default: settings.BatchSize == 1,
-						},
-						{
-							Label:   "Batch size: 2",
-							Value:   "2",
-							Default: settings.BatchSize == 2,
-						},
-						{
-							Label:   "Batch size: 4",
-							Value:   "4",
-							Default: settings.BatchSize == 4,
-						},
-					},
-				},
-			},
-		},
+func (b *botImpl) processImagineImageCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	commandData := i.ApplicationCommandData()
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(commandData.Options))
+	for _, opt := range commandData.Options {
+		optionMap[opt.Name] = opt
 	}
-}
 
-func (b *botImpl) processImagineSettingsCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	botSettings, err := b.imagineQueue.GetBotDefaultSettings()
-	if err != nil {
-		log.Printf("error getting default settings for settings command: %v", err)
+	queueItem := &imagine_queue.QueueItem{
+		Type:               imagine_queue.ItemTypeImageToImage,
+		DiscordInteraction: i.Interaction,
+	}
+
+	if option, ok := optionMap["prompt"]; ok {
+		queueItem.Prompt = option.StringValue()
+	}
+
+	queueItem.InitImageURL = attachmentURL(commandData, optionMap["image"])
+
+	if option, ok := optionMap["denoising_strength"]; ok {
+		denoisingStrength := option.FloatValue()
+		queueItem.DenoisingStrength = &denoisingStrength
+	}
+
+	if option, ok := optionMap["resize_mode"]; ok {
+		queueItem.ResizeMode = int(option.IntValue())
+	}
+
+	if queueItem.InitImageURL == "" {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "I need an image to start from.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			log.Printf("Error responding to interaction: %v", err)
+		}
 
 		return
 	}
 
-	messageComponents := settingsMessageComponents(botSettings)
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
+	if queueError != nil {
+		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
+	}
 
-	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Title:      "Settings",
-			Content:    "Choose defaults settings for the imagine command:",
-			Components: messageComponents,
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
 		},
 	})
 	if err != nil {
@@ -511,15 +843,72 @@ func (b *botImpl) processImagineSettingsCommand(s *discordgo.Session, i *discord
 	}
 }
 
-func (b *botImpl) processImagineDimensionSetting(s *discordgo.Session, i *discordgo.InteractionCreate, height, width int) {
-	botSettings, err := b.imagineQueue.UpdateDefaultDimensions(width, height)
-	if err != nil {
-		log.Printf("error updating default dimensions: %v", err)
+func (b *botImpl) processImagineInpaintCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	commandData := i.ApplicationCommandData()
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(commandData.Options))
+	for _, opt := range commandData.Options {
+		optionMap[opt.Name] = opt
+	}
+
+	queueItem := &imagine_queue.QueueItem{
+		Type:               imagine_queue.ItemTypeInpaint,
+		DiscordInteraction: i.Interaction,
+		MaskBlur:           defaultMaskBlur,
+		InpaintingFill:     defaultInpaintingFill,
+	}
+
+	if option, ok := optionMap["prompt"]; ok {
+		queueItem.Prompt = option.StringValue()
+	}
+
+	queueItem.InitImageURL = attachmentURL(commandData, optionMap["image"])
+	queueItem.MaskImageURL = attachmentURL(commandData, optionMap["mask"])
+
+	if option, ok := optionMap["tile"]; ok {
+		queueItem.MaskTile = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["grid"]; ok {
+		queueItem.GridMessageID = messageIDFromLink(option.StringValue())
+	}
+
+	if option, ok := optionMap["mask_blur"]; ok {
+		queueItem.MaskBlur = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["inpaint_full_res"]; ok {
+		queueItem.InpaintFullRes = option.BoolValue()
+	}
 
-		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-			Type: discordgo.InteractionResponseUpdateMessage,
+	if option, ok := optionMap["inpainting_fill"]; ok {
+		queueItem.InpaintingFill = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["denoising_strength"]; ok {
+		denoisingStrength := option.FloatValue()
+		queueItem.DenoisingStrength = &denoisingStrength
+	}
+
+	var validationError string
+
+	switch {
+	case queueItem.InitImageURL == "":
+		validationError = "I need an image to repaint."
+	case queueItem.MaskImageURL == "" && queueItem.MaskTile == 0:
+		validationError = "I need either a mask, or the number of the tile to repaint."
+	case queueItem.MaskImageURL != "" && queueItem.MaskTile != 0:
+		validationError = "Please choose either a mask, or a tile to repaint, but not both."
+	case queueItem.GridMessageID == "" && optionMap["grid"] != nil:
+		validationError = "The grid needs to be a link to my reply with the grid, or its message ID."
+	}
+
+	if validationError != "" {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{
-				Content: "Error updating default dimensions...",
+				Content: validationError,
+				Flags:   discordgo.MessageFlagsEphemeral,
 			},
 		})
 		if err != nil {
@@ -529,13 +918,19 @@ func (b *botImpl) processImagineDimensionSetting(s *discordgo.Session, i *discor
 		return
 	}
 
-	messageComponents := settingsMessageComponents(botSettings)
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
+	if queueError != nil {
+		log.Printf("Error adding imagine to queue: %v\n", queueError)
 
-	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseUpdateMessage,
+		respondWithQueueError(s, i, queueError)
+
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content:    "Choose defaults settings for the imagine command:",
-			Components: messageComponents,
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
 		},
 	})
 	if err != nil {
@@ -543,34 +938,147 @@ func (b *botImpl) processImagineDimensionSetting(s *discordgo.Session, i *discor
 	}
 }
 
-func (b *botImpl) processImagineBatchSetting(s *discordgo.Session, i *discordgo.InteractionCreate, batchCount, batchSize int) {
-	botSettings, err := b.imagineQueue.UpdateDefaultBatch(batchCount, batchSize)
-	if err != nil {
-		log.Printf("error updating batch settings: %v", err)
+// maxAutocompleteChoices is the most choices Discord allows in an autocomplete response.
+const maxAutocompleteChoices = 25
 
-		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-			Type: discordgo.InteractionResponseUpdateMessage,
-			Data: &discordgo.InteractionResponseData{
-				Content: "Error updating batch settings...",
-			},
-		})
+func (b *botImpl) processImagineAutocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0)
+
+	for _, option := range i.ApplicationCommandData().Options {
+		if !option.Focused || option.Name != "model" {
+			continue
+		}
+
+		models, err := b.imagineQueue.ListModels()
 		if err != nil {
-			log.Printf("Error responding to interaction: %v", err)
+			log.Printf("Error listing models: %v", err)
+
+			break
 		}
 
-		return
+		typed := strings.ToLower(option.StringValue())
+
+		for _, model := range models {
+			if len(choices) >= maxAutocompleteChoices {
+				break
+			}
+
+			if typed != "" && !strings.Contains(strings.ToLower(model.Title), typed) {
+				continue
+			}
+
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  imagine_queue.Truncate(model.Title, 100),
+				Value: model.Title,
+			})
+		}
 	}
 
-	messageComponents := settingsMessageComponents(botSettings)
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to autocomplete interaction: %v", err)
+	}
+}
+
+// respondWithQueueError lets only the requesting user know why their request wasn't added to the queue.
+func respondWithQueueError(s *discordgo.Session, i *discordgo.InteractionCreate, queueError error) {
+	content := "I'm sorry, but I couldn't add that to the queue."
 
-	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseUpdateMessage,
+	var promptErr *imagine_queue.PromptOptionError
+	if errors.As(queueError, &promptErr) {
+		content = fmt.Sprintf("I couldn't understand your prompt: %s", promptErr.Error())
+	}
+
+	var queueFullErr *imagine_queue.QueueFullError
+	if errors.As(queueError, &queueFullErr) {
+		content = fmt.Sprintf("I'm sorry, but I already have %d imagines waiting. Please try again in a little while.",
+			queueFullErr.MaxSize)
+	}
+
+	var sweepErr *imagine_queue.SweepOptionError
+	if errors.As(queueError, &sweepErr) {
+		content = fmt.Sprintf("I can't make that sweep: %s", sweepErr.Error())
+	}
+
+	var limitErr *imagine_queue.UserLimitError
+	if errors.As(queueError, &limitErr) {
+		switch limitErr.Kind {
+		case imagine_queue.UserLimitPerHour:
+			content = fmt.Sprintf("You have added %d imagines in the last hour, and the limit is %d. Please try again later.",
+				limitErr.Count, limitErr.Limit)
+		default:
+			content = fmt.Sprintf("You have %d imagines queued, and the limit is %d. Please wait for one of them to finish.",
+				limitErr.Count, limitErr.Limit)
+		}
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content:    "Choose defaults settings for the imagine command:",
-			Components: messageComponents,
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
 		},
 	})
 	if err != nil {
 		log.Printf("Error responding to interaction: %v", err)
 	}
 }
+
+// messageIDFromLink returns the message ID from a link to a message, which ends in the ID, or from
+// the ID itself. It's empty if the text is neither.
+func messageIDFromLink(text string) string {
+	text = strings.TrimRight(strings.TrimSpace(text), "/")
+	messageID := text[strings.LastIndex(text, "/")+1:]
+
+	if messageID == "" {
+		return ""
+	}
+
+	for _, r := range messageID {
+		if r < '0' || r > '9' {
+			return ""
+		}
+	}
+
+	return messageID
+}
+
+// interactionUserID is the ID of the user that used the interaction. Interactions in servers have the
+// user on their member, and interactions in DMs only have the user.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+
+	if i.User != nil {
+		return i.User.ID
+	}
+
+	return ""
+}
+
+// attachmentURL returns the URL of the attachment chosen for an attachment option, if any.
+func attachmentURL(commandData discordgo.ApplicationCommandInteractionData,
+	option *discordgo.ApplicationCommandInteractionDataOption,
+) string {
+	if option == nil || commandData.Resolved == nil {
+		return ""
+	}
+
+	attachmentID, ok := option.Value.(string)
+	if !ok {
+		return ""
+	}
+
+	attachment, found := commandData.Resolved.Attachments[attachmentID]
+	if !found {
+		return ""
+	}
+
+	return attachment.URL
+}
@@ -0,0 +1,448 @@
+package discord_bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/imagine_queue"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxEmbedDescriptionLength and maxEmbedFieldLength are Discord's limits for embeds
+	maxEmbedDescriptionLength = 4096
+	maxEmbedFieldLength       = 1024
+
+	imageInfoEmbedTitle = "Image info"
+)
+
+func (b *botImpl) imagineInfoCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.imagineCommand + "_info"
+	}
+
+	return b.imagineCommand + "_info"
+}
+
+// imagineInfoMessageCommandString is the name of the message context menu command, which Discord
+// shows as it is, so it reads like a menu item rather than a slash command.
+func (b *botImpl) imagineInfoMessageCommandString() string {
+	if b.developmentMode {
+		return "Dev image info"
+	}
+
+	return "Image info"
+}
+
+func (b *botImpl) addImagineInfoCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineInfoCommandString())
+
+	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name:        b.imagineInfoCommandString(),
+		Description: "Show the settings an image was generated with",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionAttachment,
+				Name:        "image",
+				Description: "A PNG generated by the webui or by the bot, or a JPEG posted by the bot",
+				Required:    true,
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineInfoCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	log.Printf("Adding command '%s'...", b.imagineInfoMessageCommandString())
+
+	cmd, err = b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name: b.imagineInfoMessageCommandString(),
+		Type: discordgo.MessageApplicationCommand,
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineInfoMessageCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	return nil
+}
+
+func (b *botImpl) processImagineInfoCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	commandData := i.ApplicationCommandData()
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(commandData.Options))
+	for _, opt := range commandData.Options {
+		optionMap[opt.Name] = opt
+	}
+
+	imageURL := attachmentURL(commandData, optionMap["image"])
+	if imageURL == "" {
+		respondEphemeral(s, i, "I need an image to read the settings from.")
+
+		return
+	}
+
+	if !deferEphemeral(s, i) {
+		return
+	}
+
+	generation, err := b.imagineQueue.DescribeImage(imageURL)
+
+	editWithImageInfo(s, i, generation, err)
+}
+
+// processImagineInfoMessageCommand describes the message that the command was used on. The bot's own
+// messages are looked up by their ID, and for any other message, its PNG and JPEG attachments are read.
+func (b *botImpl) processImagineInfoMessageCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	commandData := i.ApplicationCommandData()
+
+	if !deferEphemeral(s, i) {
+		return
+	}
+
+	generation, err := b.imagineQueue.DescribeMessage(commandData.TargetID)
+
+	if errors.Is(err, imagine_queue.ErrNoImageInfo) && commandData.Resolved != nil {
+		if message, found := commandData.Resolved.Messages[commandData.TargetID]; found {
+			for _, attachment := range message.Attachments {
+				if !isImageInfoAttachment(attachment) {
+					continue
+				}
+
+				generation, err = b.imagineQueue.DescribeImage(attachment.URL)
+				if err == nil {
+					break
+				}
+			}
+		}
+	}
+
+	editWithImageInfo(s, i, generation, err)
+}
+
+// isImageInfoAttachment is true for the attachments that can have parameters in them.
+func isImageInfoAttachment(attachment *discordgo.MessageAttachment) bool {
+	filename := strings.ToLower(attachment.Filename)
+
+	switch {
+	case attachment.ContentType == "image/png", attachment.ContentType == "image/jpeg":
+		return true
+	case strings.HasSuffix(filename, ".png"), strings.HasSuffix(filename, ".jpg"), strings.HasSuffix(filename, ".jpeg"):
+		return true
+	default:
+		return false
+	}
+}
+
+// deferEphemeral lets Discord know that a reply only the user can see is on its way, as reading an
+// image can take longer than Discord waits for a reply.
+func deferEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+
+		return false
+	}
+
+	return true
+}
+
+func editWithImageInfo(s *discordgo.Session, i *discordgo.InteractionCreate, generation *entities.ImageGeneration, err error) {
+	edit := &discordgo.WebhookEdit{}
+
+	switch {
+	case errors.Is(err, imagine_queue.ErrNoImageInfo):
+		content := "I couldn't find any generation settings for that image. Only PNGs from the webui, and PNGs and JPEGs from me, have them."
+		edit.Content = &content
+	case err != nil:
+		log.Printf("Error describing image: %v", err)
+
+		content := "I'm sorry, but I had a problem reading that image."
+		edit.Content = &content
+	default:
+		embed, complete := imageInfoEmbed(generation)
+
+		edit.Embeds = &[]*discordgo.MessageEmbed{embed}
+
+		if complete {
+			edit.Components = &[]discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.Button{
+							Label:    "Re-imagine with these settings",
+							Style:    discordgo.PrimaryButton,
+							CustomID: "imagine_reimagine",
+							Emoji: &discordgo.ComponentEmoji{
+								Name: "🎨",
+							},
+						},
+					},
+				},
+			}
+		}
+	}
+
+	_, err = s.InteractionResponseEdit(i.Interaction, edit)
+	if err != nil {
+		log.Printf("Error editing interaction: %v", err)
+	}
+}
+
+// imageInfoEmbed lists the generation's settings. The Re-imagine button reads the settings back out
+// of the embed, so it's only complete if none of them had to be shortened to fit.
+func imageInfoEmbed(generation *entities.ImageGeneration) (*discordgo.MessageEmbed, bool) {
+	complete := true
+
+	inlineField := func(name, value string) *discordgo.MessageEmbedField {
+		return &discordgo.MessageEmbedField{Name: name, Value: value, Inline: true}
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       imageInfoEmbedTitle,
+		Description: imagine_queue.Truncate(generation.Prompt, maxEmbedDescriptionLength),
+	}
+
+	if embed.Description != generation.Prompt {
+		complete = false
+	}
+
+	if generation.NegativePrompt != "" {
+		negativePrompt := imagine_queue.Truncate(generation.NegativePrompt, maxEmbedFieldLength)
+
+		if negativePrompt != generation.NegativePrompt {
+			complete = false
+		}
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Negative prompt", Value: negativePrompt})
+	}
+
+	embed.Fields = append(embed.Fields,
+		inlineField("Seed", strconv.Itoa(generation.Seed)),
+		inlineField("Sampler", generation.SamplerName),
+		inlineField("Steps", strconv.Itoa(generation.Steps)),
+		inlineField("CFG scale", formatFloat(generation.CfgScale)),
+		inlineField("Size", fmt.Sprintf("%dx%d", generation.Width, generation.Height)),
+	)
+
+	if generation.Model != "" {
+		embed.Fields = append(embed.Fields, inlineField("Model", generation.Model))
+	}
+
+	if generation.RestoreFaces {
+		embed.Fields = append(embed.Fields, inlineField("Restore faces", "on"))
+	}
+
+	if generation.EnableHR {
+		embed.Fields = append(embed.Fields,
+			inlineField("Hires fix", fmt.Sprintf("%dx%d", generation.HiresWidth, generation.HiresHeight)),
+		)
+
+		if generation.HiresUpscaler != "" {
+			embed.Fields = append(embed.Fields, inlineField("Hires upscaler", generation.HiresUpscaler))
+		}
+	}
+
+	// the source image and mask are links to the images on Discord, so re-imagining an img2img or
+	// inpainting result starts from the same images
+	if generation.InitImageURL != "" {
+		sourceImage := imagine_queue.Truncate(generation.InitImageURL, maxEmbedFieldLength)
+
+		if sourceImage != generation.InitImageURL {
+			complete = false
+		}
+
+		embed.Fields = append(embed.Fields,
+			&discordgo.MessageEmbedField{Name: "Source image", Value: sourceImage},
+			inlineField("Resize mode", strconv.Itoa(generation.ResizeMode)),
+		)
+	}
+
+	if generation.EnableHR || generation.InitImageURL != "" {
+		embed.Fields = append(embed.Fields, inlineField("Denoising strength", formatFloat(generation.DenoisingStrength)))
+	}
+
+	if generation.MaskImageURL != "" {
+		maskImage := imagine_queue.Truncate(generation.MaskImageURL, maxEmbedFieldLength)
+
+		if maskImage != generation.MaskImageURL {
+			complete = false
+		}
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Mask image", Value: maskImage})
+	}
+
+	if generation.MaskImageURL != "" || generation.MaskTile > 0 {
+		if generation.MaskTile > 0 {
+			embed.Fields = append(embed.Fields, inlineField("Mask tile", strconv.Itoa(generation.MaskTile)))
+		}
+
+		if generation.GridMessageID != "" {
+			embed.Fields = append(embed.Fields, inlineField("Grid message", generation.GridMessageID))
+		}
+
+		embed.Fields = append(embed.Fields,
+			inlineField("Mask blur", strconv.Itoa(generation.MaskBlur)),
+			inlineField("Inpainting fill", strconv.Itoa(generation.InpaintingFill)),
+		)
+
+		if generation.InpaintFullRes {
+			embed.Fields = append(embed.Fields, inlineField("Inpaint full res", "on"))
+		}
+	}
+
+	if generation.SubseedStrength > 0 {
+		embed.Fields = append(embed.Fields,
+			inlineField("Variation seed", strconv.Itoa(generation.Subseed)),
+			inlineField("Variation strength", formatFloat(generation.SubseedStrength)),
+		)
+	}
+
+	if !complete {
+		embed.Footer = &discordgo.MessageEmbedFooter{
+			Text: "Some of the settings are too long to re-imagine from here.",
+		}
+	}
+
+	return embed, complete
+}
+
+// generationFromEmbed reads the settings back out of an embed made by imageInfoEmbed.
+func generationFromEmbed(embed *discordgo.MessageEmbed) (*entities.ImageGeneration, error) {
+	if embed == nil || embed.Title != imageInfoEmbedTitle {
+		return nil, errors.New("not an image info embed")
+	}
+
+	generation := &entities.ImageGeneration{
+		Prompt:  embed.Description,
+		Subseed: -1,
+	}
+
+	seenFields := make(map[string]bool, len(embed.Fields))
+
+	for _, field := range embed.Fields {
+		var err error
+
+		switch field.Name {
+		case "Negative prompt":
+			generation.NegativePrompt = field.Value
+		case "Seed":
+			generation.Seed, err = strconv.Atoi(field.Value)
+		case "Sampler":
+			generation.SamplerName = field.Value
+		case "Steps":
+			generation.Steps, err = strconv.Atoi(field.Value)
+		case "CFG scale":
+			generation.CfgScale, err = strconv.ParseFloat(field.Value, 64)
+		case "Size":
+			_, err = fmt.Sscanf(field.Value, "%dx%d", &generation.Width, &generation.Height)
+		case "Model":
+			generation.Model = field.Value
+		case "Restore faces":
+			generation.RestoreFaces = true
+		case "Hires fix":
+			generation.EnableHR = true
+			_, err = fmt.Sscanf(field.Value, "%dx%d", &generation.HiresWidth, &generation.HiresHeight)
+		case "Denoising strength":
+			generation.DenoisingStrength, err = strconv.ParseFloat(field.Value, 64)
+		case "Hires upscaler":
+			generation.HiresUpscaler = field.Value
+		case "Source image":
+			generation.InitImageURL = field.Value
+		case "Resize mode":
+			generation.ResizeMode, err = strconv.Atoi(field.Value)
+		case "Mask image":
+			generation.MaskImageURL = field.Value
+		case "Mask tile":
+			generation.MaskTile, err = strconv.Atoi(field.Value)
+		case "Grid message":
+			generation.GridMessageID = field.Value
+		case "Mask blur":
+			generation.MaskBlur, err = strconv.Atoi(field.Value)
+		case "Inpainting fill":
+			generation.InpaintingFill, err = strconv.Atoi(field.Value)
+		case "Inpaint full res":
+			generation.InpaintFullRes = true
+		case "Variation seed":
+			generation.Subseed, err = strconv.Atoi(field.Value)
+		case "Variation strength":
+			generation.SubseedStrength, err = strconv.ParseFloat(field.Value, 64)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", field.Name, field.Value)
+		}
+
+		seenFields[field.Name] = true
+	}
+
+	for _, name := range []string{"Seed", "Sampler", "Steps", "CFG scale", "Size"} {
+		if !seenFields[name] {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+	}
+
+	return generation, nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (b *botImpl) processImagineReimagine(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Message == nil || len(i.Message.Embeds) == 0 {
+		log.Printf("No image info to reimagine")
+
+		return
+	}
+
+	generation, err := generationFromEmbed(i.Message.Embeds[0])
+	if err != nil {
+		log.Printf("Error reading image info: %v", err)
+
+		respondEphemeral(s, i, "I'm sorry, but I couldn't read those settings.")
+
+		return
+	}
+
+	queueItem := &imagine_queue.QueueItem{
+		Type:               imagine_queue.ItemTypeReimagine,
+		Prompt:             generation.Prompt,
+		DiscordInteraction: i.Interaction,
+		Generation:         generation,
+	}
+
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
+	if queueError != nil {
+		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
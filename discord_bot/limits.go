@@ -0,0 +1,164 @@
+package discord_bot
+
+import (
+	"fmt"
+	"log"
+	"stable_diffusion_bot/imagine_queue"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func (b *botImpl) imagineLimitsCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.imagineCommand + "_limits"
+	}
+
+	return b.imagineCommand + "_limits"
+}
+
+func (b *botImpl) addImagineLimitsCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineLimitsCommandString())
+
+	minLimit := float64(0)
+	manageServer := int64(discordgo.PermissionManageServer)
+
+	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name:                     b.imagineLimitsCommandString(),
+		Description:              "Show or change how much a member can use the imagine commands",
+		DefaultMemberPermissions: &manageServer,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "member",
+				Description: "The member whose limits to show or change",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "max_queued",
+				Description: "How many imagines they can have in the queue at once (0 for no limit)",
+				MinValue:    &minLimit,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "max_per_hour",
+				Description: "How many imagines they can add per hour (0 for no limit)",
+				MinValue:    &minLimit,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "reset",
+				Description: "Go back to the bot's default limits",
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineLimitsCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	return nil
+}
+
+func formatLimit(limit int) string {
+	if limit == 0 {
+		return "no limit"
+	}
+
+	return fmt.Sprintf("%d", limit)
+}
+
+func limitsMessageContent(memberID string, limits *imagine_queue.UserLimits) string {
+	return fmt.Sprintf("<@%s> can have %s imagines in the queue at once, and add %s per hour.",
+		memberID, formatLimit(limits.MaxQueued), formatLimit(limits.MaxPerHour))
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+			AllowedMentions: &discordgo.MessageAllowedMentions{
+				Parse: []discordgo.AllowedMentionType{},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
+
+// editDeferredContent fills in a reply that was deferred with deferEphemeral.
+func editDeferredContent(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+	if err != nil {
+		log.Printf("Error editing interaction: %v", err)
+	}
+}
+
+func (b *botImpl) processImagineLimitsCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !canManageServer(i) {
+		respondEphemeral(s, i, "Only members with the Manage Server permission can change limits.")
+
+		return
+	}
+
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	memberOption, ok := optionMap["member"]
+	if !ok {
+		log.Printf("Missing member option for limits command")
+
+		return
+	}
+
+	memberID := memberOption.UserValue(nil).ID
+
+	var maxQueued, maxPerHour *int
+
+	if option, ok := optionMap["max_queued"]; ok {
+		value := int(option.IntValue())
+		maxQueued = &value
+	}
+
+	if option, ok := optionMap["max_per_hour"]; ok {
+		value := int(option.IntValue())
+		maxPerHour = &value
+	}
+
+	var limits *imagine_queue.UserLimits
+	var err error
+
+	switch {
+	case optionMap["reset"] != nil && optionMap["reset"].BoolValue():
+		limits, err = b.imagineQueue.ResetUserLimits(memberID)
+	case maxQueued != nil || maxPerHour != nil:
+		limits, err = b.imagineQueue.SetUserLimits(memberID, maxQueued, maxPerHour)
+	default:
+		limits, err = b.imagineQueue.GetUserLimits(memberID)
+	}
+
+	if err != nil {
+		log.Printf("Error updating user limits: %v", err)
+
+		respondEphemeral(s, i, "I'm sorry, but I couldn't update the limits.")
+
+		return
+	}
+
+	respondEphemeral(s, i, limitsMessageContent(memberID, limits))
+}
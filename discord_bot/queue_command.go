@@ -0,0 +1,237 @@
+package discord_bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"stable_diffusion_bot/imagine_queue"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxListedQueueItems is how many items the queue list shows, to stay within Discord's message length.
+const maxListedQueueItems = 15
+
+func (b *botImpl) imagineQueueCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.imagineCommand + "_queue"
+	}
+
+	return b.imagineCommand + "_queue"
+}
+
+func (b *botImpl) addImagineQueueCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineQueueCommandString())
+
+	minValue := float64(1)
+
+	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name:        b.imagineQueueCommandString(),
+		Description: "See and manage what the bot is imagining",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List what is being imagined, and what is waiting in line",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "cancel",
+				Description: "Take one of your imagines out of the queue, or stop it if it's being imagined",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "id",
+						Description: "The ID of the imagine, from the queue list",
+						Required:    true,
+						MinValue:    &minValue,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "move",
+				Description: "Move an imagine to a different place in line (requires the Manage Server permission)",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "id",
+						Description: "The ID of the imagine, from the queue list",
+						Required:    true,
+						MinValue:    &minValue,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionInteger,
+						Name:        "position",
+						Description: "The place in line to move it to",
+						Required:    true,
+						MinValue:    &minValue,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineQueueCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	return nil
+}
+
+func itemTypeLabel(itemType imagine_queue.ItemType) string {
+	switch itemType {
+	case imagine_queue.ItemTypeReroll:
+		return "re-roll"
+	case imagine_queue.ItemTypeUpscale:
+		return "upscale"
+	case imagine_queue.ItemTypeVariation:
+		return "variation"
+	case imagine_queue.ItemTypeImageToImage:
+		return "image to image"
+	case imagine_queue.ItemTypeInpaint:
+		return "inpaint"
+	case imagine_queue.ItemTypeReimagine:
+		return "re-imagine"
+	case imagine_queue.ItemTypeSweep:
+		return "sweep"
+	default:
+		return "imagine"
+	}
+}
+
+func queueItemLine(item *imagine_queue.QueueItemInfo) string {
+	description := itemTypeLabel(item.Type)
+
+	if item.Prompt != "" {
+		description = fmt.Sprintf("%s \"%s\"", description, imagine_queue.Truncate(item.Prompt, 80))
+	}
+
+	line := fmt.Sprintf("**#%d** %s for <@%s> (ID %d)", item.Position, description, item.MemberID, item.ID)
+
+	if item.Running {
+		line += fmt.Sprintf(" - imagining on %s, %.0f%% done", item.Backend, item.Progress*100)
+
+		if item.ETA > 0 {
+			line += fmt.Sprintf(", about %s left", item.ETA.Round(time.Second))
+		}
+	}
+
+	return line
+}
+
+func queueListContent(items []*imagine_queue.QueueItemInfo) string {
+	if len(items) == 0 {
+		return "There is nothing in the queue."
+	}
+
+	lines := make([]string, 0, maxListedQueueItems+1)
+
+	for idx, item := range items {
+		if idx >= maxListedQueueItems {
+			lines = append(lines, fmt.Sprintf("...and %d more.", len(items)-maxListedQueueItems))
+
+			break
+		}
+
+		lines = append(lines, queueItemLine(item))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func queueErrorContent(err error) string {
+	switch {
+	case errors.Is(err, imagine_queue.ErrItemNotFound):
+		return "There is no imagine with that ID waiting in the queue."
+	case errors.Is(err, imagine_queue.ErrItemRunning):
+		return "That imagine is already being imagined."
+	case errors.Is(err, imagine_queue.ErrNotItemOwner):
+		return "You can only change your own imagines."
+	default:
+		return "I'm sorry, but I couldn't change the queue."
+	}
+}
+
+func (b *botImpl) processImagineQueueCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+	if len(options) == 0 {
+		log.Printf("Missing subcommand for queue command")
+
+		return
+	}
+
+	subcommand := options[0]
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(subcommand.Options))
+	for _, opt := range subcommand.Options {
+		optionMap[opt.Name] = opt
+	}
+
+	switch subcommand.Name {
+	case "list":
+		// listing asks each backend for its progress, which can take longer than Discord waits for a reply
+		if !deferEphemeral(s, i) {
+			return
+		}
+
+		editDeferredContent(s, i, queueListContent(b.imagineQueue.ListItems()))
+	case "cancel":
+		item, err := b.imagineQueue.CancelItem(optionMap["id"].IntValue(), interactionUserID(i), canManageServer(i))
+		if err != nil {
+			log.Printf("Error cancelling queue item: %v", err)
+
+			respondEphemeral(s, i, queueErrorContent(err))
+
+			return
+		}
+
+		respondEphemeral(s, i, cancelledItemContent(item))
+	case "move":
+		if !canManageServer(i) {
+			respondEphemeral(s, i, "Only members with the Manage Server permission can move imagines.")
+
+			return
+		}
+
+		item, err := b.imagineQueue.MoveItem(optionMap["id"].IntValue(), int(optionMap["position"].IntValue()))
+		if err != nil {
+			log.Printf("Error moving queue item: %v", err)
+
+			respondEphemeral(s, i, queueErrorContent(err))
+
+			return
+		}
+
+		respondEphemeral(s, i, fmt.Sprintf("Moved %s", queueItemLine(item)))
+	default:
+		log.Printf("Unknown queue subcommand '%v'", subcommand.Name)
+	}
+}
+
+func cancelledItemContent(item *imagine_queue.QueueItemInfo) string {
+	if item.Running {
+		return fmt.Sprintf("Stopping %s", queueItemLine(item))
+	}
+
+	return fmt.Sprintf("Cancelled %s", queueItemLine(item))
+}
+
+// processImagineCancel handles the Cancel button on an imagine that is being processed.
+func (b *botImpl) processImagineCancel(s *discordgo.Session, i *discordgo.InteractionCreate, itemID int64) {
+	_, err := b.imagineQueue.CancelItem(itemID, interactionUserID(i), canManageServer(i))
+	if err != nil {
+		log.Printf("Error cancelling queue item: %v", err)
+
+		respondEphemeral(s, i, queueErrorContent(err))
+
+		return
+	}
+
+	respondEphemeral(s, i, "Stopping that imagine...")
+}
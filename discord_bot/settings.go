@@ -0,0 +1,1228 @@
+package discord_bot
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/imagine_queue"
+	"stable_diffusion_bot/stable_diffusion_api"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// defaultModelValue is the model menu option for not choosing a model, as select menu options can't be empty.
+const defaultModelValue = "default"
+
+// maxSelectMenuOptions is the most options Discord allows in a select menu.
+const maxSelectMenuOptions = 25
+
+// settingsPage is one page of the settings message, as a message can only have 5 rows of components.
+type settingsPage string
+
+const (
+	settingsPageGeneral  settingsPage = "general"
+	settingsPageSampling settingsPage = "sampling"
+	settingsPagePrompt   settingsPage = "prompt"
+	settingsPageDisplay  settingsPage = "display"
+)
+
+// negativePromptPreset is a negative prompt that can be chosen from the settings without typing it in.
+type negativePromptPreset struct {
+	value          string
+	label          string
+	negativePrompt string
+}
+
+const (
+	negativePromptPresetInherit = "inherit"
+	negativePromptPresetCustom  = "custom"
+
+	// maxNegativePromptLength is the most Discord allows in a text input.
+	maxNegativePromptLength = 4000
+)
+
+var negativePromptPresets = []negativePromptPreset{
+	{
+		value:          "default",
+		label:          "Negative prompt: bot default",
+		negativePrompt: imagine_queue.DefaultNegativePrompt,
+	},
+	{
+		value:          "minimal",
+		label:          "Negative prompt: minimal",
+		negativePrompt: "blurry, low quality, text, watermark",
+	},
+	{
+		value:          "none",
+		label:          "Negative prompt: none",
+		negativePrompt: "",
+	},
+}
+
+var (
+	stepsSettingChoices    = []int{10, 15, 20, 25, 30, 40, 50}
+	cfgScaleSettingChoices = []float64{3, 5, 7, 7.5, 9, 11, 15}
+)
+
+const (
+	settingsScopeUser    = "user"
+	settingsScopeChannel = "channel"
+	settingsScopeServer  = "server"
+)
+
+func (b *botImpl) addImagineSettingsCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineSettingsCommandString())
+
+	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name:        b.imagineSettingsCommandString(),
+		Description: "Change the default settings for the imagine command",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "scope",
+				Description: "Whose defaults to change (channel and server require the Manage Server permission)",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{
+						Name:  "My settings",
+						Value: settingsScopeUser,
+					},
+					{
+						Name:  "This channel's defaults",
+						Value: settingsScopeChannel,
+					},
+					{
+						Name:  "The server's defaults",
+						Value: settingsScopeServer,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineSettingsCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	return nil
+}
+
+func settingsScopeFromName(name string) imagine_queue.SettingsScope {
+	switch name {
+	case settingsScopeChannel:
+		return imagine_queue.SettingsScopeChannel
+	case settingsScopeServer:
+		return imagine_queue.SettingsScopeGuild
+	default:
+		return imagine_queue.SettingsScopeUser
+	}
+}
+
+func settingsScopeName(scope imagine_queue.SettingsScope) string {
+	switch scope {
+	case imagine_queue.SettingsScopeChannel:
+		return settingsScopeChannel
+	case imagine_queue.SettingsScopeGuild:
+		return settingsScopeServer
+	default:
+		return settingsScopeUser
+	}
+}
+
+// settingsCustomID adds the scope being edited to a settings component's custom ID, so that the
+// component edits the same layer of settings that the message was opened for.
+func settingsCustomID(customID string, scope imagine_queue.SettingsScope) string {
+	return customID + ":" + settingsScopeName(scope)
+}
+
+// settingsScopeFromCustomID returns the scope from a settings component's custom ID. Components
+// without a scope (from before settings were per-user) edit the user's own settings.
+func settingsScopeFromCustomID(customID string) imagine_queue.SettingsScope {
+	_, scopeName, found := strings.Cut(customID, ":")
+	if !found {
+		return imagine_queue.SettingsScopeUser
+	}
+
+	return settingsScopeFromName(scopeName)
+}
+
+func canManageServer(i *discordgo.InteractionCreate) bool {
+	if i.Member == nil {
+		return false
+	}
+
+	return i.Member.Permissions&(discordgo.PermissionManageServer|discordgo.PermissionAdministrator) != 0
+}
+
+func settingsTarget(i *discordgo.InteractionCreate, scope imagine_queue.SettingsScope) *imagine_queue.SettingsTarget {
+	return &imagine_queue.SettingsTarget{
+		Scope:     scope,
+		MemberID:  interactionUserID(i),
+		ChannelID: i.ChannelID,
+		GuildID:   i.GuildID,
+	}
+}
+
+func settingsMessageContent(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope,
+	page settingsPage,
+) string {
+	var content string
+
+	switch scope {
+	case imagine_queue.SettingsScopeChannel:
+		content = "Choose the default settings for the imagine command in this channel:"
+	case imagine_queue.SettingsScopeGuild:
+		content = "Choose the default settings for the imagine command in this server:"
+	default:
+		content = "Choose your default settings for the imagine command:"
+	}
+
+	if page == settingsPagePrompt {
+		negativePrompt := ""
+		if settings.NegativePrompt != nil {
+			negativePrompt = *settings.NegativePrompt
+		}
+
+		if negativePrompt == "" {
+			content += "\n\nThere is no default negative prompt."
+		} else {
+			content += fmt.Sprintf("\n\nThe default negative prompt is: `%s`", imagine_queue.Truncate(negativePrompt, 1500))
+		}
+	}
+
+	return content
+}
+
+// modelSettingComponent is the model select menu, or nil if the models couldn't be listed.
+func modelSettingComponent(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope,
+	models []*stable_diffusion_api.Model,
+) discordgo.MessageComponent {
+	if len(models) == 0 {
+		return nil
+	}
+
+	minValues := 1
+
+	options := []discordgo.SelectMenuOption{
+		{
+			Label:   "Model: default",
+			Value:   defaultModelValue,
+			Default: settings.Model == "",
+		},
+	}
+
+	for idx, model := range models {
+		if len(options) >= maxSelectMenuOptions {
+			break
+		}
+
+		options = append(options, discordgo.SelectMenuOption{
+			Label:   imagine_queue.Truncate("Model: "+model.ModelName, 100),
+			Value:   modelSettingValue(idx, model),
+			Default: settings.Model == model.Title,
+		})
+	}
+
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				CustomID:  settingsCustomID("imagine_model_setting_menu", scope),
+				MinValues: &minValues,
+				MaxValues: 1,
+				Options:   options,
+			},
+		},
+	}
+}
+
+// modelSettingValue is the model's option value in the model select menu. Titles can be longer than
+// Discord allows for option values, so the model's hash is used instead, or its place in the list for
+// models that haven't been hashed yet.
+func modelSettingValue(idx int, model *stable_diffusion_api.Model) string {
+	if model.Hash != "" {
+		return "hash:" + model.Hash
+	}
+
+	return "index:" + strconv.Itoa(idx)
+}
+
+// modelFromSettingValue finds the model that was chosen in the model select menu.
+func modelFromSettingValue(models []*stable_diffusion_api.Model, value string) (*stable_diffusion_api.Model, error) {
+	for idx, model := range models {
+		if modelSettingValue(idx, model) == value {
+			return model, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown model %q", value)
+}
+
+func (b *botImpl) settingsMessageComponents(settings *entities.DefaultSettings,
+	scope imagine_queue.SettingsScope, page settingsPage,
+) []discordgo.MessageComponent {
+	var components []discordgo.MessageComponent
+
+	switch page {
+	case settingsPageSampling:
+		samplers, err := b.imagineQueue.ListSamplers()
+		if err != nil {
+			log.Printf("Error listing samplers for settings: %v", err)
+		}
+
+		if samplerComponent := samplerSettingComponent(settings, scope, samplers); samplerComponent != nil {
+			components = append(components, samplerComponent)
+		}
+
+		components = append(components, samplingSettingsComponents(settings, scope)...)
+	case settingsPagePrompt:
+		components = append(components, negativePromptSettingComponent(settings, scope))
+	case settingsPageDisplay:
+		components = append(components, attachmentModeSettingComponent(settings, scope))
+	default:
+		models, err := b.imagineQueue.ListModels()
+		if err != nil {
+			log.Printf("Error listing models for settings: %v", err)
+		}
+
+		components = settingsMessageComponents(settings, scope)
+
+		if modelComponent := modelSettingComponent(settings, scope, models); modelComponent != nil {
+			components = append(components, modelComponent)
+		}
+	}
+
+	return append(components, settingsButtonsComponents(settings, scope, page)...)
+}
+
+// samplerSettingComponent is the sampler select menu, or nil if the samplers couldn't be listed.
+func samplerSettingComponent(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope,
+	samplers []*stable_diffusion_api.Sampler,
+) discordgo.MessageComponent {
+	if len(samplers) == 0 {
+		return nil
+	}
+
+	minValues := 1
+
+	options := make([]discordgo.SelectMenuOption, 0, len(samplers))
+
+	for _, sampler := range samplers {
+		if len(options) >= maxSelectMenuOptions {
+			break
+		}
+
+		options = append(options, discordgo.SelectMenuOption{
+			Label:   imagine_queue.Truncate("Sampler: "+sampler.Name, 100),
+			Value:   imagine_queue.Truncate(sampler.Name, 100),
+			Default: settings.SamplerName == sampler.Name,
+		})
+	}
+
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				CustomID:  settingsCustomID("imagine_sampler_setting_menu", scope),
+				MinValues: &minValues,
+				MaxValues: 1,
+				Options:   options,
+			},
+		},
+	}
+}
+
+func formatCfgScale(cfgScale float64) string {
+	return strconv.FormatFloat(cfgScale, 'f', -1, 64)
+}
+
+// samplingSettingsComponents are the steps and CFG scale select menus. A value set through the
+// advanced settings that isn't one of the usual choices is added, so that it still shows as selected.
+func samplingSettingsComponents(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope) []discordgo.MessageComponent {
+	minValues := 1
+
+	steps := stepsSettingChoices
+	if !containsValue(steps, settings.Steps) {
+		steps = append([]int{settings.Steps}, steps...)
+		sort.Ints(steps)
+	}
+
+	stepsOptions := make([]discordgo.SelectMenuOption, 0, len(steps))
+
+	for _, value := range steps {
+		stepsOptions = append(stepsOptions, discordgo.SelectMenuOption{
+			Label:   fmt.Sprintf("Steps: %d", value),
+			Value:   strconv.Itoa(value),
+			Default: settings.Steps == value,
+		})
+	}
+
+	cfgScales := cfgScaleSettingChoices
+	if !containsValue(cfgScales, settings.CfgScale) {
+		cfgScales = append([]float64{settings.CfgScale}, cfgScales...)
+		sort.Float64s(cfgScales)
+	}
+
+	cfgScaleOptions := make([]discordgo.SelectMenuOption, 0, len(cfgScales))
+
+	for _, value := range cfgScales {
+		cfgScaleOptions = append(cfgScaleOptions, discordgo.SelectMenuOption{
+			Label:   "CFG scale: " + formatCfgScale(value),
+			Value:   formatCfgScale(value),
+			Default: settings.CfgScale == value,
+		})
+	}
+
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:  settingsCustomID("imagine_steps_setting_menu", scope),
+					MinValues: &minValues,
+					MaxValues: 1,
+					Options:   stepsOptions,
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:  settingsCustomID("imagine_cfg_scale_setting_menu", scope),
+					MinValues: &minValues,
+					MaxValues: 1,
+					Options:   cfgScaleOptions,
+				},
+			},
+		},
+	}
+}
+
+// negativePromptSettingComponent is the negative prompt presets select menu. A negative prompt that
+// was typed in is shown as a custom option.
+func negativePromptSettingComponent(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope) discordgo.MessageComponent {
+	minValues := 1
+
+	options := []discordgo.SelectMenuOption{
+		{
+			Label:       "Negative prompt: inherit",
+			Value:       negativePromptPresetInherit,
+			Description: "Use the negative prompt from the wider defaults",
+		},
+	}
+
+	custom := true
+
+	for _, preset := range negativePromptPresets {
+		isCurrent := settings.NegativePrompt != nil && *settings.NegativePrompt == preset.negativePrompt
+		if isCurrent {
+			custom = false
+		}
+
+		options = append(options, discordgo.SelectMenuOption{
+			Label:   preset.label,
+			Value:   preset.value,
+			Default: isCurrent,
+		})
+	}
+
+	if custom {
+		options = append(options, discordgo.SelectMenuOption{
+			Label:   "Negative prompt: custom",
+			Value:   negativePromptPresetCustom,
+			Default: true,
+		})
+	}
+
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				CustomID:  settingsCustomID("imagine_negative_prompt_setting_menu", scope),
+				MinValues: &minValues,
+				MaxValues: 1,
+				Options:   options,
+			},
+		},
+	}
+}
+
+func containsValue[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// settingsButtonsComponents are the rows of buttons at the bottom of the settings message: the buttons
+// belonging to the current page, if it has any, followed by the buttons for switching between pages.
+func settingsButtonsComponents(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope,
+	page settingsPage,
+) []discordgo.MessageComponent {
+	var buttons []discordgo.MessageComponent
+
+	if page == settingsPageDisplay {
+		showPreviews := settings.ShowPreviews != nil && *settings.ShowPreviews
+
+		showPreviewsButton := discordgo.Button{
+			Label:    "Previews: off",
+			Style:    discordgo.SecondaryButton,
+			CustomID: settingsCustomID("imagine_show_previews_setting_button", scope),
+		}
+
+		if showPreviews {
+			showPreviewsButton.Label = "Previews: on"
+			showPreviewsButton.Style = discordgo.SuccessButton
+		}
+
+		gridStyle := entities.GridStylePlain
+		if settings.GridStyle != nil {
+			gridStyle = *settings.GridStyle
+		}
+
+		gridStyleButton := discordgo.Button{
+			Label:    "Grid: " + string(gridStyle),
+			Style:    discordgo.SecondaryButton,
+			CustomID: settingsCustomID("imagine_grid_style_setting_button", scope),
+		}
+
+		if gridStyle != entities.GridStylePlain {
+			gridStyleButton.Style = discordgo.SuccessButton
+		}
+
+		buttons = append(buttons, showPreviewsButton, gridStyleButton)
+	}
+
+	if page == settingsPageSampling {
+		restoreFaces := settings.RestoreFaces != nil && *settings.RestoreFaces
+
+		restoreFacesButton := discordgo.Button{
+			Label:    "Restore faces: off",
+			Style:    discordgo.SecondaryButton,
+			CustomID: settingsCustomID("imagine_restore_faces_setting_button", scope),
+		}
+
+		if restoreFaces {
+			restoreFacesButton.Label = "Restore faces: on"
+			restoreFacesButton.Style = discordgo.SuccessButton
+		}
+
+		buttons = append(buttons, restoreFacesButton, discordgo.Button{
+			Label:    "Advanced...",
+			Style:    discordgo.SecondaryButton,
+			CustomID: settingsCustomID("imagine_advanced_settings_button", scope),
+		})
+	}
+
+	if page == settingsPagePrompt {
+		buttons = append(buttons, discordgo.Button{
+			Label:    "Edit negative prompt...",
+			Style:    discordgo.SecondaryButton,
+			CustomID: settingsCustomID("imagine_negative_prompt_settings_button", scope),
+		})
+	}
+
+	var rows []discordgo.MessageComponent
+
+	if len(buttons) > 0 {
+		rows = append(rows, discordgo.ActionsRow{
+			Components: buttons,
+		})
+	}
+
+	pageButtons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "General",
+			Style:    discordgo.PrimaryButton,
+			CustomID: settingsCustomID("imagine_settings_page_"+string(settingsPageGeneral), scope),
+			Disabled: page == settingsPageGeneral,
+		},
+		discordgo.Button{
+			Label:    "Sampling",
+			Style:    discordgo.PrimaryButton,
+			CustomID: settingsCustomID("imagine_settings_page_"+string(settingsPageSampling), scope),
+			Disabled: page == settingsPageSampling,
+		},
+		discordgo.Button{
+			Label:    "Prompt",
+			Style:    discordgo.PrimaryButton,
+			CustomID: settingsCustomID("imagine_settings_page_"+string(settingsPagePrompt), scope),
+			Disabled: page == settingsPagePrompt,
+		},
+		discordgo.Button{
+			Label:    "Display",
+			Style:    discordgo.PrimaryButton,
+			CustomID: settingsCustomID("imagine_settings_page_"+string(settingsPageDisplay), scope),
+			Disabled: page == settingsPageDisplay,
+		},
+	}
+
+	return append(rows, discordgo.ActionsRow{
+		Components: pageButtons,
+	})
+}
+
+// attachmentModeSettingComponent is the select menu for which images are attached to replies.
+func attachmentModeSettingComponent(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope) discordgo.MessageComponent {
+	minValues := 1
+
+	attachmentMode := entities.AttachmentModeGrid
+	if settings.AttachmentMode != nil {
+		attachmentMode = *settings.AttachmentMode
+	}
+
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				CustomID:  settingsCustomID("imagine_attachment_mode_setting_menu", scope),
+				MinValues: &minValues,
+				MaxValues: 1,
+				Options: []discordgo.SelectMenuOption{
+					{
+						Label:   "Attach: the grid",
+						Value:   string(entities.AttachmentModeGrid),
+						Default: attachmentMode == entities.AttachmentModeGrid,
+					},
+					{
+						Label:   "Attach: the grid and each image",
+						Value:   string(entities.AttachmentModeGridAndTiles),
+						Default: attachmentMode == entities.AttachmentModeGridAndTiles,
+					},
+					{
+						Label:   "Attach: each image, without the grid",
+						Value:   string(entities.AttachmentModeTiles),
+						Default: attachmentMode == entities.AttachmentModeTiles,
+					},
+				},
+			},
+		},
+	}
+}
+
+func settingsMessageComponents(settings *entities.DefaultSettings, scope imagine_queue.SettingsScope) []discordgo.MessageComponent {
+	minValues := 1
+
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:  settingsCustomID("imagine_dimension_setting_menu", scope),
+					MinValues: &minValues,
+					MaxValues: 1,
+					Options: []discordgo.SelectMenuOption{
+						{
+							Label:   "Size: 512x512",
+							Value:   "512_512",
+							Default: settings.Width == 512 && settings.Height == 512,
+						},
+						{
+							Label:   "Size: 768x768",
+							Value:   "768_768",
+							Default: settings.Width == 768 && settings.Height == 768,
+						},
+					},
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:  settingsCustomID("imagine_batch_count_setting_menu", scope),
+					MinValues: &minValues,
+					MaxValues: 1,
+					Options: []discordgo.SelectMenuOption{
+						{
+							Label:   "Batch count: 1",
+							Value:   "1",
+							Default: settings.BatchCount == 1,
+						},
+						{
+							Label:   "Batch count: 2",
+							Value:   "2",
+							Default: settings.BatchCount == 2,
+						},
+						{
+							Label:   "Batch count: 4",
+							Value:   "4",
+							Default: settings.BatchCount == 4,
+						},
+					},
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID:  settingsCustomID("imagine_batch_size_setting_menu", scope),
+					MinValues: &minValues,
+					MaxValues: 1,
+					Options: []discordgo.SelectMenuOption{
+						{
+							Label:   "Batch size: 1",
+							Value:   "1",
+							Default: settings.BatchSize == 1,
+						},
+						{
+							Label:   "Batch size: 2",
+							Value:   "2",
+							Default: settings.BatchSize == 2,
+						},
+						{
+							Label:   "Batch size: 4",
+							Value:   "4",
+							Default: settings.BatchSize == 4,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// respondSettingsPermissionDenied tells the user they can only change their own settings.
+func respondSettingsPermissionDenied(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "Only members with the Manage Server permission can change the channel or server defaults.",
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
+
+func (b *botImpl) processImagineSettingsCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	scope := imagine_queue.SettingsScopeUser
+
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "scope" {
+			scope = settingsScopeFromName(option.StringValue())
+		}
+	}
+
+	if scope != imagine_queue.SettingsScopeUser && !canManageServer(i) {
+		respondSettingsPermissionDenied(s, i)
+
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(settingsTarget(i, scope))
+	if err != nil {
+		log.Printf("error getting default settings for settings command: %v", err)
+
+		return
+	}
+
+	messageComponents := b.settingsMessageComponents(settings, scope, settingsPageGeneral)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Title:      "Settings",
+			Content:    settingsMessageContent(settings, scope, settingsPageGeneral),
+			Components: messageComponents,
+			Flags:      discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
+
+// settingsComponentTarget returns the settings being edited by a settings component or modal, or nil
+// if the user isn't allowed to edit them (in which case they have already been told so).
+func settingsComponentTarget(s *discordgo.Session, i *discordgo.InteractionCreate) *imagine_queue.SettingsTarget {
+	var customID string
+
+	if i.Type == discordgo.InteractionModalSubmit {
+		customID = i.ModalSubmitData().CustomID
+	} else {
+		customID = i.MessageComponentData().CustomID
+	}
+
+	scope := settingsScopeFromCustomID(customID)
+
+	if scope != imagine_queue.SettingsScopeUser && !canManageServer(i) {
+		respondSettingsPermissionDenied(s, i)
+
+		return nil
+	}
+
+	return settingsTarget(i, scope)
+}
+
+// respondUpdatedSettings edits the settings message in place, after a setting has been changed.
+func (b *botImpl) respondUpdatedSettings(s *discordgo.Session, i *discordgo.InteractionCreate,
+	target *imagine_queue.SettingsTarget, page settingsPage, settings *entities.DefaultSettings, updateErr error,
+	errorContent string,
+) {
+	if updateErr != nil {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content: errorContent,
+			},
+		})
+		if err != nil {
+			log.Printf("Error responding to interaction: %v", err)
+		}
+
+		return
+	}
+
+	messageComponents := b.settingsMessageComponents(settings, target.Scope, page)
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    settingsMessageContent(settings, target.Scope, page),
+			Components: messageComponents,
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
+
+func (b *botImpl) processImagineDimensionSetting(s *discordgo.Session, i *discordgo.InteractionCreate, width, height int) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultDimensions(target, width, height)
+	if err != nil {
+		log.Printf("error updating default dimensions: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageGeneral, settings, err, "Error updating default dimensions...")
+}
+
+func (b *botImpl) processImagineBatchSetting(s *discordgo.Session, i *discordgo.InteractionCreate, batchCount, batchSize int) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultBatch(target, batchCount, batchSize)
+	if err != nil {
+		log.Printf("error updating batch settings: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageGeneral, settings, err, "Error updating batch settings...")
+}
+
+func (b *botImpl) processImagineModelSetting(s *discordgo.Session, i *discordgo.InteractionCreate, value string) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	model := ""
+
+	if value != defaultModelValue {
+		models, err := b.imagineQueue.ListModels()
+		if err != nil {
+			log.Printf("Error listing models for model setting: %v", err)
+		}
+
+		chosenModel, err := modelFromSettingValue(models, value)
+		if err != nil {
+			log.Printf("error updating model setting: %v", err)
+
+			b.respondUpdatedSettings(s, i, target, settingsPageGeneral, nil, err, "Error updating default model...")
+
+			return
+		}
+
+		model = chosenModel.Title
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultModel(target, model)
+	if err != nil {
+		log.Printf("error updating model setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageGeneral, settings, err, "Error updating default model...")
+}
+
+func (b *botImpl) processImagineSettingsPage(s *discordgo.Session, i *discordgo.InteractionCreate, page settingsPage) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(target)
+	if err != nil {
+		log.Printf("error getting default settings for settings page: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, page, settings, err, "Error getting default settings...")
+}
+
+func (b *botImpl) processImagineSamplerSetting(s *discordgo.Session, i *discordgo.InteractionCreate, samplerName string) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultSampler(target, samplerName)
+	if err != nil {
+		log.Printf("error updating sampler setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageSampling, settings, err, "Error updating default sampler...")
+}
+
+func (b *botImpl) processImagineStepsSetting(s *discordgo.Session, i *discordgo.InteractionCreate, steps int) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultSteps(target, steps)
+	if err != nil {
+		log.Printf("error updating steps setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageSampling, settings, err, "Error updating default steps...")
+}
+
+func (b *botImpl) processImagineCfgScaleSetting(s *discordgo.Session, i *discordgo.InteractionCreate, cfgScale float64) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultCfgScale(target, cfgScale)
+	if err != nil {
+		log.Printf("error updating CFG scale setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageSampling, settings, err, "Error updating default CFG scale...")
+}
+
+func (b *botImpl) processImagineRestoreFacesSetting(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(target)
+	if err != nil {
+		log.Printf("error getting default settings for restore faces setting: %v", err)
+
+		b.respondUpdatedSettings(s, i, target, settingsPageSampling, nil, err, "Error updating restore faces...")
+
+		return
+	}
+
+	restoreFaces := settings.RestoreFaces == nil || !*settings.RestoreFaces
+
+	settings, err = b.imagineQueue.UpdateDefaultRestoreFaces(target, restoreFaces)
+	if err != nil {
+		log.Printf("error updating restore faces setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageSampling, settings, err, "Error updating restore faces...")
+}
+
+func (b *botImpl) processImagineShowPreviewsSetting(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(target)
+	if err != nil {
+		log.Printf("error getting default settings for show previews setting: %v", err)
+
+		b.respondUpdatedSettings(s, i, target, settingsPageDisplay, nil, err, "Error updating previews...")
+
+		return
+	}
+
+	showPreviews := settings.ShowPreviews == nil || !*settings.ShowPreviews
+
+	settings, err = b.imagineQueue.UpdateDefaultShowPreviews(target, showPreviews)
+	if err != nil {
+		log.Printf("error updating show previews setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageDisplay, settings, err, "Error updating previews...")
+}
+
+// nextGridStyle is the grid style that the grid style button switches to.
+func nextGridStyle(gridStyle *entities.GridStyle) entities.GridStyle {
+	if gridStyle == nil {
+		return entities.GridStyleNumbered
+	}
+
+	switch *gridStyle {
+	case entities.GridStylePlain:
+		return entities.GridStyleNumbered
+	case entities.GridStyleNumbered:
+		return entities.GridStyleCaptioned
+	default:
+		return entities.GridStylePlain
+	}
+}
+
+func (b *botImpl) processImagineGridStyleSetting(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(target)
+	if err != nil {
+		log.Printf("error getting default settings for grid style setting: %v", err)
+
+		b.respondUpdatedSettings(s, i, target, settingsPageDisplay, nil, err, "Error updating grid style...")
+
+		return
+	}
+
+	settings, err = b.imagineQueue.UpdateDefaultGridStyle(target, nextGridStyle(settings.GridStyle))
+	if err != nil {
+		log.Printf("error updating grid style setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageDisplay, settings, err, "Error updating grid style...")
+}
+
+func (b *botImpl) processImagineAttachmentModeSetting(s *discordgo.Session, i *discordgo.InteractionCreate,
+	attachmentMode entities.AttachmentMode,
+) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultAttachmentMode(target, attachmentMode)
+	if err != nil {
+		log.Printf("error updating attachment mode setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageDisplay, settings, err, "Error updating attachments...")
+}
+
+// processImagineAdvancedSettingsButton opens a modal for typing in settings that don't fit in a select menu.
+func (b *botImpl) processImagineAdvancedSettingsButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(target)
+	if err != nil {
+		log.Printf("error getting default settings for advanced settings: %v", err)
+
+		return
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: settingsCustomID("imagine_advanced_settings_modal", target.Scope),
+			Title:    "Advanced settings",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  "steps",
+							Label:     "Steps (1-150)",
+							Style:     discordgo.TextInputShort,
+							Value:     strconv.Itoa(settings.Steps),
+							Required:  true,
+							MaxLength: 3,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  "cfg_scale",
+							Label:     "CFG scale (1-30)",
+							Style:     discordgo.TextInputShort,
+							Value:     formatCfgScale(settings.CfgScale),
+							Required:  true,
+							MaxLength: 5,
+						},
+					},
+				},
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  "denoising_strength",
+							Label:     "Denoising strength (0-1)",
+							Style:     discordgo.TextInputShort,
+							Value:     strconv.FormatFloat(settings.DenoisingStrength, 'f', -1, 64),
+							Required:  true,
+							MaxLength: 5,
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
+
+// modalTextInputValues returns the values typed into a modal, by the custom IDs of the text inputs.
+func modalTextInputValues(data discordgo.ModalSubmitInteractionData) map[string]string {
+	values := make(map[string]string)
+
+	for _, component := range data.Components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+
+		for _, rowComponent := range row.Components {
+			if input, ok := rowComponent.(*discordgo.TextInput); ok {
+				values[input.CustomID] = strings.TrimSpace(input.Value)
+			}
+		}
+	}
+
+	return values
+}
+
+func (b *botImpl) processImagineAdvancedSettingsModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	values := modalTextInputValues(i.ModalSubmitData())
+
+	steps, err := strconv.Atoi(values["steps"])
+	if err != nil {
+		b.respondUpdatedSettings(s, i, target, settingsPageSampling, nil, err, "Steps must be a whole number.")
+
+		return
+	}
+
+	cfgScale, err := strconv.ParseFloat(values["cfg_scale"], 64)
+	if err != nil {
+		b.respondUpdatedSettings(s, i, target, settingsPageSampling, nil, err, "CFG scale must be a number.")
+
+		return
+	}
+
+	denoisingStrength, err := strconv.ParseFloat(values["denoising_strength"], 64)
+	if err != nil {
+		b.respondUpdatedSettings(s, i, target, settingsPageSampling, nil, err, "Denoising strength must be a number.")
+
+		return
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultAdvanced(target, steps, cfgScale, denoisingStrength)
+	if err != nil {
+		log.Printf("error updating advanced settings: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPageSampling, settings, err,
+		fmt.Sprintf("Error updating advanced settings: %v", err))
+}
+
+func (b *botImpl) processImagineNegativePromptSetting(s *discordgo.Session, i *discordgo.InteractionCreate, presetValue string) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	if presetValue == negativePromptPresetCustom {
+		// the custom negative prompt is already the current one, so there's nothing to change
+		b.processImagineSettingsPage(s, i, settingsPagePrompt)
+
+		return
+	}
+
+	var negativePrompt *string
+
+	for _, preset := range negativePromptPresets {
+		if preset.value == presetValue {
+			presetNegativePrompt := preset.negativePrompt
+			negativePrompt = &presetNegativePrompt
+		}
+	}
+
+	settings, err := b.imagineQueue.UpdateDefaultNegativePrompt(target, negativePrompt)
+	if err != nil {
+		log.Printf("error updating negative prompt setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPagePrompt, settings, err, "Error updating default negative prompt...")
+}
+
+// processImagineNegativePromptSettingsButton opens a modal for typing in a custom negative prompt.
+func (b *botImpl) processImagineNegativePromptSettingsButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	settings, err := b.imagineQueue.GetDefaultSettings(target)
+	if err != nil {
+		log.Printf("error getting default settings for negative prompt: %v", err)
+
+		return
+	}
+
+	negativePrompt := ""
+	if settings.NegativePrompt != nil {
+		negativePrompt = *settings.NegativePrompt
+	}
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: settingsCustomID("imagine_negative_prompt_settings_modal", target.Scope),
+			Title:    "Default negative prompt",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "negative_prompt",
+							Label:       "Negative prompt (leave empty for none)",
+							Style:       discordgo.TextInputParagraph,
+							Value:       imagine_queue.Truncate(negativePrompt, maxNegativePromptLength),
+							Required:    false,
+							MaxLength:   maxNegativePromptLength,
+							Placeholder: "ugly, blurry, text, watermark",
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
+
+func (b *botImpl) processImagineNegativePromptSettingsModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	target := settingsComponentTarget(s, i)
+	if target == nil {
+		return
+	}
+
+	negativePrompt := modalTextInputValues(i.ModalSubmitData())["negative_prompt"]
+
+	settings, err := b.imagineQueue.UpdateDefaultNegativePrompt(target, &negativePrompt)
+	if err != nil {
+		log.Printf("error updating negative prompt setting: %v", err)
+	}
+
+	b.respondUpdatedSettings(s, i, target, settingsPagePrompt, settings, err, "Error updating default negative prompt...")
+}
@@ -0,0 +1,167 @@
+package discord_bot
+
+import (
+	"log"
+	"stable_diffusion_bot/imagine_queue"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func (b *botImpl) imagineSweepCommandString() string {
+	if b.developmentMode {
+		return "dev_" + b.imagineCommand + "_sweep"
+	}
+
+	return b.imagineCommand + "_sweep"
+}
+
+func (b *botImpl) addImagineSweepCommand() error {
+	log.Printf("Adding command '%s'...", b.imagineSweepCommandString())
+
+	minFrames := float64(imagine_queue.MinSweepFrames)
+	minValue := float64(0)
+
+	cmd, err := b.botSession.ApplicationCommandCreate(b.botSession.State.User.ID, b.guildID, &discordgo.ApplicationCommand{
+		Name:        b.imagineSweepCommandString(),
+		Description: "Ask the bot to animate a setting changing, one frame at a time",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "The text prompt to imagine",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "setting",
+				Description: "The setting that changes from frame to frame",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{
+						Name:  "Variation strength (0 to 1)",
+						Value: string(imagine_queue.SweepParameterVariationStrength),
+					},
+					{
+						Name:  "CFG scale (3 to 15)",
+						Value: string(imagine_queue.SweepParameterCfgScale),
+					},
+					{
+						Name:  "Steps (10 to 50)",
+						Value: string(imagine_queue.SweepParameterSteps),
+					},
+					{
+						Name:  "Blend into the end prompt (0 to 1)",
+						Value: string(imagine_queue.SweepParameterPromptBlend),
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "end_prompt",
+				Description: "The prompt to blend into, when blending prompts",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionNumber,
+				Name:        "from",
+				Description: "The setting's value in the first frame, instead of the start of its usual range",
+				MinValue:    &minValue,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionNumber,
+				Name:        "to",
+				Description: "The setting's value in the last frame, instead of the end of its usual range",
+				MinValue:    &minValue,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "frames",
+				Description: "How many frames to imagine (default 8)",
+				MinValue:    &minFrames,
+				MaxValue:    imagine_queue.MaxSweepFrames,
+			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "model",
+				Description:  "The model checkpoint to imagine with, instead of the default",
+				Autocomplete: true,
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error creating '%s' command: %v", b.imagineSweepCommandString(), err)
+
+		return err
+	}
+
+	b.registeredCommands = append(b.registeredCommands, cmd)
+
+	return nil
+}
+
+func (b *botImpl) processImagineSweepCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+
+	sweep := &imagine_queue.SweepOptions{
+		Frames: imagine_queue.DefaultSweepFrames,
+	}
+
+	if option, ok := optionMap["setting"]; ok {
+		sweep.Parameter = imagine_queue.SweepParameter(option.StringValue())
+	}
+
+	sweep.From, sweep.To = imagine_queue.DefaultSweepRange(sweep.Parameter)
+
+	if option, ok := optionMap["from"]; ok {
+		sweep.From = option.FloatValue()
+	}
+
+	if option, ok := optionMap["to"]; ok {
+		sweep.To = option.FloatValue()
+	}
+
+	if option, ok := optionMap["frames"]; ok {
+		sweep.Frames = int(option.IntValue())
+	}
+
+	if option, ok := optionMap["end_prompt"]; ok {
+		sweep.EndPrompt = option.StringValue()
+	}
+
+	queueItem := &imagine_queue.QueueItem{
+		Type:               imagine_queue.ItemTypeSweep,
+		DiscordInteraction: i.Interaction,
+		Sweep:              sweep,
+	}
+
+	if option, ok := optionMap["prompt"]; ok {
+		queueItem.Prompt = option.StringValue()
+	}
+
+	if option, ok := optionMap["model"]; ok {
+		queueItem.Model = option.StringValue()
+	}
+
+	position, queueError := b.imagineQueue.AddImagine(queueItem)
+	if queueError != nil {
+		log.Printf("Error adding imagine to queue: %v\n", queueError)
+
+		respondWithQueueError(s, i, queueError)
+
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: imagine_queue.QueuedMessageContent(queueItem, position),
+		},
+	})
+	if err != nil {
+		log.Printf("Error responding to interaction: %v", err)
+	}
+}
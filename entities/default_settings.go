@@ -1,9 +1,47 @@
 package entities
 
+// GridStyle is how much is drawn onto grids, on top of the images.
+type GridStyle string
+
+const (
+	// GridStylePlain grids only have the images
+	GridStylePlain GridStyle = "plain"
+	// GridStyleNumbered grids have each tile numbered, in the same order as their buttons
+	GridStyleNumbered GridStyle = "numbered"
+	// GridStyleCaptioned grids are numbered, have space between the tiles, and a caption with their settings
+	GridStyleCaptioned GridStyle = "captioned"
+)
+
+// AttachmentMode is which images are attached to the reply to an imagine.
+type AttachmentMode string
+
+const (
+	// AttachmentModeGrid attaches just the grid
+	AttachmentModeGrid AttachmentMode = "grid"
+	// AttachmentModeGridAndTiles attaches the grid, followed by each of its images
+	AttachmentModeGridAndTiles AttachmentMode = "grid_and_tiles"
+	// AttachmentModeTiles attaches each of the images, without the grid
+	AttachmentModeTiles AttachmentMode = "tiles"
+)
+
 type DefaultSettings struct {
 	MemberID   string `json:"member_id"`
 	Width      int    `json:"width"`
 	Height     int    `json:"height"`
 	BatchCount int    `json:"batch_count"`
 	BatchSize  int    `json:"batch_size"`
+	Model      string `json:"model"`
+
+	SamplerName       string  `json:"sampler_name"`
+	Steps             int     `json:"steps"`
+	CfgScale          float64 `json:"cfg_scale"`
+	RestoreFaces      *bool   `json:"restore_faces"`
+	DenoisingStrength float64 `json:"denoising_strength"`
+
+	NegativePrompt *string `json:"negative_prompt"`
+
+	ShowPreviews *bool `json:"show_previews"`
+
+	GridStyle      *GridStyle      `json:"grid_style"`
+	AttachmentMode *AttachmentMode `json:"attachment_mode"`
 }
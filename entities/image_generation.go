@@ -16,6 +16,7 @@ type ImageGeneration struct {
 	EnableHR          bool      `json:"enable_hr"`
 	HiresWidth        int       `json:"hires_width"`
 	HiresHeight       int       `json:"hires_height"`
+	HiresUpscaler     string    `json:"hires_upscaler"`
 	DenoisingStrength float64   `json:"denoising_strength"`
 	BatchCount        int       `json:"batch_count"`
 	BatchSize         int       `json:"batch_size"`
@@ -25,6 +26,21 @@ type ImageGeneration struct {
 	SamplerName       string    `json:"sampler_name"`
 	CfgScale          float64   `json:"cfg_scale"`
 	Steps             int       `json:"steps"`
+	Model             string    `json:"model"`
+	ModelHash         string    `json:"model_hash"`
+	Backend           string    `json:"backend"`
+	ImagePath         string    `json:"image_path"`
+	UpscaledImagePath string    `json:"upscaled_image_path"`
+	InitImageURL      string    `json:"init_image_url"`
+	ResizeMode        int       `json:"resize_mode"`
+	MaskImageURL      string    `json:"mask_image_url"`
+	MaskTile          int       `json:"mask_tile"`
+	MaskBlur          int       `json:"mask_blur"`
+	InpaintingFill    int       `json:"inpainting_fill"`
+	InpaintFullRes    bool      `json:"inpaint_full_res"`
+	InitImagePath     string    `json:"init_image_path"`
+	MaskImagePath     string    `json:"mask_image_path"`
+	GridMessageID     string    `json:"grid_message_id"`
 	Processed         bool      `json:"processed"`
 	CreatedAt         time.Time `json:"created_at"`
 }
@@ -0,0 +1,26 @@
+package entities
+
+import "time"
+
+type QueueItemStatus string
+
+const (
+	// QueueItemStatusQueued is an item that is waiting in line
+	QueueItemStatusQueued QueueItemStatus = "queued"
+	// QueueItemStatusRunning is an item that has been handed to a backend
+	QueueItemStatusRunning QueueItemStatus = "running"
+	// QueueItemStatusFinished is an item that has been processed, whether it worked or not
+	QueueItemStatusFinished QueueItemStatus = "finished"
+)
+
+// QueueItem is an imagine that was added to the queue. It's kept so that the queue can be picked up
+// again after the bot restarts, and for a while after it has been processed, to count how much each
+// member has used the bot.
+type QueueItem struct {
+	ID        int64           `json:"id"`
+	MemberID  string          `json:"member_id"`
+	Payload   string          `json:"payload"`
+	Status    QueueItemStatus `json:"status"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt time.Time       `json:"created_at"`
+}
@@ -0,0 +1,9 @@
+package entities
+
+// UserLimits overrides how much a member can use the bot. A nil limit uses the bot's default, and a
+// limit of 0 means there is no limit.
+type UserLimits struct {
+	MemberID   string `json:"member_id"`
+	MaxQueued  *int   `json:"max_queued"`
+	MaxPerHour *int   `json:"max_per_hour"`
+}
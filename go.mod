@@ -3,7 +3,8 @@ module stable_diffusion_bot
 go 1.19
 
 require (
-	github.com/bwmarrin/discordgo v0.26.1
+	github.com/bwmarrin/discordgo v0.28.1
+	golang.org/x/image v0.15.0
 	modernc.org/sqlite v1.20.1
 )
 
@@ -0,0 +1,214 @@
+package image_storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type diskStorage struct {
+	dir       string
+	retention time.Duration
+}
+
+type Config struct {
+	// Dir is the directory the images are kept in, which is created if it doesn't exist
+	Dir string
+
+	// Retention is how long images are kept after they were last saved. 0 keeps them forever.
+	Retention time.Duration
+}
+
+func New(cfg Config) (Storage, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("missing image directory")
+	}
+
+	if cfg.Retention < 0 {
+		return nil, errors.New("retention can't be negative")
+	}
+
+	err := os.MkdirAll(cfg.Dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskStorage{
+		dir:       cfg.Dir,
+		retention: cfg.Retention,
+	}, nil
+}
+
+// imageExtensions are the file extensions for the image types that are recognised from their contents.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var (
+	// storedDirRegex and storedNameRegex match the subdirectories and file names that Save uses, so that
+	// nothing else in the directory is touched when pruning
+	storedDirRegex  = regexp.MustCompile(`^[0-9a-f]{2}$`)
+	storedNameRegex = regexp.MustCompile(`^[0-9a-f]{64}(\.[a-z]+)?$`)
+)
+
+// Save stores the image under the hash of its contents, so saving the same image twice only keeps one
+// copy of it. It returns the image's path within the storage, which is what it's loaded by later.
+func (s *diskStorage) Save(image []byte) (string, error) {
+	if len(image) == 0 {
+		return "", errors.New("missing image")
+	}
+
+	path := s.Path(image)
+	fullPath := filepath.Join(s.dir, path)
+	name := filepath.Base(path)
+
+	_, err := os.Stat(fullPath)
+	if err == nil {
+		// saving it again counts as using it, for the retention
+		now := time.Now()
+
+		return path, os.Chtimes(fullPath, now, now)
+	}
+
+	err = os.MkdirAll(filepath.Dir(fullPath), 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	// the image is written to a temporary file first, so that a half written image is never loaded
+	tempFile, err := os.CreateTemp(filepath.Dir(fullPath), name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tempFile.Write(image)
+
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tempFile.Name(), fullPath)
+	}
+
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Path is the path that Save stores the image under, which is the same for every copy of the image.
+func (s *diskStorage) Path(image []byte) string {
+	hash := sha256.Sum256(image)
+	name := hex.EncodeToString(hash[:]) + imageExtensions[http.DetectContentType(image)]
+
+	// the images are spread over subdirectories, so that no directory gets too big
+	return filepath.Join(name[:2], name)
+}
+
+// fullPath turns a path from Save into one on disk, refusing paths outside of the storage.
+func (s *diskStorage) fullPath(path string) (string, error) {
+	cleanPath := filepath.Clean(path)
+
+	if path == "" || filepath.IsAbs(cleanPath) || cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid image path")
+	}
+
+	return filepath.Join(s.dir, cleanPath), nil
+}
+
+func (s *diskStorage) Load(path string) ([]byte, error) {
+	fullPath, err := s.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(fullPath)
+}
+
+// Delete removes the image. Images that are already gone are ignored.
+func (s *diskStorage) Delete(path string) error {
+	fullPath, err := s.fullPath(path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(fullPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Prune removes the images that haven't been saved for longer than the retention, and returns the
+// paths of the images that were removed. Only files named the way Save names them are removed, in case
+// the directory is shared with anything else.
+func (s *diskStorage) Prune() ([]string, error) {
+	if s.retention == 0 {
+		return nil, nil
+	}
+
+	cutoff := time.Now().Add(-s.retention)
+
+	var removed []string
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		relPath, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if relPath != "." && !storedDirRegex.MatchString(relPath) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		name := entry.Name()
+
+		if !entry.Type().IsRegular() || !storedNameRegex.MatchString(name) || filepath.Dir(relPath) != name[:2] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		removed = append(removed, relPath)
+
+		return nil
+	})
+
+	return removed, err
+}
@@ -0,0 +1,9 @@
+package image_storage
+
+type Storage interface {
+	Save(image []byte) (string, error)
+	Path(image []byte) string
+	Load(path string) ([]byte, error)
+	Delete(path string) error
+	Prune() ([]string, error)
+}
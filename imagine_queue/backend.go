@@ -0,0 +1,153 @@
+package imagine_queue
+
+import (
+	"context"
+	"log"
+	"stable_diffusion_bot/stable_diffusion_api"
+	"time"
+)
+
+const (
+	// healthCheckInterval is how often each backend's API is checked, to find out whether it can be sent work.
+	healthCheckInterval = 30 * time.Second
+
+	// apiCallTimeout is how long to wait for the API to answer a call that should be quick, like
+	// getting the progress. Generating and loading models can take much longer, so they rely on the
+	// API client's timeout instead.
+	apiCallTimeout = 30 * time.Second
+)
+
+// apiCallContext is the context for an API call that should be quick.
+func apiCallContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), apiCallTimeout)
+}
+
+// backend is one Automatic1111 API that the queue sends items to. Its fields are guarded by the queue's mutex.
+type backend struct {
+	api stable_diffusion_api.StableDiffusionAPI
+
+	// currentImagine is the item the backend is working on, or nil if it's idle
+	currentImagine *QueueItem
+
+	// interrupting is set while the item the backend is working on is being interrupted, so that it isn't
+	// handed another item that the interrupt would stop instead
+	interrupting bool
+
+	// currentModel is the checkpoint the backend last loaded, or empty if that isn't known
+	currentModel string
+
+	healthy         bool
+	checkingHealth  bool
+	lastHealthCheck time.Time
+}
+
+func newBackend(api stable_diffusion_api.StableDiffusionAPI) *backend {
+	return &backend{
+		api: api,
+	}
+}
+
+func (b *backend) host() string {
+	return b.api.Host()
+}
+
+func (b *backend) idle() bool {
+	return b.healthy && b.currentImagine == nil && !b.interrupting
+}
+
+// checkBackendsHealth starts a health check for each backend that is due one. Backends that are busy
+// are known to be working, so they are only checked once they are idle again.
+func (q *queueImpl) checkBackendsHealth() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, b := range q.backends {
+		if b.checkingHealth || b.currentImagine != nil || time.Since(b.lastHealthCheck) < healthCheckInterval {
+			continue
+		}
+
+		b.checkingHealth = true
+
+		go q.checkBackendHealth(b)
+	}
+}
+
+// checkBackendHealth asks the backend for its progress, and marks it as unhealthy if it doesn't answer.
+func (q *queueImpl) checkBackendHealth(b *backend) {
+	_, err := q.currentProgress(b)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	healthy := err == nil
+
+	if healthy && !b.healthy {
+		log.Printf("Backend %s is healthy", b.host())
+	} else if !healthy && b.healthy {
+		log.Printf("Backend %s is unhealthy: %v", b.host(), err)
+	} else if !healthy && b.lastHealthCheck.IsZero() {
+		log.Printf("Backend %s is unavailable: %v", b.host(), err)
+	}
+
+	if !healthy {
+		// the backend may have restarted with a different checkpoint
+		b.currentModel = ""
+	}
+
+	b.healthy = healthy
+	b.checkingHealth = false
+	b.lastHealthCheck = time.Now()
+}
+
+// currentProgress asks the backend how far it has got with what it's working on.
+func (q *queueImpl) currentProgress(b *backend) (*stable_diffusion_api.ProgressResponse, error) {
+	ctx, cancel := apiCallContext()
+	defer cancel()
+
+	return b.api.GetCurrentProgress(ctx)
+}
+
+// recheckBackend makes the backend get checked on the next poll, e.g. after a request to it failed.
+func (q *queueImpl) recheckBackend(b *backend) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	b.lastHealthCheck = time.Time{}
+}
+
+// idleBackend returns an idle backend, preferring one that already has the model loaded, or nil if
+// every backend is busy or unhealthy. It must be called with the queue's mutex held.
+func (q *queueImpl) idleBackend(model string) *backend {
+	var firstIdle *backend
+
+	for _, b := range q.backends {
+		if !b.idle() {
+			continue
+		}
+
+		if model != "" && b.currentModel == model {
+			return b
+		}
+
+		if firstIdle == nil {
+			firstIdle = b
+		}
+	}
+
+	return firstIdle
+}
+
+// anyAPI returns an API to ask about things that are the same on every backend, like the available
+// models. A healthy backend is preferred.
+func (q *queueImpl) anyAPI() stable_diffusion_api.StableDiffusionAPI {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, b := range q.backends {
+		if b.healthy {
+			return b.api
+		}
+	}
+
+	return q.backends[0].api
+}
@@ -0,0 +1,510 @@
+package imagine_queue
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"stable_diffusion_bot/composite_renderer"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/png_info"
+	"stable_diffusion_bot/stable_diffusion_api"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxInitImageBytes caps how much we are willing to download for a source image.
+	maxInitImageBytes = 25 * 1024 * 1024
+
+	// downloadTimeout is how long downloading a source image can take, so that a stalled download
+	// can't hold up a backend
+	downloadTimeout = 60 * time.Second
+
+	// maxSlugLength is about how much of the prompt goes into the names of attached images
+	maxSlugLength = 50
+)
+
+// downloadClient is the client that images are downloaded with.
+var downloadClient = &http.Client{
+	Timeout: downloadTimeout,
+}
+
+// downloadImage fetches an image, e.g. a Discord attachment.
+func downloadImage(url string) ([]byte, error) {
+	if url == "" {
+		return nil, errors.New("missing image URL")
+	}
+
+	response, err := downloadClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status downloading image: %s", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxInitImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxInitImageBytes {
+		return nil, errors.New("image is too large")
+	}
+
+	return body, nil
+}
+
+// InpaintTileError is returned when the tile to repaint isn't one of the grid's tiles. Its message is
+// meant to be shown to the user as-is.
+type InpaintTileError struct {
+	Tile  int
+	Count int
+}
+
+func (e *InpaintTileError) Error() string {
+	if e.Count == 0 {
+		return fmt.Sprintf("I couldn't find which of my grids the image is, so I can't tell where tile %d is. "+
+			"Use the grid option with a link to my reply with the grid.", e.Tile)
+	}
+
+	if e.Count == 1 {
+		return fmt.Sprintf("there is no tile %d, as the image isn't a grid", e.Tile)
+	}
+
+	return fmt.Sprintf("there is no tile %d, as the grid only has %d images", e.Tile, e.Count)
+}
+
+// gridTileLayout is how the tiles of the generation's source image are laid out, and how many images
+// are tiled in it. The grid is looked up by the bot's reply with it, or else by the image's contents,
+// which only works for grids that were posted as they were stored. Grids have as many images as their
+// batch count and size add up to, in tiles the size of the generated images, and grid styles with
+// gutters and captions are accounted for by the size of the tiles. A count of 0 means the grid
+// couldn't be found, as the tiles of other images can't be told apart.
+func (q *queueImpl) gridTileLayout(generation *entities.ImageGeneration, image []byte) (composite_renderer.TileLayout, int) {
+	var grid *entities.ImageGeneration
+	var err error
+
+	if generation.GridMessageID != "" {
+		grid, err = q.imageGenerationRepo.GetByMessageAndSort(context.Background(), generation.GridMessageID, 0)
+	} else {
+		grid, err = q.imageGenerationRepo.GetByImagePath(context.Background(), q.imageStorage.Path(image))
+	}
+
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error looking up the grid for the image: %v", err)
+		}
+
+		return composite_renderer.TileLayout{}, 0
+	}
+
+	count := grid.BatchCount * grid.BatchSize
+
+	// one of the images from a grid, rather than the grid itself
+	if grid.SortOrder > 0 {
+		count = 1
+	}
+
+	if count < 1 {
+		return composite_renderer.TileLayout{}, 0
+	}
+
+	columns, rows := composite_renderer.GridLayout(count)
+
+	layout := composite_renderer.TileLayout{
+		Columns:    columns,
+		Rows:       rows,
+		TileWidth:  grid.Width,
+		TileHeight: grid.Height,
+	}
+
+	if grid.EnableHR && grid.HiresWidth > 0 && grid.HiresHeight > 0 {
+		layout.TileWidth = grid.HiresWidth
+		layout.TileHeight = grid.HiresHeight
+	}
+
+	return layout, count
+}
+
+// loadSourceImage loads the stored copy of an image that a generation was made from, if there is one.
+func (q *queueImpl) loadSourceImage(path string) ([]byte, bool) {
+	if path == "" {
+		return nil, false
+	}
+
+	image, err := q.imageStorage.Load(path)
+	if err != nil {
+		log.Printf("Error loading stored source image %s, making it again instead: %v", path, err)
+
+		return nil, false
+	}
+
+	return image, true
+}
+
+// initImage returns the image that an img2img generation starts from. Discord's links to attachments
+// expire, so the image is stored the first time it's downloaded, for rerolls, variations and upscales
+// of the generation to use.
+func (q *queueImpl) initImage(generation *entities.ImageGeneration) ([]byte, error) {
+	if image, ok := q.loadSourceImage(generation.InitImagePath); ok {
+		return image, nil
+	}
+
+	image, err := downloadImage(generation.InitImageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	generation.InitImagePath = q.storeImage(image)
+
+	return image, nil
+}
+
+// inpaintMask returns the base64 encoded mask for an inpainting generation, either downloaded
+// from the uploaded mask, or derived from the selected tile of the source grid image. Like the
+// init image, it's stored the first time it's made.
+func (q *queueImpl) inpaintMask(generation *entities.ImageGeneration, initImage []byte) (string, error) {
+	if mask, ok := q.loadSourceImage(generation.MaskImagePath); ok {
+		return base64.StdEncoding.EncodeToString(mask), nil
+	}
+
+	var mask []byte
+
+	if generation.MaskImageURL != "" {
+		var err error
+
+		mask, err = downloadImage(generation.MaskImageURL)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		layout, imageCount := q.gridTileLayout(generation, initImage)
+		if imageCount == 0 || generation.MaskTile > imageCount {
+			return "", &InpaintTileError{Tile: generation.MaskTile, Count: imageCount}
+		}
+
+		maskBuf, err := q.compositeRenderer.TileMask(bytes.NewBuffer(initImage), layout, generation.MaskTile)
+		if err != nil {
+			return "", err
+		}
+
+		mask = maskBuf.Bytes()
+	}
+
+	generation.MaskImagePath = q.storeImage(mask)
+
+	return base64.StdEncoding.EncodeToString(mask), nil
+}
+
+func (q *queueImpl) imageToImageRequest(generation *entities.ImageGeneration) (*stable_diffusion_api.ImageToImageRequest, error) {
+	initImage, err := q.initImage(generation)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &stable_diffusion_api.ImageToImageRequest{
+		InitImages:        []string{base64.StdEncoding.EncodeToString(initImage)},
+		ResizeMode:        generation.ResizeMode,
+		DenoisingStrength: generation.DenoisingStrength,
+		Prompt:            generation.Prompt,
+		NegativePrompt:    generation.NegativePrompt,
+		Width:             generation.Width,
+		Height:            generation.Height,
+		RestoreFaces:      generation.RestoreFaces,
+		BatchSize:         generation.BatchSize,
+		Seed:              generation.Seed,
+		Subseed:           generation.Subseed,
+		SubseedStrength:   generation.SubseedStrength,
+		SamplerName:       generation.SamplerName,
+		CfgScale:          generation.CfgScale,
+		Steps:             generation.Steps,
+		NIter:             generation.BatchCount,
+	}
+
+	if generation.MaskImageURL != "" || generation.MaskTile > 0 {
+		req.Mask, err = q.inpaintMask(generation, initImage)
+		if err != nil {
+			return nil, err
+		}
+
+		req.MaskBlur = generation.MaskBlur
+		req.InpaintingFill = generation.InpaintingFill
+		req.InpaintFullRes = generation.InpaintFullRes
+	}
+
+	return req, nil
+}
+
+func textToImageRequest(generation *entities.ImageGeneration) *stable_diffusion_api.TextToImageRequest {
+	return &stable_diffusion_api.TextToImageRequest{
+		Prompt:            generation.Prompt,
+		NegativePrompt:    generation.NegativePrompt,
+		Width:             generation.Width,
+		Height:            generation.Height,
+		RestoreFaces:      generation.RestoreFaces,
+		EnableHR:          generation.EnableHR,
+		HRResizeX:         generation.HiresWidth,
+		HRResizeY:         generation.HiresHeight,
+		HRUpscaler:        generation.HiresUpscaler,
+		DenoisingStrength: generation.DenoisingStrength,
+		BatchSize:         generation.BatchSize,
+		Seed:              generation.Seed,
+		Subseed:           generation.Subseed,
+		SubseedStrength:   generation.SubseedStrength,
+		SamplerName:       generation.SamplerName,
+		CfgScale:          generation.CfgScale,
+		Steps:             generation.Steps,
+		NIter:             generation.BatchCount,
+	}
+}
+
+// upscaleRequest builds a request that upscales the image that was stored for the generation. Images
+// from before they were stored, or that have gone missing, are regenerated first instead.
+func (q *queueImpl) upscaleRequest(generation *entities.ImageGeneration) (*stable_diffusion_api.UpscaleRequest, error) {
+	upscaleReq := &stable_diffusion_api.UpscaleRequest{
+		ResizeMode:      0,
+		UpscalingResize: 2,
+		Upscaler1:       "ESRGAN_4x",
+	}
+
+	if generation.ImagePath != "" {
+		image, err := q.imageStorage.Load(generation.ImagePath)
+		if err == nil {
+			upscaleReq.Image = base64.StdEncoding.EncodeToString(image)
+
+			return upscaleReq, nil
+		}
+
+		log.Printf("Error loading stored image %s, regenerating it instead: %v", generation.ImagePath, err)
+	}
+
+	if generation.InitImageURL != "" {
+		imageToImageReq, err := q.imageToImageRequest(generation)
+		if err != nil {
+			return nil, err
+		}
+
+		imageToImageReq.BatchSize = 1
+		imageToImageReq.NIter = 1
+
+		upscaleReq.ImageToImageRequest = imageToImageReq
+
+		return upscaleReq, nil
+	}
+
+	textToImageReq := textToImageRequest(generation)
+
+	textToImageReq.BatchSize = 1
+	textToImageReq.NIter = 1
+
+	upscaleReq.TextToImageRequest = textToImageReq
+
+	return upscaleReq, nil
+}
+
+type generatedImages struct {
+	Images    []string
+	Seeds     []int
+	Subseeds  []int
+	ModelName string
+	ModelHash string
+}
+
+// generateImages runs the generation through img2img when it has a source image, and txt2img otherwise.
+func (q *queueImpl) generateImages(b *backend, generation *entities.ImageGeneration) (*generatedImages, error) {
+	err := q.loadModel(b, generation.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	if generation.InitImageURL != "" {
+		req, err := q.imageToImageRequest(generation)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := b.api.ImageToImage(context.Background(), req)
+		if err != nil {
+			return nil, err
+		}
+
+		return &generatedImages{
+			Images:    withoutGridImages(resp.Images, len(resp.Seeds)),
+			Seeds:     resp.Seeds,
+			Subseeds:  resp.Subseeds,
+			ModelName: resp.ModelName,
+			ModelHash: resp.ModelHash,
+		}, nil
+	}
+
+	resp, err := b.api.TextToImage(context.Background(), textToImageRequest(generation))
+	if err != nil {
+		return nil, err
+	}
+
+	return &generatedImages{
+		Images:    withoutGridImages(resp.Images, len(resp.Seeds)),
+		Seeds:     resp.Seeds,
+		Subseeds:  resp.Subseeds,
+		ModelName: resp.ModelName,
+		ModelHash: resp.ModelHash,
+	}, nil
+}
+
+// withoutGridImages drops the grid that the webui puts before the images when it's set to return
+// grids, so that there is an image for each seed. The bot makes its own grid from the images.
+func withoutGridImages(images []string, seedCount int) []string {
+	if seedCount > 0 && len(images) > seedCount {
+		return images[len(images)-seedCount:]
+	}
+
+	return images
+}
+
+// storeImage saves a generated image, so that it can be re-posted or re-processed later, and returns
+// its path. Images that can't be saved are logged, and have no path.
+func (q *queueImpl) storeImage(image []byte) string {
+	path, err := q.imageStorage.Save(image)
+	if err != nil {
+		log.Printf("Error storing image: %v", err)
+
+		return ""
+	}
+
+	return path
+}
+
+// deleteStoredImages removes images that were stored for generations that have been thrown away. Images
+// are stored by their contents, so the same image may also be stored for other generations, and those
+// are kept.
+func (q *queueImpl) deleteStoredImages(paths []string) {
+	for _, path := range paths {
+		count, err := q.imageGenerationRepo.CountByImagePath(context.Background(), path)
+		if err != nil {
+			log.Printf("Error checking whether stored image %s is still used: %v", path, err)
+
+			continue
+		}
+
+		if count > 0 {
+			continue
+		}
+
+		err = q.imageStorage.Delete(path)
+		if err != nil {
+			log.Printf("Error deleting stored image %s: %v", path, err)
+		}
+	}
+}
+
+// pruneImages removes the stored images that are older than the storage's retention, and clears
+// them from the generations they were stored for.
+func (q *queueImpl) pruneImages() {
+	removed, err := q.imageStorage.Prune()
+	if err != nil {
+		log.Printf("Error pruning stored images: %v", err)
+	}
+
+	for _, path := range removed {
+		clearErr := q.imageGenerationRepo.ClearImagePath(context.Background(), path)
+		if clearErr != nil {
+			log.Printf("Error clearing pruned image %s: %v", path, clearErr)
+		}
+	}
+
+	if len(removed) > 0 {
+		log.Printf("Pruned %d stored images", len(removed))
+	}
+}
+
+// uploadFile encodes an image for posting it to Discord, named after the name. If it can't be encoded,
+// e.g. because it can't be made small enough, it's posted as it is, and Discord may turn it away.
+func (q *queueImpl) uploadFile(name string, image []byte) *discordgo.File {
+	encoded, err := q.uploadEncoder.Encode(image)
+	if err != nil {
+		log.Printf("Error encoding image for upload: %v", err)
+
+		return &discordgo.File{
+			ContentType: "image/png",
+			Name:        name + ".png",
+			Reader:      bytes.NewReader(image),
+		}
+	}
+
+	if len(encoded.Data) != len(image) {
+		log.Printf("Encoded %d byte image as %d byte %s for upload", len(image), len(encoded.Data), encoded.ContentType)
+
+		// re-encoding the image loses the parameters that were written into it
+		withParameters, err := q.pngInfo.CopyParameters(image, encoded.Data)
+		if err == nil {
+			encoded.Data = withParameters
+		} else if !errors.Is(err, png_info.ErrNoParameters) {
+			log.Printf("Error copying parameters into the encoded image: %v", err)
+		}
+	}
+
+	return &discordgo.File{
+		ContentType: encoded.ContentType,
+		Name:        name + encoded.Extension,
+		Reader:      bytes.NewReader(encoded.Data),
+	}
+}
+
+// promptSlug turns the prompt into something that can be used in a file name, keeping just its letters
+// and numbers, with dashes in between the words.
+func promptSlug(prompt string) string {
+	var slug strings.Builder
+
+	dash := false
+
+	for _, r := range strings.ToLower(prompt) {
+		if slug.Len() >= maxSlugLength {
+			break
+		}
+
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+
+			slug.WriteRune(r)
+
+			dash = false
+
+			continue
+		}
+
+		dash = true
+	}
+
+	if slug.Len() == 0 {
+		return "imagine"
+	}
+
+	return slug.String()
+}
+
+// embedParameters writes the generation's parameters into the image, so that they can be read by the
+// webui's PNG Info tab. Images that they can't be written into are returned as they are.
+func (q *queueImpl) embedParameters(image []byte, generation *entities.ImageGeneration) []byte {
+	embedded, err := q.pngInfo.EmbedParameters(image, generation)
+	if err != nil {
+		log.Printf("Error embedding image parameters: %v", err)
+
+		return image
+	}
+
+	return embedded
+}
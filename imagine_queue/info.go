@@ -0,0 +1,69 @@
+package imagine_queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"stable_diffusion_bot/entities"
+	"time"
+)
+
+// ErrNoImageInfo is returned when there are no generation settings for a message or an image.
+var ErrNoImageInfo = errors.New("there are no generation settings for that image")
+
+// DescribeMessage looks up the settings that one of the bot's messages was generated with. Grids
+// are described by their first image, like the parameters written into them.
+func (q *queueImpl) DescribeMessage(messageID string) (*entities.ImageGeneration, error) {
+	for _, sortOrder := range []int{1, 0} {
+		generation, err := q.imageGenerationRepo.GetByMessageAndSort(context.Background(), messageID, sortOrder)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return generation, nil
+	}
+
+	return nil, ErrNoImageInfo
+}
+
+// DescribeImage reads the generation settings that the webui, or the bot, wrote into a PNG image.
+func (q *queueImpl) DescribeImage(imageURL string) (*entities.ImageGeneration, error) {
+	image, err := downloadImage(imageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	generation, err := q.pngInfo.ReadParameters(image)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoImageInfo, err)
+	}
+
+	return generation, nil
+}
+
+// reimagineGeneration copies the settings of a re-imagine item into a new generation.
+func reimagineGeneration(imagine *QueueItem) (*entities.ImageGeneration, error) {
+	if imagine.Generation == nil {
+		return nil, errors.New("missing generation to reimagine")
+	}
+
+	newGeneration := *imagine.Generation
+
+	newGeneration.ID = 0
+	newGeneration.InteractionID = ""
+	newGeneration.MessageID = ""
+	newGeneration.MemberID = ""
+	newGeneration.SortOrder = 0
+	newGeneration.Backend = ""
+	newGeneration.ImagePath = ""
+	newGeneration.UpscaledImagePath = ""
+	newGeneration.Processed = false
+	newGeneration.CreatedAt = time.Time{}
+
+	return &newGeneration, nil
+}
@@ -2,6 +2,7 @@ package imagine_queue
 
 import (
 	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/stable_diffusion_api"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -9,7 +10,28 @@ import (
 type Queue interface {
 	AddImagine(item *QueueItem) (int, error)
 	StartPolling(botSession *discordgo.Session)
-	GetBotDefaultSettings() (*entities.DefaultSettings, error)
-	UpdateDefaultDimensions(width, height int) (*entities.DefaultSettings, error)
-	UpdateDefaultBatch(batchCount, batchSize int) (*entities.DefaultSettings, error)
+	GetDefaultSettings(target *SettingsTarget) (*entities.DefaultSettings, error)
+	UpdateDefaultDimensions(target *SettingsTarget, width, height int) (*entities.DefaultSettings, error)
+	UpdateDefaultBatch(target *SettingsTarget, batchCount, batchSize int) (*entities.DefaultSettings, error)
+	UpdateDefaultModel(target *SettingsTarget, model string) (*entities.DefaultSettings, error)
+	UpdateDefaultSampler(target *SettingsTarget, samplerName string) (*entities.DefaultSettings, error)
+	UpdateDefaultSteps(target *SettingsTarget, steps int) (*entities.DefaultSettings, error)
+	UpdateDefaultCfgScale(target *SettingsTarget, cfgScale float64) (*entities.DefaultSettings, error)
+	UpdateDefaultRestoreFaces(target *SettingsTarget, restoreFaces bool) (*entities.DefaultSettings, error)
+	UpdateDefaultDenoisingStrength(target *SettingsTarget, denoisingStrength float64) (*entities.DefaultSettings, error)
+	UpdateDefaultAdvanced(target *SettingsTarget, steps int, cfgScale, denoisingStrength float64) (*entities.DefaultSettings, error)
+	UpdateDefaultNegativePrompt(target *SettingsTarget, negativePrompt *string) (*entities.DefaultSettings, error)
+	UpdateDefaultShowPreviews(target *SettingsTarget, showPreviews bool) (*entities.DefaultSettings, error)
+	UpdateDefaultGridStyle(target *SettingsTarget, gridStyle entities.GridStyle) (*entities.DefaultSettings, error)
+	UpdateDefaultAttachmentMode(target *SettingsTarget, attachmentMode entities.AttachmentMode) (*entities.DefaultSettings, error)
+	ListModels() ([]*stable_diffusion_api.Model, error)
+	ListSamplers() ([]*stable_diffusion_api.Sampler, error)
+	GetUserLimits(memberID string) (*UserLimits, error)
+	SetUserLimits(memberID string, maxQueued, maxPerHour *int) (*UserLimits, error)
+	ResetUserLimits(memberID string) (*UserLimits, error)
+	ListItems() []*QueueItemInfo
+	CancelItem(id int64, memberID string, canManageOthers bool) (*QueueItemInfo, error)
+	MoveItem(id int64, position int) (*QueueItemInfo, error)
+	DescribeMessage(messageID string) (*entities.ImageGeneration, error)
+	DescribeImage(imageURL string) (*entities.ImageGeneration, error)
 }
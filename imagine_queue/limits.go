@@ -0,0 +1,206 @@
+package imagine_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/repositories"
+	"time"
+)
+
+const (
+	// usageWindow is the period that the hourly limit counts items over
+	usageWindow = time.Hour
+
+	// usageRetention is how long processed items are kept around for counting usage
+	usageRetention = 24 * time.Hour
+)
+
+type UserLimitKind int
+
+const (
+	// UserLimitQueued limits how many items a member can have waiting in line or being processed
+	UserLimitQueued UserLimitKind = iota
+	// UserLimitPerHour limits how many items a member can add in an hour
+	UserLimitPerHour
+)
+
+// UserLimitError is returned when an item can't be added, because the member has reached one of their limits.
+type UserLimitError struct {
+	Kind  UserLimitKind
+	Count int
+	Limit int
+}
+
+func (e *UserLimitError) Error() string {
+	if e.Kind == UserLimitPerHour {
+		return fmt.Sprintf("added %d items in the last hour, and the limit is %d", e.Count, e.Limit)
+	}
+
+	return fmt.Sprintf("%d items queued, and the limit is %d", e.Count, e.Limit)
+}
+
+// UserLimits are the limits that apply to a member, after falling back to the bot's defaults. A limit of
+// 0 means there is no limit.
+type UserLimits struct {
+	MaxQueued  int
+	MaxPerHour int
+}
+
+// getUserLimitOverrides returns the limits that have been set for the member, which are empty if none have.
+func (q *queueImpl) getUserLimitOverrides(memberID string) (*entities.UserLimits, error) {
+	limits, err := q.userLimitsRepo.GetByMemberID(context.Background(), memberID)
+	if err != nil {
+		if errors.Is(err, &repositories.NotFoundError{}) {
+			return &entities.UserLimits{MemberID: memberID}, nil
+		}
+
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+func (q *queueImpl) effectiveUserLimits(overrides *entities.UserLimits) *UserLimits {
+	limits := &UserLimits{
+		MaxQueued:  q.defaultUserLimits.MaxQueued,
+		MaxPerHour: q.defaultUserLimits.MaxPerHour,
+	}
+
+	if overrides.MaxQueued != nil {
+		limits.MaxQueued = *overrides.MaxQueued
+	}
+
+	if overrides.MaxPerHour != nil {
+		limits.MaxPerHour = *overrides.MaxPerHour
+	}
+
+	return limits
+}
+
+// GetUserLimits returns the limits that apply to the member.
+func (q *queueImpl) GetUserLimits(memberID string) (*UserLimits, error) {
+	overrides, err := q.getUserLimitOverrides(memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.effectiveUserLimits(overrides), nil
+}
+
+// SetUserLimits changes the member's limits. A nil limit is left as it is.
+func (q *queueImpl) SetUserLimits(memberID string, maxQueued, maxPerHour *int) (*UserLimits, error) {
+	if (maxQueued != nil && *maxQueued < 0) || (maxPerHour != nil && *maxPerHour < 0) {
+		return nil, errors.New("limits can't be negative")
+	}
+
+	overrides, err := q.getUserLimitOverrides(memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxQueued != nil {
+		overrides.MaxQueued = maxQueued
+	}
+
+	if maxPerHour != nil {
+		overrides.MaxPerHour = maxPerHour
+	}
+
+	overrides, err = q.userLimitsRepo.Upsert(context.Background(), overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := q.effectiveUserLimits(overrides)
+
+	log.Printf("Updated limits for %s to: %+v\n", memberID, *limits)
+
+	return limits, nil
+}
+
+// ResetUserLimits makes the member use the bot's default limits again.
+func (q *queueImpl) ResetUserLimits(memberID string) (*UserLimits, error) {
+	overrides, err := q.userLimitsRepo.Upsert(context.Background(), &entities.UserLimits{MemberID: memberID})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Reset limits for %s\n", memberID)
+
+	return q.effectiveUserLimits(overrides), nil
+}
+
+// memberQueuedCount is how many of the member's items are waiting or being processed. It must be called
+// with the queue's mutex held.
+func (q *queueImpl) memberQueuedCount(memberID string) int {
+	count := 0
+
+	for _, b := range q.backends {
+		if b.currentImagine != nil && b.currentImagine.memberID() == memberID {
+			count++
+		}
+	}
+
+	for idx := 0; idx < q.pending.len(); idx++ {
+		if q.pending.at(idx).memberID() == memberID {
+			count++
+		}
+	}
+
+	return count
+}
+
+// checkUserLimits returns a UserLimitError if the item's member has already added as many items as they
+// can this hour, and otherwise their limits, for checkQueuedLimit. It reads the database, so it's called
+// without the queue's mutex held, but with addMu held until the item is persisted.
+func (q *queueImpl) checkUserLimits(item *QueueItem) (*UserLimits, error) {
+	memberID := item.memberID()
+	if memberID == "" {
+		return nil, nil
+	}
+
+	limits, err := q.GetUserLimits(memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.MaxPerHour > 0 {
+		added, countErr := q.queueItemRepo.CountByMemberSince(context.Background(), memberID, time.Now().Add(-usageWindow))
+		if countErr != nil {
+			return nil, countErr
+		}
+
+		if added >= limits.MaxPerHour {
+			return nil, &UserLimitError{Kind: UserLimitPerHour, Count: added, Limit: limits.MaxPerHour}
+		}
+	}
+
+	return limits, nil
+}
+
+// checkQueuedLimit returns a UserLimitError if the item's member already has as many items queued as
+// they're allowed. It must be called with the queue's mutex held.
+func (q *queueImpl) checkQueuedLimit(item *QueueItem, limits *UserLimits) error {
+	if limits == nil || limits.MaxQueued <= 0 {
+		return nil
+	}
+
+	queued := q.memberQueuedCount(item.memberID())
+
+	if queued >= limits.MaxQueued {
+		return &UserLimitError{Kind: UserLimitQueued, Count: queued, Limit: limits.MaxQueued}
+	}
+
+	return nil
+}
+
+// pruneUsage forgets about items that were processed too long ago to count towards any limit.
+func (q *queueImpl) pruneUsage() {
+	err := q.queueItemRepo.DeleteFinishedBefore(context.Background(), time.Now().Add(-usageRetention))
+	if err != nil {
+		log.Printf("Error pruning finished queue items: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package imagine_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/repositories"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUserLimitsRepo keeps members' limits in memory, in place of the database.
+type fakeUserLimitsRepo struct {
+	mu     sync.Mutex
+	limits map[string]*entities.UserLimits
+}
+
+func newFakeUserLimitsRepo() *fakeUserLimitsRepo {
+	return &fakeUserLimitsRepo{limits: make(map[string]*entities.UserLimits)}
+}
+
+func (repo *fakeUserLimitsRepo) Upsert(_ context.Context, limits *entities.UserLimits) (*entities.UserLimits, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored := *limits
+	repo.limits[limits.MemberID] = &stored
+
+	upserted := stored
+
+	return &upserted, nil
+}
+
+func (repo *fakeUserLimitsRepo) GetByMemberID(_ context.Context, memberID string) (*entities.UserLimits, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	limits, ok := repo.limits[memberID]
+	if !ok {
+		return nil, repositories.NewNotFoundError("user limits")
+	}
+
+	found := *limits
+
+	return &found, nil
+}
+
+// newTestLimitsQueue is a queue with the default limits, for testing how they're applied.
+func newTestLimitsQueue(maxQueued, maxPerHour int) *queueImpl {
+	q := newTestQueue(newFakeQueueItemRepo())
+
+	q.userLimitsRepo = newFakeUserLimitsRepo()
+	q.defaultUserLimits = UserLimits{MaxQueued: maxQueued, MaxPerHour: maxPerHour}
+
+	return q
+}
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestEffectiveUserLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides entities.UserLimits
+		want      UserLimits
+	}{
+		{
+			name: "defaults",
+			want: UserLimits{MaxQueued: 3, MaxPerHour: 20},
+		},
+		{
+			name:      "queued override",
+			overrides: entities.UserLimits{MaxQueued: intPointer(10)},
+			want:      UserLimits{MaxQueued: 10, MaxPerHour: 20},
+		},
+		{
+			name:      "hourly override",
+			overrides: entities.UserLimits{MaxPerHour: intPointer(5)},
+			want:      UserLimits{MaxQueued: 3, MaxPerHour: 5},
+		},
+		{
+			name:      "no limit",
+			overrides: entities.UserLimits{MaxQueued: intPointer(0), MaxPerHour: intPointer(0)},
+			want:      UserLimits{},
+		},
+	}
+
+	q := newTestLimitsQueue(3, 20)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := q.effectiveUserLimits(&test.overrides)
+
+			if *got != test.want {
+				t.Errorf("effectiveUserLimits(%+v) = %+v, want %+v", test.overrides, *got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetUserLimitsRejectsNegativeLimits(t *testing.T) {
+	q := newTestLimitsQueue(3, 20)
+
+	_, err := q.SetUserLimits("member", intPointer(-1), nil)
+	if err == nil {
+		t.Error("SetUserLimits with a negative limit didn't return an error")
+	}
+}
+
+func TestCheckQueuedLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		queued    int
+		running   bool
+		maxQueued int
+		wantErr   bool
+	}{
+		{name: "under the limit", queued: 1, maxQueued: 3},
+		{name: "at the limit", queued: 3, maxQueued: 3, wantErr: true},
+		{name: "running item counts", queued: 2, running: true, maxQueued: 3, wantErr: true},
+		{name: "no limit", queued: 10, maxQueued: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestLimitsQueue(test.maxQueued, 0)
+
+			for idx := 0; idx < test.queued; idx++ {
+				_, err := q.pending.push(testItem("member", fmt.Sprintf("queued %d", idx)))
+				if err != nil {
+					t.Fatalf("push returned error: %v", err)
+				}
+			}
+
+			// another member's items don't count
+			_, err := q.pending.push(testItem("other", "other"))
+			if err != nil {
+				t.Fatalf("push returned error: %v", err)
+			}
+
+			if test.running {
+				q.backends = []*backend{{currentImagine: testItem("member", "running")}}
+			}
+
+			err = q.checkQueuedLimit(testItem("member", "new"), &UserLimits{MaxQueued: test.maxQueued})
+
+			var limitErr *UserLimitError
+			if gotErr := errors.As(err, &limitErr); gotErr != test.wantErr {
+				t.Fatalf("checkQueuedLimit returned %v, want error: %v", err, test.wantErr)
+			}
+
+			if test.wantErr && limitErr.Kind != UserLimitQueued {
+				t.Errorf("checkQueuedLimit returned a limit error of kind %d, want %d", limitErr.Kind, UserLimitQueued)
+			}
+		})
+	}
+}
+
+func TestCheckUserLimitsPerHour(t *testing.T) {
+	tests := []struct {
+		name       string
+		recent     int
+		old        int
+		maxPerHour int
+		wantErr    bool
+	}{
+		{name: "under the limit", recent: 1, maxPerHour: 2},
+		{name: "at the limit", recent: 2, maxPerHour: 2, wantErr: true},
+		{name: "older items don't count", recent: 1, old: 5, maxPerHour: 2},
+		{name: "no limit", recent: 50, maxPerHour: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestLimitsQueue(0, test.maxPerHour)
+			repo := q.queueItemRepo.(*fakeQueueItemRepo)
+
+			for idx := 0; idx < test.recent+test.old; idx++ {
+				createdAt := time.Now()
+				if idx >= test.recent {
+					createdAt = createdAt.Add(-usageWindow - time.Minute)
+				}
+
+				_, err := repo.Create(context.Background(), &entities.QueueItem{
+					MemberID:  "member",
+					Status:    entities.QueueItemStatusFinished,
+					CreatedAt: createdAt,
+				})
+				if err != nil {
+					t.Fatalf("Create returned error: %v", err)
+				}
+			}
+
+			_, err := q.checkUserLimits(testItem("member", "new"))
+
+			var limitErr *UserLimitError
+			if gotErr := errors.As(err, &limitErr); gotErr != test.wantErr {
+				t.Fatalf("checkUserLimits returned %v, want error: %v", err, test.wantErr)
+			}
+
+			if test.wantErr && limitErr.Kind != UserLimitPerHour {
+				t.Errorf("checkUserLimits returned a limit error of kind %d, want %d", limitErr.Kind, UserLimitPerHour)
+			}
+		})
+	}
+}
+
+func TestAddImagineHourlyLimitWhenAddedTogether(t *testing.T) {
+	const maxPerHour = 3
+
+	q := newTestLimitsQueue(0, maxPerHour)
+	q.queueItemRepo.(*fakeQueueItemRepo).countDelay = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+
+	results := make([]error, 10)
+
+	for idx := range results {
+		wg.Add(1)
+
+		go func(idx int) {
+			defer wg.Done()
+
+			item := testItem("member", fmt.Sprintf("a cute kitten %d", idx))
+			item.DiscordInteraction.ID = fmt.Sprint(idx)
+
+			_, results[idx] = q.AddImagine(item)
+		}(idx)
+	}
+
+	wg.Wait()
+
+	added := 0
+
+	for _, err := range results {
+		var limitErr *UserLimitError
+
+		switch {
+		case err == nil:
+			added++
+		case errors.As(err, &limitErr) && limitErr.Kind == UserLimitPerHour:
+		default:
+			t.Errorf("AddImagine returned %v, want nil or an hourly limit error", err)
+		}
+	}
+
+	if added != maxPerHour {
+		t.Errorf("added %d items, want %d", added, maxPerHour)
+	}
+}
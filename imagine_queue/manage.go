@@ -0,0 +1,304 @@
+package imagine_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	// ErrItemNotFound is returned when there is no item with the ID in the queue, e.g. because it has finished.
+	ErrItemNotFound = errors.New("there is no item with that ID in the queue")
+
+	// ErrItemRunning is returned when an item can't be changed, because it's already being processed.
+	ErrItemRunning = errors.New("that item is already being processed")
+
+	// ErrNotItemOwner is returned when a member tries to change someone else's item without being allowed to.
+	ErrNotItemOwner = errors.New("that item belongs to someone else")
+)
+
+// cancelledMessageContent replaces the reply to an item that was cancelled.
+const cancelledMessageContent = "This imagine was cancelled."
+
+// QueueItemInfo describes an item that is waiting in line or being processed.
+type QueueItemInfo struct {
+	// ID is the stored item's ID, which stays the same while the item moves through the queue
+	ID       int64
+	Position int
+	Type     ItemType
+	Prompt   string
+	MemberID string
+
+	// Running is set for items that are being processed, which also have their backend and progress
+	Running  bool
+	Backend  string
+	Progress float64
+	ETA      time.Duration
+}
+
+func newQueueItemInfo(item *QueueItem, position int) *QueueItemInfo {
+	return &QueueItemInfo{
+		ID:       item.persistedID,
+		Position: position,
+		Type:     item.Type,
+		Prompt:   item.Prompt,
+		MemberID: item.memberID(),
+	}
+}
+
+// ListItems describes the items being processed, followed by the items waiting in line.
+func (q *queueImpl) ListItems() []*QueueItemInfo {
+	q.mu.Lock()
+
+	items := make([]*QueueItemInfo, 0, len(q.backends)+q.pending.len())
+
+	var runningBackends []*backend
+
+	for _, b := range q.backends {
+		if b.currentImagine == nil {
+			continue
+		}
+
+		info := newQueueItemInfo(b.currentImagine, len(items)+1)
+		info.Running = true
+		info.Backend = b.host()
+
+		items = append(items, info)
+		runningBackends = append(runningBackends, b)
+	}
+
+	for idx := 0; idx < q.pending.len(); idx++ {
+		items = append(items, newQueueItemInfo(q.pending.at(idx), q.queuedPosition(idx)))
+	}
+
+	q.mu.Unlock()
+
+	// the progress is fetched without holding the lock, as it means asking each backend
+	for idx, b := range runningBackends {
+		progress, err := q.currentProgress(b)
+		if err != nil {
+			log.Printf("Error getting current progress from %s: %v", b.host(), err)
+
+			continue
+		}
+
+		items[idx].Progress = progress.Progress
+		items[idx].ETA = time.Duration(progress.EtaRelative * float64(time.Second))
+	}
+
+	return items
+}
+
+// pendingIndex finds the waiting item with the ID. It must be called with the queue's mutex held.
+func (q *queueImpl) pendingIndex(id int64) (int, error) {
+	for idx := 0; idx < q.pending.len(); idx++ {
+		if q.pending.at(idx).persistedID == id {
+			return idx, nil
+		}
+	}
+
+	for _, b := range q.backends {
+		if b.currentImagine != nil && b.currentImagine.persistedID == id {
+			return 0, ErrItemRunning
+		}
+	}
+
+	return 0, ErrItemNotFound
+}
+
+// CancelItem takes a waiting item out of the queue, or interrupts it if it's being processed. Members
+// can only cancel their own items, unless canManageOthers is set.
+func (q *queueImpl) CancelItem(id int64, memberID string, canManageOthers bool) (*QueueItemInfo, error) {
+	q.mu.Lock()
+
+	index, err := q.pendingIndex(id)
+	if errors.Is(err, ErrItemRunning) {
+		q.mu.Unlock()
+
+		return q.cancelRunningItem(id, memberID, canManageOthers)
+	}
+
+	if err != nil {
+		q.mu.Unlock()
+
+		return nil, err
+	}
+
+	item := q.pending.at(index)
+
+	if !canManageOthers && item.memberID() != memberID {
+		q.mu.Unlock()
+
+		return nil, ErrNotItemOwner
+	}
+
+	info := newQueueItemInfo(item, q.queuedPosition(index))
+
+	q.pending.removeAt(index)
+
+	q.updateQueuedPositions()
+
+	q.mu.Unlock()
+
+	log.Printf("Cancelled queue item %d for %s", id, memberID)
+
+	q.deletePersistedQueueItem(item)
+
+	item.markLeftQueue()
+
+	q.reportCancelled(item, "")
+
+	return info, nil
+}
+
+// cancelRunningItem interrupts the backend that is processing the item. The backend returns early,
+// and the item's reply is then changed to say it was cancelled, rather than showing what was generated.
+func (q *queueImpl) cancelRunningItem(id int64, memberID string, canManageOthers bool) (*QueueItemInfo, error) {
+	q.mu.Lock()
+
+	var runningBackend *backend
+
+	for _, b := range q.backends {
+		if b.currentImagine != nil && b.currentImagine.persistedID == id {
+			runningBackend = b
+
+			break
+		}
+	}
+
+	// it may have finished since it was looked up
+	if runningBackend == nil {
+		q.mu.Unlock()
+
+		return nil, ErrItemNotFound
+	}
+
+	item := runningBackend.currentImagine
+
+	if !canManageOthers && item.memberID() != memberID {
+		q.mu.Unlock()
+
+		return nil, ErrNotItemOwner
+	}
+
+	info := newQueueItemInfo(item, 1)
+	info.Running = true
+	info.Backend = runningBackend.host()
+
+	alreadyCancelled := item.cancelled
+	item.cancelled = true
+
+	if alreadyCancelled || runningBackend.interrupting {
+		q.mu.Unlock()
+
+		return info, nil
+	}
+
+	// the item is still the backend's current item, as it was found under the same lock. The backend
+	// isn't handed another item until the interrupt has been sent, so the interrupt can only stop this one.
+	runningBackend.interrupting = true
+
+	q.mu.Unlock()
+
+	log.Printf("Interrupting queue item %d on %s for %s", id, runningBackend.host(), memberID)
+
+	ctx, cancel := apiCallContext()
+	defer cancel()
+
+	err := runningBackend.api.Interrupt(ctx)
+	if err != nil {
+		// the item is still marked as cancelled, so whatever it generates is thrown away
+		log.Printf("Error interrupting %s: %v", runningBackend.host(), err)
+	}
+
+	q.mu.Lock()
+	runningBackend.interrupting = false
+	q.mu.Unlock()
+
+	return info, nil
+}
+
+// itemCancelled is true once the item has been cancelled while being processed.
+func (q *queueImpl) itemCancelled(item *QueueItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return item.cancelled
+}
+
+// reportCancelled lets the user know their item was cancelled, and throws away any generations that
+// were already stored for its message, so that they can't be re-rolled or upscaled.
+func (q *queueImpl) reportCancelled(item *QueueItem, messageID string) {
+	if messageID != "" {
+		err := q.imageGenerationRepo.DeleteByMessage(context.Background(), messageID)
+		if err != nil {
+			log.Printf("Error deleting image generations for cancelled message %s: %v", messageID, err)
+		}
+	}
+
+	content := cancelledMessageContent
+
+	_, err := q.botSession.InteractionResponseEdit(item.DiscordInteraction, &discordgo.WebhookEdit{
+		Content:     &content,
+		Components:  &[]discordgo.MessageComponent{},
+		Attachments: &[]*discordgo.MessageAttachment{},
+	})
+	if err != nil {
+		log.Printf("Error editing interaction: %v", err)
+	}
+}
+
+// cancelButtonComponents is the button shown while an item is being processed, which lets the member
+// that added it cancel it.
+func cancelButtonComponents(item *QueueItem) *[]discordgo.MessageComponent {
+	return &[]discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Cancel",
+					Style:    discordgo.DangerButton,
+					CustomID: fmt.Sprintf("imagine_cancel_%d", item.persistedID),
+					Emoji: &discordgo.ComponentEmoji{
+						Name: "✖️",
+					},
+				},
+			},
+		},
+	}
+}
+
+// MoveItem moves a waiting item to a new place in line, counting the items being processed like
+// ListItems does. Items can't be moved ahead of the ones being processed.
+func (q *queueImpl) MoveItem(id int64, position int) (*QueueItemInfo, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	index, err := q.pendingIndex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	item := q.pending.removeAt(index)
+
+	newIndex := position - q.runningCount() - 1
+
+	if newIndex < 0 {
+		newIndex = 0
+	}
+
+	if newIndex > q.pending.len() {
+		newIndex = q.pending.len()
+	}
+
+	q.pending.insertAt(newIndex, item)
+
+	q.updateQueuedPositions()
+
+	log.Printf("Moved queue item %d to position %d", id, q.queuedPosition(newIndex))
+
+	return newQueueItemInfo(item, q.queuedPosition(newIndex)), nil
+}
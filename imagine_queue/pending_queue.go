@@ -0,0 +1,127 @@
+package imagine_queue
+
+import "fmt"
+
+// maxQueueSize is how many items can be waiting in line before new ones are turned away.
+const maxQueueSize = 100
+
+// QueueFullError is returned when an item can't be added, because too many are already waiting.
+type QueueFullError struct {
+	MaxSize int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("the queue is full, with %d items waiting", e.MaxSize)
+}
+
+// pendingQueue is the line of items waiting for a backend. It's guarded by the queue's mutex.
+type pendingQueue struct {
+	items   []*QueueItem
+	maxSize int
+}
+
+func newPendingQueue(maxSize int) *pendingQueue {
+	return &pendingQueue{
+		items:   make([]*QueueItem, 0),
+		maxSize: maxSize,
+	}
+}
+
+func (p *pendingQueue) len() int {
+	return len(p.items)
+}
+
+func (p *pendingQueue) at(index int) *QueueItem {
+	return p.items[index]
+}
+
+// checkSpace returns a QueueFullError if there is no room for another item.
+func (p *pendingQueue) checkSpace() error {
+	if len(p.items) >= p.maxSize {
+		return &QueueFullError{MaxSize: p.maxSize}
+	}
+
+	return nil
+}
+
+// push adds the item to the line, unless the line is full, and returns its index. Items take turns
+// between members: an item goes after every item from members with as many items waiting as its own
+// member does, so that one member adding lots of items doesn't hold everyone else up.
+func (p *pendingQueue) push(item *QueueItem) (int, error) {
+	err := p.checkSpace()
+	if err != nil {
+		return 0, err
+	}
+
+	memberID := item.memberID()
+
+	// the member's items are all ahead of the new one, as they are in earlier rounds
+	item.round = 0
+
+	for _, queued := range p.items {
+		if memberID != "" && queued.memberID() == memberID {
+			item.round++
+		}
+	}
+
+	index := len(p.items)
+
+	for idx, queued := range p.items {
+		if queued.round > item.round {
+			index = idx
+
+			break
+		}
+	}
+
+	p.insertAt(index, item)
+
+	return index, nil
+}
+
+// insertAt puts the item into the line at the index.
+func (p *pendingQueue) insertAt(index int, item *QueueItem) {
+	p.items = append(p.items, nil)
+	copy(p.items[index+1:], p.items[index:])
+	p.items[index] = item
+
+	p.updateRounds()
+}
+
+// pushFront puts items back at the front of the line, e.g. when resuming after a restart. These were
+// already accepted, so they are let in even if it makes the line longer than its limit.
+func (p *pendingQueue) pushFront(items []*QueueItem) {
+	p.items = append(items, p.items...)
+
+	p.updateRounds()
+}
+
+// removeAt takes the item at the index out of the line.
+func (p *pendingQueue) removeAt(index int) *QueueItem {
+	item := p.items[index]
+
+	p.items = append(p.items[:index], p.items[index+1:]...)
+
+	p.updateRounds()
+
+	return item
+}
+
+// updateRounds works out each item's round again from where it is in line, after items have left the
+// line or been moved. Otherwise a member whose items were added behind a burst of their own would keep
+// the rounds from then, and have new items from other members go ahead of them every time.
+func (p *pendingQueue) updateRounds() {
+	ahead := make(map[string]int)
+
+	for _, item := range p.items {
+		memberID := item.memberID()
+		if memberID == "" {
+			item.round = 0
+
+			continue
+		}
+
+		item.round = ahead[memberID]
+		ahead[memberID]++
+	}
+}
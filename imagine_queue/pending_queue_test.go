@@ -0,0 +1,154 @@
+package imagine_queue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// testItem is an item from the member, whose prompt names it in the tests. Items without a member
+// have an empty member ID.
+func testItem(memberID, name string) *QueueItem {
+	item := &QueueItem{Prompt: name, DiscordInteraction: &discordgo.Interaction{}}
+
+	if memberID != "" {
+		item.DiscordInteraction.Member = &discordgo.Member{User: &discordgo.User{ID: memberID}}
+	}
+
+	return item
+}
+
+func pendingNames(p *pendingQueue) []string {
+	names := make([]string, p.len())
+
+	for idx := range names {
+		names[idx] = p.at(idx).Prompt
+	}
+
+	return names
+}
+
+func TestPendingQueuePush(t *testing.T) {
+	type push struct {
+		memberID string
+		name     string
+	}
+
+	tests := []struct {
+		name   string
+		pushes []push
+		want   []string
+	}{
+		{
+			name:   "one member keeps their order",
+			pushes: []push{{"a", "a1"}, {"a", "a2"}, {"a", "a3"}},
+			want:   []string{"a1", "a2", "a3"},
+		},
+		{
+			name:   "members take turns",
+			pushes: []push{{"a", "a1"}, {"a", "a2"}, {"a", "a3"}, {"b", "b1"}, {"b", "b2"}, {"c", "c1"}},
+			want:   []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		{
+			name:   "a new member goes after the first round",
+			pushes: []push{{"a", "a1"}, {"b", "b1"}, {"a", "a2"}, {"c", "c1"}},
+			want:   []string{"a1", "b1", "c1", "a2"},
+		},
+		{
+			name:   "items without a member are all in the first round",
+			pushes: []push{{"a", "a1"}, {"a", "a2"}, {"", "x1"}, {"", "x2"}},
+			want:   []string{"a1", "x1", "x2", "a2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newPendingQueue(maxQueueSize)
+
+			for _, push := range test.pushes {
+				_, err := p.push(testItem(push.memberID, push.name))
+				if err != nil {
+					t.Fatalf("push(%s) returned error: %v", push.name, err)
+				}
+			}
+
+			if got := pendingNames(p); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("queue = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPendingQueuePushReturnsIndex(t *testing.T) {
+	p := newPendingQueue(maxQueueSize)
+
+	for _, name := range []string{"a1", "a2"} {
+		_, err := p.push(testItem("a", name))
+		if err != nil {
+			t.Fatalf("push(%s) returned error: %v", name, err)
+		}
+	}
+
+	index, err := p.push(testItem("b", "b1"))
+	if err != nil {
+		t.Fatalf("push(b1) returned error: %v", err)
+	}
+
+	if index != 1 {
+		t.Errorf("push(b1) = %d, want 1", index)
+	}
+}
+
+func TestPendingQueueRoundsAfterRemoving(t *testing.T) {
+	p := newPendingQueue(maxQueueSize)
+
+	for _, name := range []string{"a1", "a2", "a3"} {
+		_, err := p.push(testItem("a", name))
+		if err != nil {
+			t.Fatalf("push(%s) returned error: %v", name, err)
+		}
+	}
+
+	// once a1 is being processed, a2 is in the first round, so b1 goes after it
+	p.removeAt(0)
+
+	_, err := p.push(testItem("b", "b1"))
+	if err != nil {
+		t.Fatalf("push(b1) returned error: %v", err)
+	}
+
+	want := []string{"a2", "b1", "a3"}
+
+	if got := pendingNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("queue = %v, want %v", got, want)
+	}
+}
+
+func TestPendingQueuePushFront(t *testing.T) {
+	p := newPendingQueue(2)
+
+	for _, name := range []string{"b1", "c1"} {
+		_, err := p.push(testItem(name[:1], name))
+		if err != nil {
+			t.Fatalf("push(%s) returned error: %v", name, err)
+		}
+	}
+
+	// resumed items are let in even though the line is full
+	p.pushFront([]*QueueItem{testItem("a", "a1"), testItem("a", "a2")})
+
+	want := []string{"a1", "a2", "b1", "c1"}
+
+	if got := pendingNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("queue = %v, want %v", got, want)
+	}
+
+	var fullErr *QueueFullError
+
+	_, err := p.push(testItem("d", "d1"))
+	if !errors.As(err, &fullErr) {
+		t.Errorf("push(d1) returned %v, want a QueueFullError", err)
+	}
+}
@@ -0,0 +1,175 @@
+package imagine_queue
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"stable_diffusion_bot/entities"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxQueueItemAttempts is how many times an item is started before giving up on it, e.g. when the
+	// bot keeps being restarted while generating it
+	maxQueueItemAttempts = 2
+
+	// interactionTokenLifetime is how long Discord allows the bot to edit its reply to an interaction
+	interactionTokenLifetime = 15 * time.Minute
+)
+
+// persistQueueItem stores the item, so that it can be resumed if the bot restarts before processing it.
+func (q *queueImpl) persistQueueItem(item *QueueItem) error {
+	payload, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	persistedItem, err := q.queueItemRepo.Create(context.Background(), &entities.QueueItem{
+		MemberID: item.memberID(),
+		Payload:  string(payload),
+		Status:   entities.QueueItemStatusQueued,
+	})
+	if err != nil {
+		return err
+	}
+
+	item.persistedID = persistedItem.ID
+
+	return nil
+}
+
+// deletePersistedQueueItem removes an item that was never processed, because it couldn't be put in line
+// or was cancelled while waiting, so that it doesn't count towards the member's hourly limit.
+func (q *queueImpl) deletePersistedQueueItem(item *QueueItem) {
+	err := q.queueItemRepo.Delete(context.Background(), item.persistedID)
+	if err != nil {
+		log.Printf("Error deleting queue item %d: %v", item.persistedID, err)
+	}
+}
+
+// markQueueItemRunning records that the item has been started, so that it's known to have been
+// interrupted if the bot restarts before it's done.
+func (q *queueImpl) markQueueItemRunning(item *QueueItem) {
+	item.attempts++
+
+	err := q.queueItemRepo.UpdateStatus(context.Background(), item.persistedID, entities.QueueItemStatusRunning, item.attempts)
+	if err != nil {
+		log.Printf("Error marking queue item %d as running: %v", item.persistedID, err)
+	}
+}
+
+// finishPersistedQueueItem records that the item has been processed, whether it worked or not, so that
+// it isn't resumed. It's kept for a while after that, to count towards the member's hourly limit.
+func (q *queueImpl) finishPersistedQueueItem(item *QueueItem) {
+	err := q.queueItemRepo.UpdateStatus(context.Background(), item.persistedID, entities.QueueItemStatusFinished, item.attempts)
+	if err != nil {
+		log.Printf("Error finishing queue item %d: %v", item.persistedID, err)
+	}
+}
+
+// resumePersistedQueue puts the items that were left over from before the bot restarted back at the
+// front of the queue. Items that were interrupted while being processed are retried, unless they have
+// already been tried too many times, in which case the user is told that it failed.
+func (q *queueImpl) resumePersistedQueue() {
+	persistedItems, err := q.queueItemRepo.GetUnfinished(context.Background())
+	if err != nil {
+		log.Printf("Error getting persisted queue items: %v", err)
+
+		return
+	}
+
+	resumedItems := make([]*QueueItem, 0, len(persistedItems))
+
+	for _, persistedItem := range persistedItems {
+		item := &QueueItem{}
+
+		err = json.Unmarshal([]byte(persistedItem.Payload), item)
+		if err != nil || item.DiscordInteraction == nil {
+			log.Printf("Error decoding persisted queue item %d: %v", persistedItem.ID, err)
+
+			q.finishPersistedQueueItem(&QueueItem{persistedID: persistedItem.ID})
+
+			continue
+		}
+
+		item.persistedID = persistedItem.ID
+		item.attempts = persistedItem.Attempts
+
+		if interactionExpired(item.DiscordInteraction) {
+			log.Printf("Dropping persisted queue item %d, as its interaction has expired", persistedItem.ID)
+
+			q.finishPersistedQueueItem(item)
+
+			continue
+		}
+
+		if persistedItem.Status == entities.QueueItemStatusRunning {
+			if item.attempts >= maxQueueItemAttempts {
+				log.Printf("Giving up on interrupted queue item %d after %d attempts", persistedItem.ID, item.attempts)
+
+				q.reportInterruptedItem(item)
+				q.finishPersistedQueueItem(item)
+
+				continue
+			}
+
+			log.Printf("Retrying interrupted queue item %d", persistedItem.ID)
+		}
+
+		item.model = q.itemModel(item)
+
+		resumedItems = append(resumedItems, item)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queuedIDs := make(map[int64]bool, q.pending.len())
+
+	for idx := 0; idx < q.pending.len(); idx++ {
+		queuedIDs[q.pending.at(idx).persistedID] = true
+	}
+
+	resumed := make([]*QueueItem, 0, len(resumedItems))
+
+	for _, item := range resumedItems {
+		if !queuedIDs[item.persistedID] {
+			resumed = append(resumed, item)
+		}
+	}
+
+	if len(resumed) > 0 {
+		log.Printf("Resuming %d queue items from before restarting", len(resumed))
+	}
+
+	q.pending.pushFront(resumed)
+}
+
+// interactionExpired is true when the bot can no longer edit its reply to the interaction.
+func interactionExpired(interaction *discordgo.Interaction) bool {
+	return interactionTimeLeft(interaction) < 0
+}
+
+// interactionTimeLeft is how much longer the bot can edit its reply to the interaction.
+func interactionTimeLeft(interaction *discordgo.Interaction) time.Duration {
+	createdAt, err := discordgo.SnowflakeTimestamp(interaction.ID)
+	if err != nil {
+		return interactionTokenLifetime
+	}
+
+	return interactionTokenLifetime - time.Since(createdAt)
+}
+
+// reportInterruptedItem lets the user know that their imagine won't be finished.
+func (q *queueImpl) reportInterruptedItem(imagine *QueueItem) {
+	errorContent := "I'm sorry, but I was restarted while imagining this, and couldn't finish it. Please try again."
+
+	_, err := q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+		Content: &errorContent,
+	})
+	if err != nil {
+		log.Printf("Error editing interaction: %v", err)
+	}
+}
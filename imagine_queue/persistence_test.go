@@ -0,0 +1,419 @@
+package imagine_queue
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/repositories"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordEpoch is the start of Discord's snowflake timestamps, in milliseconds since the Unix epoch
+const discordEpoch = 1420070400000
+
+// fakeQueueItemRepo keeps queue items in memory, in place of the database.
+type fakeQueueItemRepo struct {
+	mu     sync.Mutex
+	items  map[int64]*entities.QueueItem
+	nextID int64
+
+	// countDelay is how long a count takes to come back, like a query would, so that items added
+	// together overlap
+	countDelay time.Duration
+}
+
+func newFakeQueueItemRepo() *fakeQueueItemRepo {
+	return &fakeQueueItemRepo{items: make(map[int64]*entities.QueueItem)}
+}
+
+func (repo *fakeQueueItemRepo) Create(_ context.Context, item *entities.QueueItem) (*entities.QueueItem, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.nextID++
+
+	stored := *item
+	stored.ID = repo.nextID
+
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+
+	repo.items[stored.ID] = &stored
+
+	created := stored
+
+	return &created, nil
+}
+
+func (repo *fakeQueueItemRepo) UpdateStatus(_ context.Context, id int64, status entities.QueueItemStatus, attempts int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	item, ok := repo.items[id]
+	if !ok {
+		return repositories.NewNotFoundError("queue item")
+	}
+
+	item.Status = status
+	item.Attempts = attempts
+
+	return nil
+}
+
+func (repo *fakeQueueItemRepo) GetUnfinished(_ context.Context) ([]*entities.QueueItem, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var items []*entities.QueueItem
+
+	for id := int64(1); id <= repo.nextID; id++ {
+		item, ok := repo.items[id]
+		if ok && item.Status != entities.QueueItemStatusFinished {
+			unfinished := *item
+			items = append(items, &unfinished)
+		}
+	}
+
+	return items, nil
+}
+
+func (repo *fakeQueueItemRepo) CountByMemberSince(_ context.Context, memberID string, since time.Time) (int, error) {
+	repo.mu.Lock()
+
+	count := 0
+
+	for _, item := range repo.items {
+		if item.MemberID == memberID && !item.CreatedAt.Before(since) {
+			count++
+		}
+	}
+
+	repo.mu.Unlock()
+
+	time.Sleep(repo.countDelay)
+
+	return count, nil
+}
+
+func (repo *fakeQueueItemRepo) DeleteFinishedBefore(_ context.Context, before time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for id, item := range repo.items {
+		if item.Status == entities.QueueItemStatusFinished && item.CreatedAt.Before(before) {
+			delete(repo.items, id)
+		}
+	}
+
+	return nil
+}
+
+func (repo *fakeQueueItemRepo) Delete(_ context.Context, id int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.items, id)
+
+	return nil
+}
+
+func (repo *fakeQueueItemRepo) status(id int64) (entities.QueueItemStatus, bool) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	item, ok := repo.items[id]
+	if !ok {
+		return "", false
+	}
+
+	return item.Status, true
+}
+
+// fakeDefaultSettingsRepo keeps settings in memory, in place of the database.
+type fakeDefaultSettingsRepo struct {
+	mu       sync.Mutex
+	settings map[string]*entities.DefaultSettings
+}
+
+func newFakeDefaultSettingsRepo() *fakeDefaultSettingsRepo {
+	return &fakeDefaultSettingsRepo{settings: make(map[string]*entities.DefaultSettings)}
+}
+
+func (repo *fakeDefaultSettingsRepo) Upsert(_ context.Context, settings *entities.DefaultSettings) (*entities.DefaultSettings, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored := *settings
+	repo.settings[settings.MemberID] = &stored
+
+	upserted := stored
+
+	return &upserted, nil
+}
+
+func (repo *fakeDefaultSettingsRepo) GetByMemberID(_ context.Context, memberID string) (*entities.DefaultSettings, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	settings, ok := repo.settings[memberID]
+	if !ok {
+		return nil, repositories.NewNotFoundError("default settings")
+	}
+
+	found := *settings
+
+	return &found, nil
+}
+
+// roundTripFunc answers the bot's requests to Discord in tests.
+type roundTripFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// newTestSession is a Discord session that answers every request with an empty message, and counts
+// the requests it was sent.
+func newTestSession(t *testing.T, requests *int) *discordgo.Session {
+	session, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatalf("discordgo.New returned error: %v", err)
+	}
+
+	var mu sync.Mutex
+
+	session.Client = &http.Client{
+		Transport: roundTripFunc(func(request *http.Request) (*http.Response, error) {
+			mu.Lock()
+			*requests++
+			mu.Unlock()
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(`{"id": "1"}`)),
+				Request:    request,
+			}, nil
+		}),
+	}
+
+	return session
+}
+
+// newTestQueue is a queue with the repository, the bot's default settings, and nothing else that the
+// tests don't need.
+func newTestQueue(repo *fakeQueueItemRepo) *queueImpl {
+	defaultSettingsRepo := newFakeDefaultSettingsRepo()
+
+	defaultSettingsRepo.settings[botID] = &entities.DefaultSettings{MemberID: botID, Model: "default-model"}
+
+	return &queueImpl{
+		pending:             newPendingQueue(maxQueueSize),
+		queueItemRepo:       repo,
+		defaultSettingsRepo: defaultSettingsRepo,
+	}
+}
+
+// testInteraction is an imagine command from the member, created at the time.
+func testInteraction(memberID string, createdAt time.Time) *discordgo.Interaction {
+	return &discordgo.Interaction{
+		ID:    strconv.FormatInt((createdAt.UnixMilli()-discordEpoch)<<22, 10),
+		Type:  discordgo.InteractionApplicationCommand,
+		Data:  discordgo.ApplicationCommandInteractionData{Name: "imagine"},
+		Token: "token-" + memberID,
+		Member: &discordgo.Member{
+			User: &discordgo.User{ID: memberID},
+		},
+	}
+}
+
+func TestPersistedQueueItemRoundTrip(t *testing.T) {
+	repo := newFakeQueueItemRepo()
+	q := newTestQueue(repo)
+
+	strength := 0.0
+
+	item := &QueueItem{
+		Prompt:             "a cute kitten --ar 16:9",
+		Type:               ItemTypeImageToImage,
+		InitImageURL:       "https://example.com/kitten.png",
+		DenoisingStrength:  &strength,
+		DiscordInteraction: testInteraction("member", time.Now()),
+	}
+
+	err := q.persistQueueItem(item)
+	if err != nil {
+		t.Fatalf("persistQueueItem returned error: %v", err)
+	}
+
+	if item.persistedID == 0 {
+		t.Fatal("persistQueueItem didn't set the persisted ID")
+	}
+
+	resumedQueue := newTestQueue(repo)
+	resumedQueue.resumePersistedQueue()
+
+	if resumedQueue.pending.len() != 1 {
+		t.Fatalf("resumed %d items, want 1", resumedQueue.pending.len())
+	}
+
+	resumed := resumedQueue.pending.at(0)
+
+	if resumed.persistedID != item.persistedID {
+		t.Errorf("resumed item has persisted ID %d, want %d", resumed.persistedID, item.persistedID)
+	}
+
+	if resumed.Prompt != item.Prompt || resumed.Type != item.Type || resumed.InitImageURL != item.InitImageURL {
+		t.Errorf("resumed item is a %d for %q from %q, want a %d for %q from %q",
+			resumed.Type, resumed.Prompt, resumed.InitImageURL, item.Type, item.Prompt, item.InitImageURL)
+	}
+
+	if resumed.DenoisingStrength == nil || *resumed.DenoisingStrength != 0 {
+		t.Errorf("resumed item's denoising strength = %v, want 0", resumed.DenoisingStrength)
+	}
+
+	if resumed.memberID() != "member" || resumed.DiscordInteraction.Token != item.DiscordInteraction.Token {
+		t.Errorf("resumed item's interaction = %+v, want %+v", *resumed.DiscordInteraction, *item.DiscordInteraction)
+	}
+
+	// the model is worked out again from the settings, as it isn't persisted
+	if resumed.model != "default-model" {
+		t.Errorf("resumed item's model = %q, want %q", resumed.model, "default-model")
+	}
+}
+
+func TestResumePersistedQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    entities.QueueItemStatus
+		attempts  int
+		createdAt time.Time
+		payload   string
+		resumed   bool
+		finished  bool
+		reported  bool
+	}{
+		{
+			name:      "queued",
+			status:    entities.QueueItemStatusQueued,
+			createdAt: time.Now(),
+			resumed:   true,
+		},
+		{
+			name:      "interrupted",
+			status:    entities.QueueItemStatusRunning,
+			attempts:  1,
+			createdAt: time.Now(),
+			resumed:   true,
+		},
+		{
+			name:      "interrupted too many times",
+			status:    entities.QueueItemStatusRunning,
+			attempts:  maxQueueItemAttempts,
+			createdAt: time.Now(),
+			finished:  true,
+			reported:  true,
+		},
+		{
+			name:      "interaction expired",
+			status:    entities.QueueItemStatusQueued,
+			createdAt: time.Now().Add(-interactionTokenLifetime - time.Minute),
+			finished:  true,
+		},
+		{
+			name:      "undecodable",
+			status:    entities.QueueItemStatusQueued,
+			createdAt: time.Now(),
+			payload:   "not json",
+			finished:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newFakeQueueItemRepo()
+
+			payload := test.payload
+
+			if payload == "" {
+				encoded, err := json.Marshal(&QueueItem{
+					Prompt:             "a cute kitten",
+					DiscordInteraction: testInteraction("member", test.createdAt),
+				})
+				if err != nil {
+					t.Fatalf("json.Marshal returned error: %v", err)
+				}
+
+				payload = string(encoded)
+			}
+
+			persisted, _ := repo.Create(context.Background(), &entities.QueueItem{
+				MemberID: "member",
+				Payload:  payload,
+				Status:   test.status,
+				Attempts: test.attempts,
+			})
+
+			requests := 0
+
+			q := newTestQueue(repo)
+			q.botSession = newTestSession(t, &requests)
+
+			q.resumePersistedQueue()
+
+			if resumed := q.pending.len() == 1; resumed != test.resumed {
+				t.Fatalf("resumed = %v, want %v", resumed, test.resumed)
+			}
+
+			if test.resumed && q.pending.at(0).attempts != test.attempts {
+				t.Errorf("resumed item has %d attempts, want %d", q.pending.at(0).attempts, test.attempts)
+			}
+
+			status, _ := repo.status(persisted.ID)
+
+			if finished := status == entities.QueueItemStatusFinished; finished != test.finished {
+				t.Errorf("finished = %v, want %v", finished, test.finished)
+			}
+
+			if reported := requests > 0; reported != test.reported {
+				t.Errorf("reported to Discord = %v, want %v", reported, test.reported)
+			}
+		})
+	}
+}
+
+func TestResumePersistedQueueSkipsQueuedItems(t *testing.T) {
+	repo := newFakeQueueItemRepo()
+	q := newTestQueue(repo)
+
+	item := &QueueItem{
+		Prompt:             "a cute kitten",
+		DiscordInteraction: testInteraction("member", time.Now()),
+	}
+
+	err := q.persistQueueItem(item)
+	if err != nil {
+		t.Fatalf("persistQueueItem returned error: %v", err)
+	}
+
+	// the item was added after the queue started, but before the persisted items were resumed
+	_, err = q.pending.push(item)
+	if err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+
+	q.resumePersistedQueue()
+
+	if q.pending.len() != 1 {
+		t.Errorf("queue has %d items after resuming, want 1", q.pending.len())
+	}
+}
@@ -0,0 +1,134 @@
+package imagine_queue
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// QueuedMessageContent is the reply to an item while it waits in line.
+func QueuedMessageContent(item *QueueItem, position int) string {
+	userID := item.memberID()
+
+	switch item.Type {
+	case ItemTypeReroll:
+		return fmt.Sprintf("I'm reimagining that for you... You are currently #%d in line.", position)
+	case ItemTypeUpscale:
+		return fmt.Sprintf("I'm upscaling that for you... You are currently #%d in line.", position)
+	case ItemTypeVariation:
+		return fmt.Sprintf("I'm imagining more variations for you... You are currently #%d in line.", position)
+	case ItemTypeImageToImage:
+		return fmt.Sprintf(
+			"I'm dreaming something up for you from your image. You are currently #%d in line.\n<@%s> asked me to imagine \"%s\".",
+			position, userID, item.Prompt)
+	case ItemTypeInpaint:
+		return fmt.Sprintf(
+			"I'm repainting your image. You are currently #%d in line.\n<@%s> asked me to imagine \"%s\".",
+			position, userID, item.Prompt)
+	case ItemTypeSweep:
+		return fmt.Sprintf(
+			"I'm animating something for you. You are currently #%d in line.\n<@%s> asked me to imagine \"%s\".",
+			position, userID, item.Prompt)
+	default:
+		return fmt.Sprintf(
+			"I'm dreaming something up for you. You are currently #%d in line.\n<@%s> asked me to imagine \"%s\".",
+			position, userID, item.Prompt)
+	}
+}
+
+// runningCount is how many items the backends are working on. It must be called with the queue's mutex held.
+func (q *queueImpl) runningCount() int {
+	running := 0
+
+	for _, b := range q.backends {
+		if b.currentImagine != nil {
+			running++
+		}
+	}
+
+	return running
+}
+
+// queuedPosition is the place in line of the item at the index of the pending queue, counting the
+// items that are already being worked on as being ahead of it. It must be called with the queue's mutex held.
+func (q *queueImpl) queuedPosition(index int) int {
+	return q.runningCount() + index + 1
+}
+
+type positionUpdate struct {
+	item     *QueueItem
+	position int
+}
+
+// updateQueuedPositions edits the replies of the items whose place in line has changed. The edits are
+// made in the background, and only one batch of them at a time, so that a slow edit doesn't hold up
+// the queue. It must be called with the queue's mutex held.
+func (q *queueImpl) updateQueuedPositions() {
+	if q.updatingPositions {
+		return
+	}
+
+	var updates []positionUpdate
+
+	for idx := 0; idx < q.pending.len(); idx++ {
+		item := q.pending.at(idx)
+		position := q.queuedPosition(idx)
+
+		if item.position == position {
+			continue
+		}
+
+		item.position = position
+
+		updates = append(updates, positionUpdate{item: item, position: position})
+	}
+
+	if len(updates) == 0 {
+		return
+	}
+
+	q.updatingPositions = true
+
+	go func() {
+		defer func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.updatingPositions = false
+		}()
+
+		for _, update := range updates {
+			q.editQueuedMessage(update.item, update.position)
+		}
+	}()
+}
+
+// editQueuedMessage shows the item's new place in line, unless it has already left the line, in which
+// case its reply is showing something else, like the progress.
+func (q *queueImpl) editQueuedMessage(item *QueueItem, position int) {
+	item.messageMu.Lock()
+	defer item.messageMu.Unlock()
+
+	if item.leftQueue {
+		return
+	}
+
+	content := QueuedMessageContent(item, position)
+
+	_, err := q.botSession.InteractionResponseEdit(item.DiscordInteraction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+	if err != nil {
+		log.Printf("Error editing queued interaction: %v", err)
+	}
+}
+
+// markLeftQueue stops the item's place in line from being shown, now that it's being processed or
+// has been cancelled.
+func (item *QueueItem) markLeftQueue() {
+	item.messageMu.Lock()
+	defer item.messageMu.Unlock()
+
+	item.leftQueue = true
+}
@@ -0,0 +1,110 @@
+package imagine_queue
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"time"
+)
+
+const (
+	// previewInterval is how often the preview is updated, as uploading it with every progress edit
+	// would run into Discord's rate limits
+	previewInterval = 5 * time.Second
+
+	// previewMaxSize is the longest side of the preview, in pixels
+	previewMaxSize = 256
+
+	previewQuality = 70
+)
+
+// previewImage decodes a preview from the progress endpoint, and shrinks it into a small JPEG.
+func previewImage(encodedImage string) (*bytes.Buffer, error) {
+	decodedImage, err := base64.StdEncoding.DecodeString(encodedImage)
+	if err != nil {
+		return nil, err
+	}
+
+	// the webui can be set to send previews as PNG or JPEG
+	img, _, err := image.Decode(bytes.NewReader(decodedImage))
+	if err != nil {
+		return nil, err
+	}
+
+	previewBuf := &bytes.Buffer{}
+
+	err = jpeg.Encode(previewBuf, shrinkImage(img, previewMaxSize), &jpeg.Options{Quality: previewQuality})
+	if err != nil {
+		return nil, err
+	}
+
+	return previewBuf, nil
+}
+
+// shrinkImage scales the image down so that neither side is longer than maxSize, averaging the pixels
+// that end up in each new pixel. Images that are already small enough are returned as they are.
+func shrinkImage(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+
+	newWidth := maxSize
+	newHeight := maxSize
+
+	if width > height {
+		newHeight = height * maxSize / width
+	} else {
+		newWidth = width * maxSize / height
+	}
+
+	if newWidth < 1 {
+		newWidth = 1
+	}
+
+	if newHeight < 1 {
+		newHeight = 1
+	}
+
+	shrunk := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+
+	for y := 0; y < newHeight; y++ {
+		startY := bounds.Min.Y + y*height/newHeight
+		endY := bounds.Min.Y + (y+1)*height/newHeight
+
+		for x := 0; x < newWidth; x++ {
+			startX := bounds.Min.X + x*width/newWidth
+			endX := bounds.Min.X + (x+1)*width/newWidth
+
+			var r, g, b, a, count uint64
+
+			for srcY := startY; srcY < endY; srcY++ {
+				for srcX := startX; srcX < endX; srcX++ {
+					pixelR, pixelG, pixelB, pixelA := img.At(srcX, srcY).RGBA()
+
+					r += uint64(pixelR)
+					g += uint64(pixelG)
+					b += uint64(pixelB)
+					a += uint64(pixelA)
+					count++
+				}
+			}
+
+			shrunk.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+
+	return shrunk
+}
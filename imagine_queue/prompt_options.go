@@ -0,0 +1,290 @@
+package imagine_queue
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PromptOptionError is returned when a --option in a prompt can't be understood. Its message is
+// meant to be shown to the user as-is.
+type PromptOptionError struct {
+	Option string
+	Reason string
+}
+
+func (e *PromptOptionError) Error() string {
+	if e.Option == "" {
+		return e.Reason
+	}
+
+	return fmt.Sprintf("--%s %s", e.Option, e.Reason)
+}
+
+// promptOptions is the result of parsing the Midjourney-style options out of a prompt. Options that
+// were not given are left at their zero value, except for Seed, which is -1 (random).
+type promptOptions struct {
+	SanitizedPrompt string
+	Width           int
+	Height          int
+	NegativePrompt  string
+	Seed            int
+	Steps           int
+	CfgScale        float64
+	SamplerName     string
+	Chaos           int
+	HiresScale      float64
+	Upscaler        string
+	Model           string
+}
+
+const (
+	emdash = '—'
+	hyphen = '-'
+
+	defaultHiresScale = 2
+
+	maxSteps    = 150
+	minCfgScale = 1
+	maxCfgScale = 30
+	maxChaos    = 100
+	maxHires    = 4
+
+	// maxAspectRatio is how many times longer one side can be than the other, so a prompt can't ask
+	// for an image too large for the webui to make
+	maxAspectRatio = 4
+)
+
+func fixEmDash(prompt string) string {
+	return strings.ReplaceAll(prompt, string(emdash), string(hyphen)+string(hyphen))
+}
+
+var (
+	optionRegex      = regexp.MustCompile(`(?:^|\s)--([A-Za-z]+)`)
+	aspectRatioRegex = regexp.MustCompile(`^(\d+):(\d+)$`)
+)
+
+// valueKind describes how much of the text following an option belongs to it.
+type valueKind int
+
+const (
+	// valueToken options take a single word, and the rest goes back into the prompt
+	valueToken valueKind = iota
+	// valueOptionalToken options are flags that may be followed by a single numeric word
+	valueOptionalToken
+	// valueText options take everything up to the next option, or a "quoted string"
+	valueText
+)
+
+var promptOptionKinds = map[string]valueKind{
+	"ar":       valueToken,
+	"seed":     valueToken,
+	"steps":    valueToken,
+	"cfg":      valueToken,
+	"chaos":    valueToken,
+	"hires":    valueOptionalToken,
+	"no":       valueText,
+	"sampler":  valueText,
+	"upscaler": valueText,
+	"model":    valueText,
+}
+
+// splitOptionValue splits the text following an option into the option's value, and whatever
+// remains of the prompt.
+func splitOptionValue(kind valueKind, text string) (string, string) {
+	text = strings.TrimSpace(text)
+
+	switch kind {
+	case valueText:
+		if strings.HasPrefix(text, `"`) {
+			closingQuote := strings.Index(text[1:], `"`)
+			if closingQuote >= 0 {
+				return text[1 : closingQuote+1], text[closingQuote+2:]
+			}
+		}
+
+		return text, ""
+	default:
+		value := text
+		rest := ""
+
+		if valueEnd := strings.IndexFunc(text, unicode.IsSpace); valueEnd >= 0 {
+			value = text[:valueEnd]
+			rest = text[valueEnd:]
+		}
+
+		if kind == valueOptionalToken {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return "", text
+			}
+		}
+
+		return value, rest
+	}
+}
+
+// parsePromptOptions extracts Midjourney-style options (e.g. "--ar 16:9 --no text, watermark") from
+// the prompt, validates them, and calculates the image dimensions from the given defaults.
+func parsePromptOptions(prompt string, width, height int) (*promptOptions, error) {
+	// Sanitize em dashes. Some phones will autocorrect to em dashes
+	prompt = fixEmDash(prompt)
+
+	options := &promptOptions{
+		Width:  width,
+		Height: height,
+		Seed:   -1,
+	}
+
+	optionLocations := optionRegex.FindAllStringSubmatchIndex(prompt, -1)
+
+	promptParts := []string{prompt}
+	if len(optionLocations) > 0 {
+		promptParts = []string{prompt[:optionLocations[0][0]]}
+	}
+
+	seenOptions := make(map[string]bool, len(optionLocations))
+
+	for idx, location := range optionLocations {
+		name := strings.ToLower(prompt[location[2]:location[3]])
+
+		valueEnd := len(prompt)
+		if idx+1 < len(optionLocations) {
+			valueEnd = optionLocations[idx+1][0]
+		}
+
+		kind, known := promptOptionKinds[name]
+		if !known {
+			return nil, &PromptOptionError{Option: name, Reason: "is not an option I understand"}
+		}
+
+		if seenOptions[name] {
+			return nil, &PromptOptionError{Option: name, Reason: "can only be used once"}
+		}
+
+		seenOptions[name] = true
+
+		value, rest := splitOptionValue(kind, prompt[location[1]:valueEnd])
+
+		promptParts = append(promptParts, rest)
+
+		err := options.apply(name, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	options.SanitizedPrompt = strings.Join(strings.Fields(strings.Join(promptParts, " ")), " ")
+
+	if options.SanitizedPrompt == "" {
+		return nil, &PromptOptionError{Reason: "the prompt can't be empty"}
+	}
+
+	if seenOptions["ar"] {
+		log.Printf("New dimensions: width: %v, height: %v", options.Width, options.Height)
+	}
+
+	return options, nil
+}
+
+func (o *promptOptions) apply(name, value string) error {
+	if value == "" && promptOptionKinds[name] != valueOptionalToken {
+		return &PromptOptionError{Option: name, Reason: "needs a value"}
+	}
+
+	switch name {
+	case "ar":
+		return o.applyAspectRatio(value)
+	case "seed":
+		seed, err := strconv.Atoi(value)
+		if err != nil || seed < -1 {
+			return &PromptOptionError{Option: name, Reason: "must be a whole number, or -1 for random"}
+		}
+
+		o.Seed = seed
+	case "steps":
+		steps, err := strconv.Atoi(value)
+		if err != nil || steps < 1 || steps > maxSteps {
+			return &PromptOptionError{Option: name, Reason: fmt.Sprintf("must be a whole number from 1 to %d", maxSteps)}
+		}
+
+		o.Steps = steps
+	case "cfg":
+		cfgScale, err := strconv.ParseFloat(value, 64)
+		if err != nil || cfgScale < minCfgScale || cfgScale > maxCfgScale {
+			return &PromptOptionError{Option: name, Reason: fmt.Sprintf("must be a number from %d to %d", minCfgScale, maxCfgScale)}
+		}
+
+		o.CfgScale = cfgScale
+	case "chaos":
+		chaos, err := strconv.Atoi(value)
+		if err != nil || chaos < 0 || chaos > maxChaos {
+			return &PromptOptionError{Option: name, Reason: fmt.Sprintf("must be a whole number from 0 to %d", maxChaos)}
+		}
+
+		o.Chaos = chaos
+	case "hires":
+		o.HiresScale = defaultHiresScale
+
+		if value != "" {
+			hiresScale, err := strconv.ParseFloat(value, 64)
+			if err != nil || hiresScale <= 1 || hiresScale > maxHires {
+				return &PromptOptionError{Option: name, Reason: fmt.Sprintf("scale must be more than 1, and at most %d", maxHires)}
+			}
+
+			o.HiresScale = hiresScale
+		}
+	case "no":
+		o.NegativePrompt = value
+	case "sampler":
+		o.SamplerName = value
+	case "upscaler":
+		o.Upscaler = value
+	case "model":
+		o.Model = value
+	}
+
+	return nil
+}
+
+func (o *promptOptions) applyAspectRatio(value string) error {
+	arMatches := aspectRatioRegex.FindStringSubmatch(value)
+	if len(arMatches) != 3 {
+		return &PromptOptionError{Option: "ar", Reason: "must look like <width>:<height>, e.g. 16:9"}
+	}
+
+	firstDimension, err := strconv.Atoi(arMatches[1])
+	if err != nil || firstDimension == 0 {
+		return &PromptOptionError{Option: "ar", Reason: "width must be more than 0"}
+	}
+
+	secondDimension, err := strconv.Atoi(arMatches[2])
+	if err != nil || secondDimension == 0 {
+		return &PromptOptionError{Option: "ar", Reason: "height must be more than 0"}
+	}
+
+	ratio := float64(firstDimension) / float64(secondDimension)
+	if ratio > maxAspectRatio || ratio < 1.0/maxAspectRatio {
+		return &PromptOptionError{Option: "ar", Reason: fmt.Sprintf("can be at most %d:1 or 1:%d", maxAspectRatio, maxAspectRatio)}
+	}
+
+	if firstDimension > secondDimension {
+		scaledWidth := float64(o.Height) * (float64(firstDimension) / float64(secondDimension))
+
+		// Round up to the nearest 8
+		o.Width = roundUpToEight(scaledWidth)
+	} else if secondDimension > firstDimension {
+		scaledHeight := float64(o.Width) * (float64(secondDimension) / float64(firstDimension))
+
+		// Round up to the nearest 8
+		o.Height = roundUpToEight(scaledHeight)
+	}
+
+	return nil
+}
+
+func roundUpToEight(value float64) int {
+	return (int(value) + 7) & (-8)
+}
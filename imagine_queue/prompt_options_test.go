@@ -0,0 +1,120 @@
+package imagine_queue
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePromptOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		want   promptOptions
+	}{
+		{
+			name:   "no options",
+			prompt: "a cute kitten",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 512, Seed: -1},
+		},
+		{
+			name:   "wide aspect ratio",
+			prompt: "a cute kitten --ar 16:9",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 912, Height: 512, Seed: -1},
+		},
+		{
+			name:   "tall aspect ratio",
+			prompt: "a cute kitten --ar 1:4",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 2048, Seed: -1},
+		},
+		{
+			name:   "em dash",
+			prompt: "a cute kitten —seed 42",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 512, Seed: 42},
+		},
+		{
+			name:   "text option runs to the next option",
+			prompt: "a cute kitten --no text, watermark --steps 30",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 512, Seed: -1, NegativePrompt: "text, watermark", Steps: 30},
+		},
+		{
+			name:   "quoted text option",
+			prompt: `a cute kitten --no "text, watermark" on a skateboard`,
+			want:   promptOptions{SanitizedPrompt: "a cute kitten on a skateboard", Width: 512, Height: 512, Seed: -1, NegativePrompt: "text, watermark"},
+		},
+		{
+			name:   "token option leaves the rest in the prompt",
+			prompt: "a cute kitten --cfg 7.5 on a skateboard",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten on a skateboard", Width: 512, Height: 512, Seed: -1, CfgScale: 7.5},
+		},
+		{
+			name:   "hires without a scale",
+			prompt: "a cute kitten --hires",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 512, Seed: -1, HiresScale: defaultHiresScale},
+		},
+		{
+			name:   "hires with a scale",
+			prompt: "a cute kitten --hires 1.5",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 512, Seed: -1, HiresScale: 1.5},
+		},
+		{
+			name:   "option names are case insensitive",
+			prompt: "a cute kitten --Chaos 20",
+			want:   promptOptions{SanitizedPrompt: "a cute kitten", Width: 512, Height: 512, Seed: -1, Chaos: 20},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, err := parsePromptOptions(test.prompt, 512, 512)
+			if err != nil {
+				t.Fatalf("parsePromptOptions(%q) returned error: %v", test.prompt, err)
+			}
+
+			if *options != test.want {
+				t.Errorf("parsePromptOptions(%q) = %+v, want %+v", test.prompt, *options, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePromptOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		option string
+	}{
+		{name: "unknown option", prompt: "a cute kitten --fast", option: "fast"},
+		{name: "repeated option", prompt: "a cute kitten --seed 1 --seed 2", option: "seed"},
+		{name: "missing value", prompt: "a cute kitten --seed", option: "seed"},
+		{name: "empty prompt", prompt: "--seed 1", option: ""},
+		{name: "aspect ratio without a colon", prompt: "a cute kitten --ar 16x9", option: "ar"},
+		{name: "aspect ratio with no width", prompt: "a cute kitten --ar 0:1", option: "ar"},
+		{name: "aspect ratio with no height", prompt: "a cute kitten --ar 1:0", option: "ar"},
+		{name: "aspect ratio too wide", prompt: "a cute kitten --ar 1000:1", option: "ar"},
+		{name: "aspect ratio too tall", prompt: "a cute kitten --ar 1:5", option: "ar"},
+		{name: "seed below -1", prompt: "a cute kitten --seed -2", option: "seed"},
+		{name: "seed not a number", prompt: "a cute kitten --seed abc", option: "seed"},
+		{name: "no steps", prompt: "a cute kitten --steps 0", option: "steps"},
+		{name: "too many steps", prompt: "a cute kitten --steps 151", option: "steps"},
+		{name: "cfg too low", prompt: "a cute kitten --cfg 0.5", option: "cfg"},
+		{name: "cfg too high", prompt: "a cute kitten --cfg 31", option: "cfg"},
+		{name: "chaos too high", prompt: "a cute kitten --chaos 101", option: "chaos"},
+		{name: "hires scale too low", prompt: "a cute kitten --hires 1", option: "hires"},
+		{name: "hires scale too high", prompt: "a cute kitten --hires 5", option: "hires"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePromptOptions(test.prompt, 512, 512)
+
+			var optionErr *PromptOptionError
+			if !errors.As(err, &optionErr) {
+				t.Fatalf("parsePromptOptions(%q) returned %v, want a PromptOptionError", test.prompt, err)
+			}
+
+			if optionErr.Option != test.option {
+				t.Errorf("parsePromptOptions(%q) failed on option %q, want %q", test.prompt, optionErr.Option, test.option)
+			}
+		})
+	}
+}
@@ -7,14 +7,17 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"regexp"
 	"stable_diffusion_bot/composite_renderer"
 	"stable_diffusion_bot/entities"
-	"stable_diffusion_bot/repositories"
+	"stable_diffusion_bot/image_storage"
+	"stable_diffusion_bot/png_info"
 	"stable_diffusion_bot/repositories/default_settings"
 	"stable_diffusion_bot/repositories/image_generations"
+	"stable_diffusion_bot/repositories/queue_items"
+	"stable_diffusion_bot/repositories/user_limits"
 	"stable_diffusion_bot/stable_diffusion_api"
 	"strconv"
 	"strings"
@@ -31,31 +34,106 @@ const (
 	initializedHeight     = 512
 	initializedBatchCount = 4
 	initializedBatchSize  = 1
+
+	initializedSamplerName       = "Euler a"
+	initializedSteps             = 20
+	initializedCfgScale          = 9
+	initializedRestoreFaces      = true
+	initializedDenoisingStrength = 0.7
+	initializedNegativePrompt    = DefaultNegativePrompt
+	initializedShowPreviews      = true
+	initializedGridStyle         = entities.GridStylePlain
+	initializedAttachmentMode    = entities.AttachmentModeGrid
+
+	// modelBatchWindow is how far ahead in the queue to look for an item that uses the model that
+	// is already loaded, and how many times an item can be passed over for one
+	modelBatchWindow = 5
+
+	modelsCacheDuration = 1 * time.Minute
+
+	// maxAPIErrorLength is how much of an error from the API is shown to the user
+	maxAPIErrorLength = 1000
+
+	// maxButtonsPerRow is how many buttons Discord allows in a row. A message can have 5 rows, which
+	// leaves room for variation and upscale buttons for the first maxGridButtons images of a grid.
+	maxButtonsPerRow = 5
+	maxGridButtons   = 10
+
+	// MaxGridImages is the most images a grid can have, with the largest batch count and size
+	MaxGridImages = 16
+
+	// maxAttachments is how many files Discord allows on a message
+	maxAttachments = 10
+
+	// gridGutter is the space, in pixels, around and between the tiles of captioned grids
+	gridGutter = 8
 )
 
 type queueImpl struct {
 	botSession          *discordgo.Session
-	stableDiffusionAPI  stable_diffusion_api.StableDiffusionAPI
-	queue               chan *QueueItem
-	currentImagine      *QueueItem
+	backends            []*backend
+	pending             *pendingQueue
+	updatingPositions   bool
 	mu                  sync.Mutex
 	imageGenerationRepo image_generations.Repository
 	compositeRenderer   composite_renderer.Renderer
+	pngInfo             png_info.PNGInfo
 	defaultSettingsRepo default_settings.Repository
+	queueItemRepo       queue_items.Repository
+	userLimitsRepo      user_limits.Repository
+	imageStorage        image_storage.Storage
+	uploadEncoder       composite_renderer.Encoder
+	maxUploadBytes      int
+	defaultUserLimits   UserLimits
 	botDefaultSettings  *entities.DefaultSettings
+	botDefaultsMu       sync.RWMutex
+	settingsMu          sync.Mutex
+	addMu               sync.Mutex
+	models              []*stable_diffusion_api.Model
+	modelsFetchedAt     time.Time
+	samplers            []*stable_diffusion_api.Sampler
+	samplersFetchedAt   time.Time
+	refreshingModels    bool
+	refreshingSamplers  bool
 }
 
 type Config struct {
-	StableDiffusionAPI  stable_diffusion_api.StableDiffusionAPI
+	StableDiffusionAPIs []stable_diffusion_api.StableDiffusionAPI
 	ImageGenerationRepo image_generations.Repository
 	DefaultSettingsRepo default_settings.Repository
+	QueueItemRepo       queue_items.Repository
+	UserLimitsRepo      user_limits.Repository
+	ImageStorage        image_storage.Storage
+
+	// UploadEncoder encodes the grids and upscales that are posted to Discord. Without one, they are
+	// posted as PNGs.
+	UploadEncoder composite_renderer.Encoder
+
+	// MaxUploadBytes is the largest file that can be posted to Discord. Sweep animations are shrunk to
+	// fit it, as they aren't posted through the UploadEncoder. 0 means there is no limit.
+	MaxUploadBytes int
+
+	// DefaultMaxQueued and DefaultMaxPerHour are the limits for members that don't have their own.
+	// A limit of 0 means there is no limit.
+	DefaultMaxQueued  int
+	DefaultMaxPerHour int
 }
 
 func New(cfg Config) (Queue, error) {
-	if cfg.StableDiffusionAPI == nil {
+	if len(cfg.StableDiffusionAPIs) == 0 {
 		return nil, errors.New("missing stable diffusion API")
 	}
 
+	backends := make([]*backend, len(cfg.StableDiffusionAPIs))
+
+	for idx, api := range cfg.StableDiffusionAPIs {
+		if api == nil {
+			return nil, errors.New("missing stable diffusion API")
+		}
+
+		backends[idx] = newBackend(api)
+	}
+
 	if cfg.ImageGenerationRepo == nil {
 		return nil, errors.New("missing image generation repository")
 	}
@@ -64,17 +142,49 @@ func New(cfg Config) (Queue, error) {
 		return nil, errors.New("missing default settings repository")
 	}
 
+	if cfg.QueueItemRepo == nil {
+		return nil, errors.New("missing queue item repository")
+	}
+
+	if cfg.UserLimitsRepo == nil {
+		return nil, errors.New("missing user limits repository")
+	}
+
+	if cfg.ImageStorage == nil {
+		return nil, errors.New("missing image storage")
+	}
+
 	compositeRenderer, err := composite_renderer.New(composite_renderer.Config{})
 	if err != nil {
 		return nil, err
 	}
 
+	pngInfo, err := png_info.New(png_info.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	uploadEncoder := cfg.UploadEncoder
+	if uploadEncoder == nil {
+		uploadEncoder = composite_renderer.NewPNGEncoder()
+	}
+
 	return &queueImpl{
-		stableDiffusionAPI:  cfg.StableDiffusionAPI,
+		backends:            backends,
 		imageGenerationRepo: cfg.ImageGenerationRepo,
-		queue:               make(chan *QueueItem, 100),
+		pending:             newPendingQueue(maxQueueSize),
 		compositeRenderer:   compositeRenderer,
+		pngInfo:             pngInfo,
 		defaultSettingsRepo: cfg.DefaultSettingsRepo,
+		queueItemRepo:       cfg.QueueItemRepo,
+		userLimitsRepo:      cfg.UserLimitsRepo,
+		imageStorage:        cfg.ImageStorage,
+		uploadEncoder:       uploadEncoder,
+		maxUploadBytes:      cfg.MaxUploadBytes,
+		defaultUserLimits: UserLimits{
+			MaxQueued:  cfg.DefaultMaxQueued,
+			MaxPerHour: cfg.DefaultMaxPerHour,
+		},
 	}, nil
 }
 
@@ -85,6 +195,10 @@ const (
 	ItemTypeReroll
 	ItemTypeUpscale
 	ItemTypeVariation
+	ItemTypeImageToImage
+	ItemTypeInpaint
+	ItemTypeReimagine
+	ItemTypeSweep
 )
 
 type QueueItem struct {
@@ -92,14 +206,199 @@ type QueueItem struct {
 	Type               ItemType
 	InteractionIndex   int
 	DiscordInteraction *discordgo.Interaction
+
+	// InitImageURL, DenoisingStrength and ResizeMode are only used by ItemTypeImageToImage and ItemTypeInpaint
+	// DenoisingStrength is nil when it wasn't chosen, to use the default.
+	InitImageURL      string
+	DenoisingStrength *float64
+	ResizeMode        int
+
+	// The mask is either an uploaded image, or the tile of the source grid image to repaint. The grid is
+	// found by GridMessageID, the bot's reply with the grid, if it's given. These, and the other
+	// inpainting options, are only used by ItemTypeInpaint
+	MaskImageURL   string
+	MaskTile       int
+	GridMessageID  string
+	MaskBlur       int
+	InpaintingFill int
+	InpaintFullRes bool
+
+	// Model is the checkpoint chosen with the command, instead of the default one
+	Model string
+
+	// Generation has the settings to imagine with again, and is only used by ItemTypeReimagine
+	Generation *entities.ImageGeneration
+
+	// Sweep has the setting to change between the frames of an animation, and is only used by ItemTypeSweep
+	Sweep *SweepOptions
+
+	// NegativePrompt is added to the default negative prompt, or replaces it if ReplaceNegativePrompt is set
+	NegativePrompt        string
+	ReplaceNegativePrompt bool
+
+	// model is the checkpoint the item is expected to use, which is used to batch together items
+	// that use the same model. skipped counts how many times other items were batched ahead of it.
+	model   string
+	skipped int
+
+	// persistedID is the stored copy of the item, and attempts counts how many times it has been started
+	persistedID int64
+	attempts    int
+
+	// round is how many of the member's items are ahead of the item in line, which is used to take
+	// turns between members. It's kept up to date by the pending queue as items leave or are moved.
+	round int
+
+	// position is the place in line that the item's reply last showed. leftQueue is set once the item
+	// is being processed or has been cancelled, and messageMu stops its place in line from being shown
+	// after that.
+	position  int
+	leftQueue bool
+	messageMu sync.Mutex
+
+	// cancelled is set when the item is cancelled while it's being processed. It's guarded by the queue's mutex.
+	cancelled bool
+}
+
+// user is the user that added the item. Interactions in servers have the user on their member, and
+// interactions in DMs only have the user.
+func (item *QueueItem) user() *discordgo.User {
+	if item.DiscordInteraction == nil {
+		return &discordgo.User{}
+	}
+
+	if item.DiscordInteraction.Member != nil && item.DiscordInteraction.Member.User != nil {
+		return item.DiscordInteraction.Member.User
+	}
+
+	if item.DiscordInteraction.User != nil {
+		return item.DiscordInteraction.User
+	}
+
+	return &discordgo.User{}
+}
+
+// memberID is the member that added the item.
+func (item *QueueItem) memberID() string {
+	return item.user().ID
 }
 
 func (q *queueImpl) AddImagine(item *QueueItem) (int, error) {
-	q.queue <- item
+	err := validatePrompt(item)
+	if err != nil {
+		return 0, err
+	}
 
-	linePosition := len(q.queue)
+	item.model = q.itemModel(item)
 
-	return linePosition, nil
+	limits, err := q.checkAndPersistQueueItem(item)
+	if err != nil {
+		return 0, err
+	}
+
+	position, err := q.pushQueueItem(item, limits)
+	if err != nil {
+		q.deletePersistedQueueItem(item)
+
+		return 0, err
+	}
+
+	return position, nil
+}
+
+// checkAndPersistQueueItem checks the member's hourly limit and stores the item. Both happen while
+// holding addMu, so that items added at the same time can't all be counted before any is stored.
+func (q *queueImpl) checkAndPersistQueueItem(item *QueueItem) (*UserLimits, error) {
+	q.addMu.Lock()
+	defer q.addMu.Unlock()
+
+	limits, err := q.checkUserLimits(item)
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.persistQueueItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+// pushQueueItem puts the persisted item in line, if there's space for it, and its member doesn't have
+// too many items queued already.
+func (q *queueImpl) pushQueueItem(item *QueueItem, limits *UserLimits) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// the item is persisted before it's put in line, so if the queue has only just started, it may
+	// already have been resumed from the database
+	for idx := 0; idx < q.pending.len(); idx++ {
+		if q.pending.at(idx).persistedID == item.persistedID {
+			item.position = q.queuedPosition(idx)
+
+			return item.position, nil
+		}
+	}
+
+	err := q.pending.checkSpace()
+	if err != nil {
+		return 0, err
+	}
+
+	err = q.checkQueuedLimit(item, limits)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := q.pending.push(item)
+	if err != nil {
+		return 0, err
+	}
+
+	item.position = q.queuedPosition(index)
+
+	return item.position, nil
+}
+
+// itemModel works out which checkpoint an item will be generated with, if it isn't the default.
+func (q *queueImpl) itemModel(item *QueueItem) string {
+	switch item.Type {
+	case ItemTypeReroll, ItemTypeVariation, ItemTypeUpscale:
+		sortOrder := item.InteractionIndex
+		if item.Type == ItemTypeReroll {
+			sortOrder = 0
+		}
+
+		generation, err := q.getPreviousGeneration(item, sortOrder)
+		if err != nil {
+			return ""
+		}
+
+		return generation.Model
+	case ItemTypeReimagine:
+		if item.Generation == nil {
+			return ""
+		}
+
+		return item.Generation.Model
+	default:
+		options, err := parsePromptOptions(item.Prompt, initializedWidth, initializedHeight)
+		if err == nil && options.Model != "" {
+			return options.Model
+		}
+
+		if item.Model != "" {
+			return item.Model
+		}
+
+		settings, err := q.requesterSettings(item)
+		if err != nil {
+			return ""
+		}
+
+		return settings.Model
+	}
 }
 
 func (q *queueImpl) StartPolling(botSession *discordgo.Session) {
@@ -112,7 +411,19 @@ func (q *queueImpl) StartPolling(botSession *discordgo.Session) {
 		return
 	}
 
+	q.botDefaultsMu.Lock()
 	q.botDefaultSettings = botDefaultSettings
+	q.botDefaultsMu.Unlock()
+
+	// the models and samplers are fetched ahead of time, so that they're ready for the settings and autocomplete
+	q.ListModels()
+	q.ListSamplers()
+
+	q.resumePersistedQueue()
+	q.pruneUsage()
+	q.pruneImages()
+
+	lastPruned := time.Now()
 
 	log.Println("Press Ctrl+C to exit")
 
@@ -121,13 +432,21 @@ func (q *queueImpl) StartPolling(botSession *discordgo.Session) {
 
 	stopPolling := false
 
+	q.checkBackendsHealth()
+
 	for {
 		select {
 		case <-stop:
 			stopPolling = true
 		case <-time.After(1 * time.Second):
-			if q.currentImagine == nil {
-				q.pullNextInQueue()
+			q.checkBackendsHealth()
+			q.pullNextInQueue()
+
+			if time.Since(lastPruned) > usageWindow {
+				q.pruneUsage()
+				q.pruneImages()
+
+				lastPruned = time.Now()
 			}
 		}
 
@@ -139,320 +458,437 @@ func (q *queueImpl) StartPolling(botSession *discordgo.Session) {
 	log.Printf("Polling stopped...\n")
 }
 
+// pullNextInQueue hands out items from the front of the queue to each idle backend, and then lets
+// the items still waiting know if their place in line has changed.
 func (q *queueImpl) pullNextInQueue() {
-	if len(q.queue) > 0 {
-		element := <-q.queue
-
-		q.mu.Lock()
-		defer q.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-		q.currentImagine = element
+	defer q.updateQueuedPositions()
 
-		q.processCurrentImagine()
-	}
-}
-
-func (q *queueImpl) fillInBotDefaults(settings *entities.DefaultSettings) (*entities.DefaultSettings, bool) {
-	updated := false
-
-	if settings == nil {
-		settings = &entities.DefaultSettings{
-			MemberID: botID,
+	for q.pending.len() > 0 {
+		b := q.idleBackend(q.pending.at(0).model)
+		if b == nil {
+			return
 		}
-	}
 
-	if settings.Width == 0 {
-		settings.Width = initializedWidth
-		updated = true
-	}
+		index := q.nextItemIndex(b.currentModel)
 
-	if settings.Height == 0 {
-		settings.Height = initializedHeight
-		updated = true
-	}
+		element := q.pending.removeAt(index)
 
-	if settings.BatchCount == 0 {
-		settings.BatchCount = initializedBatchCount
-		updated = true
-	}
+		b.currentImagine = element
 
-	if settings.BatchSize == 0 {
-		settings.BatchSize = initializedBatchSize
-		updated = true
+		q.processCurrentImagine(b, element)
 	}
-
-	return settings, updated
 }
 
-func (q *queueImpl) initializeOrGetBotDefaults() (*entities.DefaultSettings, error) {
-	botDefaultSettings, err := q.GetBotDefaultSettings()
-	if err != nil && !errors.Is(err, &repositories.NotFoundError{}) {
-		return nil, err
+// nextItemIndex picks the next item to process. Items that use the model that is already loaded are
+// preferred, to avoid reloading checkpoints between every item, as long as they are near the front
+// of the queue and the items they jump ahead of haven't already been passed over too many times.
+func (q *queueImpl) nextItemIndex(currentModel string) int {
+	head := q.pending.at(0)
+
+	if currentModel == "" || head.model == "" || head.model == currentModel || head.skipped >= modelBatchWindow {
+		return 0
 	}
 
-	botDefaultSettings, updated := q.fillInBotDefaults(botDefaultSettings)
-	if updated {
-		botDefaultSettings, err = q.defaultSettingsRepo.Upsert(context.Background(), botDefaultSettings)
-		if err != nil {
-			return nil, err
+	for idx := 1; idx < q.pending.len() && idx <= modelBatchWindow; idx++ {
+		if q.pending.at(idx).model != currentModel {
+			continue
 		}
 
-		log.Printf("Initialized bot default settings: %+v\n", botDefaultSettings)
-	} else {
-		log.Printf("Retrieved bot default settings: %+v\n", botDefaultSettings)
+		for passedOver := 0; passedOver < idx; passedOver++ {
+			q.pending.at(passedOver).skipped++
+		}
+
+		return idx
 	}
 
-	return botDefaultSettings, nil
+	return 0
 }
 
-func (q *queueImpl) GetBotDefaultSettings() (*entities.DefaultSettings, error) {
-	if q.botDefaultSettings != nil {
-		return q.botDefaultSettings, nil
+// loadModel switches the backend to the given checkpoint, unless it's already loaded.
+func (q *queueImpl) loadModel(b *backend, model string) error {
+	q.mu.Lock()
+	currentModel := b.currentModel
+	q.mu.Unlock()
+
+	if model == "" || model == currentModel {
+		return nil
 	}
 
-	defaultSettings, err := q.defaultSettingsRepo.GetByMemberID(context.Background(), botID)
+	log.Printf("Loading model on %s: %v", b.host(), model)
+
+	err := b.api.SetModel(context.Background(), model)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	q.botDefaultSettings = defaultSettings
+	q.mu.Lock()
+	b.currentModel = model
+	q.mu.Unlock()
 
-	return defaultSettings, nil
+	return nil
 }
 
-func (q *queueImpl) defaultWidth() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
-	if err != nil {
-		return 0, err
-	}
+// ListModels returns the checkpoints available to the API. They're used to answer interactions, which
+// can't wait for the API, so they're cached, and refreshed in the background once they're out of date.
+// There are none until they've been fetched for the first time.
+func (q *queueImpl) ListModels() ([]*stable_diffusion_api.Model, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	return defaultSettings.Width, nil
-}
+	if time.Since(q.modelsFetchedAt) >= modelsCacheDuration && !q.refreshingModels {
+		q.refreshingModels = true
 
-func (q *queueImpl) defaultHeight() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
-	if err != nil {
-		return 0, err
+		go q.refreshModels()
 	}
 
-	return defaultSettings.Height, nil
+	return q.models, nil
 }
 
-func (q *queueImpl) defaultBatchCount() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
-	if err != nil {
-		return 0, err
-	}
+func (q *queueImpl) refreshModels() {
+	ctx, cancel := apiCallContext()
+	defer cancel()
 
-	return defaultSettings.BatchCount, nil
-}
+	models, err := q.anyAPI().ListModels(ctx)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.refreshingModels = false
 
-func (q *queueImpl) defaultBatchSize() (int, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
 	if err != nil {
-		return 0, err
+		log.Printf("Error listing models: %v", err)
+
+		return
 	}
 
-	return defaultSettings.BatchSize, nil
+	q.models = models
+	q.modelsFetchedAt = time.Now()
 }
 
-func (q *queueImpl) UpdateDefaultDimensions(width, height int) (*entities.DefaultSettings, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
-	if err != nil {
-		return nil, err
-	}
+// ListSamplers returns the samplers available to the API, which are cached like the models.
+func (q *queueImpl) ListSamplers() ([]*stable_diffusion_api.Sampler, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	defaultSettings.Width = width
-	defaultSettings.Height = height
+	if time.Since(q.samplersFetchedAt) >= modelsCacheDuration && !q.refreshingSamplers {
+		q.refreshingSamplers = true
 
-	newDefaultSettings, err := q.defaultSettingsRepo.Upsert(context.Background(), defaultSettings)
-	if err != nil {
-		return nil, err
+		go q.refreshSamplers()
 	}
 
-	q.botDefaultSettings = newDefaultSettings
+	return q.samplers, nil
+}
 
-	log.Printf("Updated default dimensions to: %dx%d\n", width, height)
+func (q *queueImpl) refreshSamplers() {
+	ctx, cancel := apiCallContext()
+	defer cancel()
 
-	return newDefaultSettings, nil
-}
+	samplers, err := q.anyAPI().ListSamplers(ctx)
 
-func (q *queueImpl) UpdateDefaultBatch(batchCount, batchSize int) (*entities.DefaultSettings, error) {
-	defaultSettings, err := q.GetBotDefaultSettings()
-	if err != nil {
-		return nil, err
-	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	defaultSettings.BatchCount = batchCount
-	defaultSettings.BatchSize = batchSize
+	q.refreshingSamplers = false
 
-	newDefaultSettings, err := q.defaultSettingsRepo.Upsert(context.Background(), defaultSettings)
 	if err != nil {
-		return nil, err
+		log.Printf("Error listing samplers: %v", err)
+
+		return
 	}
 
-	q.botDefaultSettings = newDefaultSettings
+	q.samplers = samplers
+	q.samplersFetchedAt = time.Now()
+}
 
-	log.Printf("Updated default batch count/size to: %d/%d\n", batchCount, batchSize)
+// processCurrentImagine processes the item on the backend it was handed to, and frees the backend
+// up for the next item once it's done.
+func (q *queueImpl) processCurrentImagine(b *backend, imagine *QueueItem) {
+	go func() {
+		defer func() {
+			q.finishPersistedQueueItem(imagine)
 
-	return newDefaultSettings, nil
-}
+			q.mu.Lock()
+			defer q.mu.Unlock()
 
-type dimensionsResult struct {
-	SanitizedPrompt string
-	Width           int
-	Height          int
-}
+			b.currentImagine = nil
+		}()
 
-const (
-	emdash = '\u2014'
-	hyphen = '\u002D'
-)
+		imagine.markLeftQueue()
+		q.markQueueItemRunning(imagine)
 
-func fixEmDash(prompt string) string {
-	return strings.ReplaceAll(prompt, string(emdash), string(hyphen)+string(hyphen))
-}
+		if imagine.Type == ItemTypeUpscale {
+			q.processUpscaleImagine(b, imagine)
 
-var arRegex = regexp.MustCompile(`\s?--ar ([\d]*):([\d]*)\s?`)
+			return
+		}
+
+		var newGeneration *entities.ImageGeneration
+		var err error
+
+		if imagine.Type == ItemTypeReroll || imagine.Type == ItemTypeVariation {
+			newGeneration, err = q.getPreviousGeneration(imagine, imagine.InteractionIndex)
+			if err != nil {
+				log.Printf("Error getting prompt for reroll: %v", err)
 
-func extractDimensionsFromPrompt(prompt string, width, height int) (*dimensionsResult, error) {
-	// Sanitize em dashes. Some phones will autocorrect to em dashes
-	prompt = fixEmDash(prompt)
+				return
+			}
 
-	arMatches := arRegex.FindStringSubmatch(prompt)
+			// for variations, we need random subseeds
+			newGeneration.Subseed = -1
 
-	if len(arMatches) == 3 {
-		log.Printf("Aspect ratio overwrite: %#v", arMatches)
+			// for variations, the subseed strength determines how much variation we get
+			if imagine.Type == ItemTypeVariation {
+				newGeneration.SubseedStrength = 0.15
+			}
+		} else if imagine.Type == ItemTypeReimagine {
+			newGeneration, err = reimagineGeneration(imagine)
+			if err != nil {
+				log.Printf("Error getting settings to reimagine: %v", err)
 
-		prompt = arRegex.ReplaceAllString(prompt, "")
+				return
+			}
+		} else {
+			newGeneration, err = q.newGenerationFromPrompt(imagine)
+			if err != nil {
+				log.Printf("Error creating generation from prompt: %v", err)
 
-		firstDimension, err := strconv.Atoi(arMatches[1])
-		if err != nil {
-			return nil, err
+				q.reportPromptError(imagine, err)
+
+				return
+			}
 		}
 
-		secondDimension, err := strconv.Atoi(arMatches[2])
+		if imagine.Type == ItemTypeSweep {
+			err = q.processImagineSweep(b, newGeneration, imagine)
+			if err != nil {
+				log.Printf("Error processing imagine sweep: %v", err)
+			}
+
+			return
+		}
+
+		err = q.processImagineGrid(b, newGeneration, imagine)
 		if err != nil {
-			return nil, err
+			log.Printf("Error processing imagine grid: %v", err)
+
+			return
 		}
+	}()
+}
 
-		if firstDimension > secondDimension {
-			scaledWidth := float64(height) * (float64(firstDimension) / float64(secondDimension))
+// DefaultNegativePrompt is the negative prompt used until the settings choose a different one.
+const DefaultNegativePrompt = "ugly, tiling, poorly drawn hands, poorly drawn feet, poorly drawn face, out of frame, " +
+	"mutation, mutated, extra limbs, extra legs, extra arms, disfigured, deformed, cross-eye, " +
+	"body out of frame, blurry, bad art, bad anatomy, blurred, text, watermark, grainy"
+
+// validatePrompt checks the options in the prompt of a new imagine, so that mistakes can be
+// reported straight away rather than once the item reaches the front of the queue.
+func validatePrompt(item *QueueItem) error {
+	switch item.Type {
+	case ItemTypeImagine, ItemTypeImageToImage, ItemTypeInpaint, ItemTypeSweep:
+	default:
+		return nil
+	}
 
-			// Round up to the nearest 8
-			width = (int(scaledWidth) + 7) & (-8)
-		} else if secondDimension > firstDimension {
-			scaledHeight := float64(width) * (float64(secondDimension) / float64(firstDimension))
+	options, err := parsePromptOptions(item.Prompt, initializedWidth, initializedHeight)
+	if err != nil {
+		return err
+	}
 
-			// Round up to the nearest 8
-			height = (int(scaledHeight) + 7) & (-8)
+	if item.Type == ItemTypeSweep {
+		if options.HiresScale > 0 {
+			return &PromptOptionError{Option: "hires", Reason: "can't be used with a sweep"}
 		}
 
-		log.Printf("New dimensions: width: %v, height: %v", width, height)
+		return validateSweep(item.Sweep, options.Steps)
 	}
 
-	return &dimensionsResult{
-		SanitizedPrompt: prompt,
-		Width:           width,
-		Height:          height,
-	}, nil
+	if item.Type != ItemTypeImagine && options.HiresScale > 0 {
+		return &PromptOptionError{Option: "hires", Reason: "can't be used when starting from an image"}
+	}
+
+	return nil
 }
 
-func (q *queueImpl) processCurrentImagine() {
-	go func() {
-		defer func() {
-			q.mu.Lock()
-			defer q.mu.Unlock()
+// imagineNegativePrompt is the negative prompt from the settings, either replaced or added to by the
+// negative prompt given with the command.
+func imagineNegativePrompt(settings *entities.DefaultSettings, imagine *QueueItem) string {
+	if imagine.ReplaceNegativePrompt {
+		return imagine.NegativePrompt
+	}
 
-			q.currentImagine = nil
-		}()
+	negativePrompt := ""
+	if settings.NegativePrompt != nil {
+		negativePrompt = *settings.NegativePrompt
+	}
 
-		if q.currentImagine.Type == ItemTypeUpscale {
-			q.processUpscaleImagine(q.currentImagine)
+	return joinPrompts(negativePrompt, imagine.NegativePrompt)
+}
 
-			return
-		}
+// joinPrompts joins two comma separated prompts, either of which may be empty.
+func joinPrompts(prompt, addition string) string {
+	switch {
+	case addition == "":
+		return prompt
+	case prompt == "":
+		return addition
+	default:
+		return prompt + ", " + addition
+	}
+}
 
-		defaultWidth, err := q.defaultWidth()
-		if err != nil {
-			log.Printf("Error getting default width: %v", err)
+// newGenerationFromPrompt creates a generation from the defaults, overridden by any options in the prompt.
+func (q *queueImpl) newGenerationFromPrompt(imagine *QueueItem) (*entities.ImageGeneration, error) {
+	defaultSettings, err := q.requesterSettings(imagine)
+	if err != nil {
+		return nil, err
+	}
 
-			return
-		}
+	defaultWidth := defaultSettings.Width
+	defaultHeight := defaultSettings.Height
 
-		defaultHeight, err := q.defaultHeight()
-		if err != nil {
-			log.Printf("Error getting default height: %v", err)
+	promptRes, err := parsePromptOptions(imagine.Prompt, defaultWidth, defaultHeight)
+	if err != nil {
+		return nil, err
+	}
 
-			return
-		}
+	if imagine.Type != ItemTypeImagine && promptRes.HiresScale > 0 {
+		return nil, &PromptOptionError{Option: "hires", Reason: "can't be used when starting from an image"}
+	}
 
-		promptRes, err := extractDimensionsFromPrompt(q.currentImagine.Prompt, defaultWidth, defaultHeight)
-		if err != nil {
-			log.Printf("Error extracting dimensions from prompt: %v", err)
+	enableHR := false
+	hiresWidth := 0
+	hiresHeight := 0
 
-			return
-		}
+	if promptRes.Width > defaultWidth || promptRes.Height > defaultHeight {
+		enableHR = true
+		hiresWidth = promptRes.Width
+		hiresHeight = promptRes.Height
+	}
 
-		enableHR := false
-		hiresWidth := 0
-		hiresHeight := 0
+	if promptRes.HiresScale > 0 {
+		enableHR = true
+		hiresWidth = roundUpToEight(float64(promptRes.Width) * promptRes.HiresScale)
+		hiresHeight = roundUpToEight(float64(promptRes.Height) * promptRes.HiresScale)
+	}
 
-		if promptRes.Width > defaultWidth || promptRes.Height > defaultHeight {
-			enableHR = true
-			hiresWidth = promptRes.Width
-			hiresHeight = promptRes.Height
-		}
+	// new generation with defaults
+	newGeneration := &entities.ImageGeneration{
+		Prompt:            promptRes.SanitizedPrompt,
+		NegativePrompt:    imagineNegativePrompt(defaultSettings, imagine),
+		Width:             defaultWidth,
+		Height:            defaultHeight,
+		RestoreFaces:      defaultSettings.RestoreFaces != nil && *defaultSettings.RestoreFaces,
+		EnableHR:          enableHR,
+		HiresWidth:        hiresWidth,
+		HiresHeight:       hiresHeight,
+		HiresUpscaler:     promptRes.Upscaler,
+		DenoisingStrength: defaultSettings.DenoisingStrength,
+		Seed:              promptRes.Seed,
+		Subseed:           -1,
+		SubseedStrength:   float64(promptRes.Chaos) / maxChaos,
+		SamplerName:       defaultSettings.SamplerName,
+		CfgScale:          defaultSettings.CfgScale,
+		Steps:             defaultSettings.Steps,
+		Model:             defaultSettings.Model,
+		Processed:         false,
+	}
 
-		// new generation with defaults
-		newGeneration := &entities.ImageGeneration{
-			Prompt: promptRes.SanitizedPrompt,
-			NegativePrompt: "ugly, tiling, poorly drawn hands, poorly drawn feet, poorly drawn face, out of frame, " +
-				"mutation, mutated, extra limbs, extra legs, extra arms, disfigured, deformed, cross-eye, " +
-				"body out of frame, blurry, bad art, bad anatomy, blurred, text, watermark, grainy",
-			Width:             defaultWidth,
-			Height:            defaultHeight,
-			RestoreFaces:      true,
-			EnableHR:          enableHR,
-			HiresWidth:        hiresWidth,
-			HiresHeight:       hiresHeight,
-			DenoisingStrength: 0.7,
-			Seed:              -1,
-			Subseed:           -1,
-			SubseedStrength:   0,
-			SamplerName:       "Euler a",
-			CfgScale:          9,
-			Steps:             20,
-			Processed:         false,
-		}
+	if promptRes.Model != "" {
+		newGeneration.Model = promptRes.Model
+	} else if imagine.Model != "" {
+		newGeneration.Model = imagine.Model
+	}
 
-		if q.currentImagine.Type == ItemTypeReroll || q.currentImagine.Type == ItemTypeVariation {
-			foundGeneration, err := q.getPreviousGeneration(q.currentImagine, q.currentImagine.InteractionIndex)
-			if err != nil {
-				log.Printf("Error getting prompt for reroll: %v", err)
+	newGeneration.NegativePrompt = joinPrompts(newGeneration.NegativePrompt, promptRes.NegativePrompt)
 
-				return
-			}
+	if promptRes.SamplerName != "" {
+		newGeneration.SamplerName = promptRes.SamplerName
+	}
 
-			// if we are rerolling, or generating variations, we simply replace some defaults
-			newGeneration = foundGeneration
+	if promptRes.CfgScale > 0 {
+		newGeneration.CfgScale = promptRes.CfgScale
+	}
 
-			// for variations, we need random subseeds
-			newGeneration.Subseed = -1
+	if promptRes.Steps > 0 {
+		newGeneration.Steps = promptRes.Steps
+	}
 
-			// for variations, the subseed strength determines how much variation we get
-			if q.currentImagine.Type == ItemTypeVariation {
-				newGeneration.SubseedStrength = 0.15
-			}
+	if imagine.Type == ItemTypeImageToImage || imagine.Type == ItemTypeInpaint {
+		// img2img works at the requested size directly, so there is no need for hires fix
+		newGeneration.EnableHR = false
+		newGeneration.HiresWidth = 0
+		newGeneration.HiresHeight = 0
+		newGeneration.Width = promptRes.Width
+		newGeneration.Height = promptRes.Height
+		newGeneration.InitImageURL = imagine.InitImageURL
+		newGeneration.ResizeMode = imagine.ResizeMode
+		if imagine.DenoisingStrength != nil {
+			newGeneration.DenoisingStrength = *imagine.DenoisingStrength
 		}
+	}
 
-		err = q.processImagineGrid(newGeneration, q.currentImagine)
-		if err != nil {
-			log.Printf("Error processing imagine grid: %v", err)
+	if imagine.Type == ItemTypeInpaint {
+		newGeneration.MaskImageURL = imagine.MaskImageURL
+		newGeneration.MaskTile = imagine.MaskTile
+		newGeneration.GridMessageID = imagine.GridMessageID
+		newGeneration.MaskBlur = imagine.MaskBlur
+		newGeneration.InpaintingFill = imagine.InpaintingFill
+		newGeneration.InpaintFullRes = imagine.InpaintFullRes
+	}
 
-			return
-		}
-	}()
+	return newGeneration, nil
+}
+
+// reportPromptError lets the user know why their imagine couldn't be started.
+func (q *queueImpl) reportPromptError(imagine *QueueItem, err error) {
+	errorContent := "I'm sorry, but I had a problem imagining your image."
+
+	var promptErr *PromptOptionError
+	if errors.As(err, &promptErr) {
+		errorContent = fmt.Sprintf("I'm sorry, but I couldn't understand your prompt: %s", promptErr.Error())
+	}
+
+	_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+		Content: &errorContent,
+	})
+	if err != nil {
+		log.Printf("Error editing interaction: %v", err)
+	}
+}
+
+// apiErrorContent adds the reason to an error message, when the error came from the API, or was a
+// tile that the grid doesn't have.
+func apiErrorContent(content string, err error) string {
+	var apiErr *stable_diffusion_api.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%s\n`%s`", content, Truncate(apiErr.Error(), maxAPIErrorLength))
+	}
+
+	var tileErr *InpaintTileError
+	if errors.As(err, &tileErr) {
+		return fmt.Sprintf("%s\n%s", content, tileErr.Error())
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return content + "\nThe webui took too long to answer."
+	}
+
+	return content
+}
+
+// Truncate shortens text to fit Discord's length limits.
+func Truncate(text string, maxLength int) string {
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return text
+	}
+
+	return string(runes[:maxLength-1]) + "…"
 }
 
 func (q *queueImpl) getPreviousGeneration(imagine *QueueItem, sortOrder int) (*entities.ImageGeneration, error) {
@@ -489,54 +925,60 @@ func imagineMessageContent(generation *entities.ImageGeneration, user *discordgo
 	}
 }
 
-func (q *queueImpl) processImagineGrid(newGeneration *entities.ImageGeneration, imagine *QueueItem) error {
-	log.Printf("Processing imagine #%s: %v\n", imagine.DiscordInteraction.ID, newGeneration.Prompt)
+func (q *queueImpl) processImagineGrid(b *backend, newGeneration *entities.ImageGeneration, imagine *QueueItem) error {
+	log.Printf("Processing imagine #%s on %s: %v\n", imagine.DiscordInteraction.ID, b.host(), newGeneration.Prompt)
 
-	newContent := imagineMessageContent(newGeneration, imagine.DiscordInteraction.Member.User, 0)
+	newContent := imagineMessageContent(newGeneration, imagine.user(), 0)
 
 	message, err := q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
-		Content: &newContent,
+		Content:    &newContent,
+		Components: cancelButtonComponents(imagine),
 	})
 	if err != nil {
 		log.Printf("Error editing interaction: %v", err)
-	}
-
-	defaultBatchCount, err := q.defaultBatchCount()
-	if err != nil {
-		log.Printf("Error getting default batch count: %v", err)
 
+		// without the message, the generation can't be stored or shown
 		return err
 	}
 
-	defaultBatchSize, err := q.defaultBatchSize()
+	defaultSettings, err := q.requesterSettings(imagine)
 	if err != nil {
-		log.Printf("Error getting default batch size: %v", err)
+		log.Printf("Error getting default settings: %v", err)
 
 		return err
 	}
 
 	newGeneration.InteractionID = imagine.DiscordInteraction.ID
 	newGeneration.MessageID = message.ID
-	newGeneration.MemberID = imagine.DiscordInteraction.Member.User.ID
+	newGeneration.MemberID = imagine.user().ID
 	newGeneration.SortOrder = 0
-	newGeneration.BatchCount = defaultBatchCount
-	newGeneration.BatchSize = defaultBatchSize
+	newGeneration.BatchCount = defaultSettings.BatchCount
+	newGeneration.BatchSize = defaultSettings.BatchSize
 	newGeneration.Processed = true
+	newGeneration.Backend = b.host()
 
-	_, err = q.imageGenerationRepo.Create(context.Background(), newGeneration)
-	if err != nil {
-		log.Printf("Error creating image generation record: %v\n", err)
+	if q.itemCancelled(imagine) {
+		q.reportCancelled(imagine, message.ID)
+
+		return nil
 	}
 
+	showPreviews := defaultSettings.ShowPreviews != nil && *defaultSettings.ShowPreviews
+
 	generationDone := make(chan bool)
+	progressStopped := make(chan bool)
 
 	go func() {
+		defer close(progressStopped)
+
+		var lastPreview time.Time
+
 		for {
 			select {
 			case <-generationDone:
 				return
 			case <-time.After(1 * time.Second):
-				progress, progressErr := q.stableDiffusionAPI.GetCurrentProgress()
+				progress, progressErr := q.currentProgress(b)
 				if progressErr != nil {
 					log.Printf("Error getting current progress: %v", progressErr)
 
@@ -547,11 +989,32 @@ func (q *queueImpl) processImagineGrid(newGeneration *entities.ImageGeneration,
 					continue
 				}
 
-				progressContent := imagineMessageContent(newGeneration, imagine.DiscordInteraction.Member.User, progress.Progress)
+				progressContent := imagineMessageContent(newGeneration, imagine.user(), progress.Progress)
 
-				_, progressErr = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+				progressEdit := &discordgo.WebhookEdit{
 					Content: &progressContent,
-				})
+				}
+
+				if showPreviews && progress.CurrentImage != "" && time.Since(lastPreview) >= previewInterval {
+					preview, previewErr := previewImage(progress.CurrentImage)
+					if previewErr != nil {
+						log.Printf("Error creating preview: %v", previewErr)
+					} else {
+						// the new preview replaces the last one, rather than being added alongside it
+						progressEdit.Files = []*discordgo.File{
+							{
+								ContentType: "image/jpeg",
+								Name:        "preview.jpg",
+								Reader:      preview,
+							},
+						}
+						progressEdit.Attachments = &[]*discordgo.MessageAttachment{}
+
+						lastPreview = time.Now()
+					}
+				}
+
+				_, progressErr = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, progressEdit)
 				if progressErr != nil {
 					log.Printf("Error editing interaction: %v", err)
 				}
@@ -559,43 +1022,48 @@ func (q *queueImpl) processImagineGrid(newGeneration *entities.ImageGeneration,
 		}
 	}()
 
-	resp, err := q.stableDiffusionAPI.TextToImage(&stable_diffusion_api.TextToImageRequest{
-		Prompt:            newGeneration.Prompt,
-		NegativePrompt:    newGeneration.NegativePrompt,
-		Width:             newGeneration.Width,
-		Height:            newGeneration.Height,
-		RestoreFaces:      newGeneration.RestoreFaces,
-		EnableHR:          newGeneration.EnableHR,
-		HRResizeX:         newGeneration.HiresWidth,
-		HRResizeY:         newGeneration.HiresHeight,
-		DenoisingStrength: newGeneration.DenoisingStrength,
-		BatchSize:         newGeneration.BatchSize,
-		Seed:              newGeneration.Seed,
-		Subseed:           newGeneration.Subseed,
-		SubseedStrength:   newGeneration.SubseedStrength,
-		SamplerName:       newGeneration.SamplerName,
-		CfgScale:          newGeneration.CfgScale,
-		Steps:             newGeneration.Steps,
-		NIter:             newGeneration.BatchCount,
-	})
+	resp, err := q.generateImages(b, newGeneration)
+
+	close(generationDone)
+
+	// wait for any progress edit that is under way, so that its preview can't replace the grid
+	<-progressStopped
+
+	// an interrupted generation still returns the images so far, which aren't wanted
+	if q.itemCancelled(imagine) {
+		q.reportCancelled(imagine, message.ID)
+
+		return nil
+	}
+
 	if err != nil {
-		log.Printf("Error processing image: %v\n", err)
+		log.Printf("Error processing image on %s: %v\n", b.host(), err)
 
-		errorContent := "I'm sorry, but I had a problem imagining your image."
+		q.recheckBackend(b)
+
+		errorContent := apiErrorContent("I'm sorry, but I had a problem imagining your image.", err)
 
 		_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
-			Content: &errorContent,
+			Content:     &errorContent,
+			Components:  &[]discordgo.MessageComponent{},
+			Attachments: &[]*discordgo.MessageAttachment{},
 		})
 
 		return err
 	}
 
-	generationDone <- true
+	// record which checkpoint was actually used, so that re-rolls use it too
+	if newGeneration.Model == "" {
+		newGeneration.Model = resp.ModelName
+	}
 
-	finishedContent := imagineMessageContent(newGeneration, imagine.DiscordInteraction.Member.User, 1)
+	newGeneration.ModelHash = resp.ModelHash
+
+	finishedContent := imagineMessageContent(newGeneration, imagine.user(), 1)
 
 	log.Printf("Seeds: %v Subseeds:%v", resp.Seeds, resp.Subseeds)
 
+	decodedImages := make([][]byte, len(resp.Images))
 	imageBufs := make([]*bytes.Buffer, len(resp.Images))
 
 	for idx, image := range resp.Images {
@@ -604,9 +1072,38 @@ func (q *queueImpl) processImagineGrid(newGeneration *entities.ImageGeneration,
 			log.Printf("Error decoding image: %v\n", decodeErr)
 		}
 
-		imageBuf := bytes.NewBuffer(decodedImage)
+		decodedImages[idx] = decodedImage
+		imageBufs[idx] = bytes.NewBuffer(decodedImage)
+	}
+
+	tiledImage, err := q.compositeRenderer.TileImages(imageBufs, gridTileOptions(defaultSettings, newGeneration, resp.Seeds))
+	if err != nil {
+		log.Printf("Error tiling images: %v\n", err)
+
+		return err
+	}
+
+	// the grid's parameters are the first image's, like the webui's grids
+	gridGeneration := *newGeneration
 
-		imageBufs[idx] = imageBuf
+	if len(resp.Seeds) > 0 && len(resp.Subseeds) > 0 {
+		gridGeneration.Seed = resp.Seeds[0]
+		gridGeneration.Subseed = resp.Subseeds[0]
+	}
+
+	compositeImage := bytes.NewBuffer(q.embedParameters(tiledImage.Bytes(), &gridGeneration))
+
+	var storedImagePaths []string
+
+	// the grid is stored with the generation it was made for, and each image with its own generation
+	newGeneration.ImagePath = q.storeImage(compositeImage.Bytes())
+	if newGeneration.ImagePath != "" {
+		storedImagePaths = append(storedImagePaths, newGeneration.ImagePath)
+	}
+
+	_, err = q.imageGenerationRepo.Create(context.Background(), newGeneration)
+	if err != nil {
+		log.Printf("Error creating image generation record: %v\n", err)
 	}
 
 	for idx := range resp.Seeds {
@@ -632,158 +1129,55 @@ func (q *queueImpl) processImagineGrid(newGeneration *entities.ImageGeneration,
 			SamplerName:       newGeneration.SamplerName,
 			CfgScale:          newGeneration.CfgScale,
 			Steps:             newGeneration.Steps,
+			InitImageURL:      newGeneration.InitImageURL,
+			ResizeMode:        newGeneration.ResizeMode,
+			MaskImageURL:      newGeneration.MaskImageURL,
+			InitImagePath:     newGeneration.InitImagePath,
+			MaskImagePath:     newGeneration.MaskImagePath,
+			MaskTile:          newGeneration.MaskTile,
+			GridMessageID:     newGeneration.GridMessageID,
+			MaskBlur:          newGeneration.MaskBlur,
+			InpaintingFill:    newGeneration.InpaintingFill,
+			InpaintFullRes:    newGeneration.InpaintFullRes,
+			HiresUpscaler:     newGeneration.HiresUpscaler,
+			Model:             newGeneration.Model,
+			ModelHash:         newGeneration.ModelHash,
+			Backend:           newGeneration.Backend,
 			Processed:         true,
 		}
 
+		if idx < len(decodedImages) && len(decodedImages[idx]) > 0 {
+			// the tiles are attached with their parameters, like the stored images
+			decodedImages[idx] = q.embedParameters(decodedImages[idx], subGeneration)
+
+			subGeneration.ImagePath = q.storeImage(decodedImages[idx])
+
+			if subGeneration.ImagePath != "" {
+				storedImagePaths = append(storedImagePaths, subGeneration.ImagePath)
+			}
+		}
+
 		_, createErr := q.imageGenerationRepo.Create(context.Background(), subGeneration)
 		if createErr != nil {
 			log.Printf("Error creating image generation record: %v\n", createErr)
 		}
 	}
 
-	compositeImage, err := q.compositeRenderer.TileImages(imageBufs)
-	if err != nil {
-		log.Printf("Error tiling images: %v\n", err)
+	// the item may have been cancelled while the generations were being stored
+	if q.itemCancelled(imagine) {
+		// the generations are thrown away first, so that only images nothing else uses are deleted
+		q.reportCancelled(imagine, message.ID)
+		q.deleteStoredImages(storedImagePaths)
 
-		return err
+		return nil
 	}
 
 	_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
 		Content: &finishedContent,
-		Files: []*discordgo.File{
-			{
-				ContentType: "image/png",
-				Name:        "imagine.png",
-				Reader:      compositeImage,
-			},
-		},
-		Components: &[]discordgo.MessageComponent{
-			discordgo.ActionsRow{
-				Components: []discordgo.MessageComponent{
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "Re-roll",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.PrimaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_reroll",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "🎲",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "V1",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_variation_1",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "V2",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_variation_2",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "V3",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_variation_3",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "V4",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_variation_4",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "♻️",
-						},
-					},
-				},
-			},
-			discordgo.ActionsRow{
-				Components: []discordgo.MessageComponent{
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "U1",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_upscale_1",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "U2",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_upscale_2",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "U3",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_upscale_3",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-					discordgo.Button{
-						// Label is what the user will see on the button.
-						Label: "U4",
-						// Style provides coloring of the button. There are not so many styles tho.
-						Style: discordgo.SecondaryButton,
-						// Disabled allows bot to disable some buttons for users.
-						Disabled: false,
-						// CustomID is a thing telling Discord which data to send when this button will be pressed.
-						CustomID: "imagine_upscale_4",
-						Emoji: discordgo.ComponentEmoji{
-							Name: "⬆️",
-						},
-					},
-				},
-			},
-		},
+		Files:   q.gridFiles(defaultSettings, newGeneration, compositeImage.Bytes(), decodedImages, resp.Seeds),
+		// drops the last preview, leaving just the finished grid
+		Attachments: &[]*discordgo.MessageAttachment{},
+		Components:  gridComponents(len(resp.Seeds)),
 	})
 	if err != nil {
 		log.Printf("Error editing interaction: %v\n", err)
@@ -794,6 +1188,154 @@ func (q *queueImpl) processImagineGrid(newGeneration *entities.ImageGeneration,
 	return nil
 }
 
+// gridTileOptions are the extras drawn onto a grid, depending on its style. Numbered grids only have
+// their tiles numbered. Captioned grids also have gutters, and a caption with the settings the images
+// were generated with, and each tile's seed. Inpainting a tile finds it by the size of the images, so
+// it works with every style.
+func gridTileOptions(settings *entities.DefaultSettings, generation *entities.ImageGeneration, seeds []int) composite_renderer.TileOptions {
+	options := composite_renderer.TileOptions{}
+
+	if settings.GridStyle == nil || *settings.GridStyle == entities.GridStylePlain {
+		return options
+	}
+
+	options.Badges = true
+
+	if *settings.GridStyle != entities.GridStyleCaptioned {
+		return options
+	}
+
+	options.Gutter = gridGutter
+
+	var details []string
+
+	if generation.Model != "" {
+		details = append(details, "Model: "+generation.Model)
+	}
+
+	details = append(details,
+		"Sampler: "+generation.SamplerName,
+		fmt.Sprintf("Steps: %d", generation.Steps),
+		fmt.Sprintf("CFG scale: %s", strconv.FormatFloat(generation.CfgScale, 'f', -1, 64)),
+	)
+
+	tileSeeds := make([]string, len(seeds))
+
+	for idx, seed := range seeds {
+		tileSeeds[idx] = fmt.Sprintf("%d: %d", idx+1, seed)
+	}
+
+	options.Caption = []string{
+		strings.Join(details, ", "),
+		"Seeds " + strings.Join(tileSeeds, ", "),
+	}
+
+	return options
+}
+
+// gridFiles are the attachments for a finished grid: the grid, its images, or both, depending on the
+// settings. The images are named after the prompt and their seed.
+func (q *queueImpl) gridFiles(settings *entities.DefaultSettings, generation *entities.ImageGeneration,
+	grid []byte, images [][]byte, seeds []int,
+) []*discordgo.File {
+	attachmentMode := entities.AttachmentModeGrid
+	if settings.AttachmentMode != nil {
+		attachmentMode = *settings.AttachmentMode
+	}
+
+	files := make([]*discordgo.File, 0, len(images)+1)
+
+	if attachmentMode != entities.AttachmentModeTiles {
+		files = append(files, q.uploadFile("imagine", grid))
+	}
+
+	if attachmentMode == entities.AttachmentModeGrid {
+		return files
+	}
+
+	slug := promptSlug(generation.Prompt)
+
+	for idx, image := range images {
+		if len(files) >= maxAttachments {
+			break
+		}
+
+		if len(image) == 0 || idx >= len(seeds) {
+			continue
+		}
+
+		files = append(files, q.uploadFile(fmt.Sprintf("%s-%d", slug, seeds[idx]), image))
+	}
+
+	// without any images, the grid is attached instead
+	if len(files) == 0 {
+		files = append(files, q.uploadFile("imagine", grid))
+	}
+
+	return files
+}
+
+// gridComponents are the buttons under a finished grid: a re-roll button, followed by a variation
+// button and an upscale button for each image, as many to a row as Discord allows.
+func gridComponents(imageCount int) *[]discordgo.MessageComponent {
+	if imageCount > maxGridButtons {
+		imageCount = maxGridButtons
+	}
+
+	variationButtons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "Re-roll",
+			Style:    discordgo.PrimaryButton,
+			CustomID: "imagine_reroll",
+			Emoji: &discordgo.ComponentEmoji{
+				Name: "🎲",
+			},
+		},
+	}
+
+	upscaleButtons := make([]discordgo.MessageComponent, 0, imageCount)
+
+	for idx := 1; idx <= imageCount; idx++ {
+		variationButtons = append(variationButtons, discordgo.Button{
+			Label:    fmt.Sprintf("V%d", idx),
+			Style:    discordgo.SecondaryButton,
+			CustomID: fmt.Sprintf("imagine_variation_%d", idx),
+			Emoji: &discordgo.ComponentEmoji{
+				Name: "♻️",
+			},
+		})
+
+		upscaleButtons = append(upscaleButtons, discordgo.Button{
+			Label:    fmt.Sprintf("U%d", idx),
+			Style:    discordgo.SecondaryButton,
+			CustomID: fmt.Sprintf("imagine_upscale_%d", idx),
+			Emoji: &discordgo.ComponentEmoji{
+				Name: "⬆️",
+			},
+		})
+	}
+
+	components := append(buttonRows(variationButtons), buttonRows(upscaleButtons)...)
+
+	return &components
+}
+
+// buttonRows splits the buttons into rows.
+func buttonRows(buttons []discordgo.MessageComponent) []discordgo.MessageComponent {
+	rows := make([]discordgo.MessageComponent, 0, (len(buttons)+maxButtonsPerRow-1)/maxButtonsPerRow)
+
+	for start := 0; start < len(buttons); start += maxButtonsPerRow {
+		end := start + maxButtonsPerRow
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+
+		rows = append(rows, discordgo.ActionsRow{Components: buttons[start:end]})
+	}
+
+	return rows
+}
+
 func upscaleMessageContent(user *discordgo.User, fetchProgress, upscaleProgress float64) string {
 	if fetchProgress >= 0 && fetchProgress <= 1 && upscaleProgress < 1 {
 		if upscaleProgress == 0 {
@@ -808,7 +1350,7 @@ func upscaleMessageContent(user *discordgo.User, fetchProgress, upscaleProgress
 	}
 }
 
-func (q *queueImpl) processUpscaleImagine(imagine *QueueItem) {
+func (q *queueImpl) processUpscaleImagine(b *backend, imagine *QueueItem) {
 	interactionID := imagine.DiscordInteraction.ID
 	messageID := ""
 
@@ -828,10 +1370,11 @@ func (q *queueImpl) processUpscaleImagine(imagine *QueueItem) {
 
 	log.Printf("Found generation: %v", generation)
 
-	newContent := upscaleMessageContent(imagine.DiscordInteraction.Member.User, 0, 0)
+	newContent := upscaleMessageContent(imagine.user(), 0, 0)
 
 	_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
-		Content: &newContent,
+		Content:    &newContent,
+		Components: cancelButtonComponents(imagine),
 	})
 	if err != nil {
 		log.Printf("Error editing interaction: %v", err)
@@ -849,7 +1392,7 @@ func (q *queueImpl) processUpscaleImagine(imagine *QueueItem) {
 			case <-generationDone:
 				return
 			case <-time.After(1 * time.Second):
-				progress, progressErr := q.stableDiffusionAPI.GetCurrentProgress()
+				progress, progressErr := q.currentProgress(b)
 				if progressErr != nil {
 					log.Printf("Error getting current progress: %v", progressErr)
 
@@ -869,7 +1412,7 @@ func (q *queueImpl) processUpscaleImagine(imagine *QueueItem) {
 
 				lastProgress = progress.Progress
 
-				progressContent := upscaleMessageContent(imagine.DiscordInteraction.Member.User, fetchProgress, upscaleProgress)
+				progressContent := upscaleMessageContent(imagine.user(), fetchProgress, upscaleProgress)
 
 				_, progressErr = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
 					Content: &progressContent,
@@ -881,44 +1424,42 @@ func (q *queueImpl) processUpscaleImagine(imagine *QueueItem) {
 		}
 	}()
 
-	resp, err := q.stableDiffusionAPI.UpscaleImage(&stable_diffusion_api.UpscaleRequest{
-		ResizeMode:      0,
-		UpscalingResize: 2,
-		Upscaler1:       "ESRGAN_4x",
-		TextToImageRequest: &stable_diffusion_api.TextToImageRequest{
-			Prompt:            generation.Prompt,
-			NegativePrompt:    generation.NegativePrompt,
-			Width:             generation.Width,
-			Height:            generation.Height,
-			RestoreFaces:      generation.RestoreFaces,
-			EnableHR:          generation.EnableHR,
-			HRResizeX:         generation.HiresWidth,
-			HRResizeY:         generation.HiresHeight,
-			DenoisingStrength: generation.DenoisingStrength,
-			BatchSize:         1,
-			Seed:              generation.Seed,
-			Subseed:           generation.Subseed,
-			SubseedStrength:   generation.SubseedStrength,
-			SamplerName:       generation.SamplerName,
-			CfgScale:          generation.CfgScale,
-			Steps:             generation.Steps,
-			NIter:             1,
-		},
-	})
+	var resp *stable_diffusion_api.UpscaleResponse
+
+	upscaleReq, err := q.upscaleRequest(generation)
+
+	// the model is only needed when the image has to be regenerated
+	if err == nil && upscaleReq.Image == "" {
+		err = q.loadModel(b, generation.Model)
+	}
+
+	if err == nil && !q.itemCancelled(imagine) {
+		resp, err = b.api.UpscaleImage(context.Background(), upscaleReq)
+	}
+
+	close(generationDone)
+
+	if q.itemCancelled(imagine) {
+		q.reportCancelled(imagine, "")
+
+		return
+	}
+
 	if err != nil {
-		log.Printf("Error processing image upscale: %v\n", err)
+		log.Printf("Error processing image upscale on %s: %v\n", b.host(), err)
+
+		q.recheckBackend(b)
 
-		errorContent := "I'm sorry, but I had a problem upscaling your image."
+		errorContent := apiErrorContent("I'm sorry, but I had a problem upscaling your image.", err)
 
 		_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
-			Content: &errorContent,
+			Content:    &errorContent,
+			Components: &[]discordgo.MessageComponent{},
 		})
 
 		return
 	}
 
-	generationDone <- true
-
 	decodedImage, decodeErr := base64.StdEncoding.DecodeString(resp.Image)
 	if decodeErr != nil {
 		log.Printf("Error decoding image: %v\n", decodeErr)
@@ -926,23 +1467,28 @@ func (q *queueImpl) processUpscaleImagine(imagine *QueueItem) {
 		return
 	}
 
-	imageBuf := bytes.NewBuffer(decodedImage)
+	decodedImage = q.embedParameters(decodedImage, generation)
+
+	upscaledImagePath := q.storeImage(decodedImage)
+	if upscaledImagePath != "" {
+		err = q.imageGenerationRepo.SetUpscaledImagePath(context.Background(), generation.ID, upscaledImagePath)
+		if err != nil {
+			log.Printf("Error recording upscaled image: %v\n", err)
+		}
+	}
 
 	log.Printf("Successfully upscaled image: %v, Message: %v, Upscale Index: %d",
 		interactionID, messageID, imagine.InteractionIndex)
 
 	finishedContent := fmt.Sprintf("<@%s> asked me to upscale their image. Here's the result:",
-		imagine.DiscordInteraction.Member.User.ID)
+		imagine.user().ID)
 
 	_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
 		Content: &finishedContent,
 		Files: []*discordgo.File{
-			{
-				ContentType: "image/png",
-				Name:        "imagine.png",
-				Reader:      imageBuf,
-			},
+			q.uploadFile("imagine", decodedImage),
 		},
+		Components: &[]discordgo.MessageComponent{},
 	})
 	if err != nil {
 		log.Printf("Error editing interaction: %v\n", err)
@@ -0,0 +1,593 @@
+package imagine_queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/repositories"
+)
+
+// SettingsScope is the layer of default settings being viewed or changed. Settings are resolved from
+// the most specific layer that has a value: user, then channel, then guild, then the bot's own defaults.
+type SettingsScope int
+
+const (
+	SettingsScopeUser SettingsScope = iota
+	SettingsScopeChannel
+	SettingsScopeGuild
+)
+
+// SettingsTarget identifies a layer of default settings, and where it sits in the resolution order.
+type SettingsTarget struct {
+	Scope     SettingsScope
+	MemberID  string
+	ChannelID string
+	GuildID   string
+}
+
+const (
+	channelSettingsPrefix = "channel_"
+	guildSettingsPrefix   = "guild_"
+)
+
+// settingsKey is the key of the settings row for the target's scope, or empty if the target doesn't
+// have the member, channel or server for its scope.
+func (t *SettingsTarget) settingsKey() string {
+	switch t.Scope {
+	case SettingsScopeChannel:
+		if t.ChannelID == "" {
+			return ""
+		}
+
+		return channelSettingsPrefix + t.ChannelID
+	case SettingsScopeGuild:
+		if t.GuildID == "" {
+			return ""
+		}
+
+		return guildSettingsPrefix + t.GuildID
+	default:
+		return t.MemberID
+	}
+}
+
+// settingsKeys lists the keys of every layer that applies to the target, from least to most specific,
+// not including the bot's own defaults.
+func (t *SettingsTarget) settingsKeys() []string {
+	keys := make([]string, 0, 3)
+
+	if t.GuildID != "" {
+		keys = append(keys, guildSettingsPrefix+t.GuildID)
+	}
+
+	if t.Scope == SettingsScopeGuild {
+		return keys
+	}
+
+	if t.ChannelID != "" {
+		keys = append(keys, channelSettingsPrefix+t.ChannelID)
+	}
+
+	if t.Scope == SettingsScopeChannel {
+		return keys
+	}
+
+	if t.MemberID != "" {
+		keys = append(keys, t.MemberID)
+	}
+
+	return keys
+}
+
+func (q *queueImpl) fillInBotDefaults(settings *entities.DefaultSettings) (*entities.DefaultSettings, bool) {
+	updated := false
+
+	if settings == nil {
+		settings = &entities.DefaultSettings{
+			MemberID: botID,
+		}
+	}
+
+	if settings.Width == 0 {
+		settings.Width = initializedWidth
+		updated = true
+	}
+
+	if settings.Height == 0 {
+		settings.Height = initializedHeight
+		updated = true
+	}
+
+	if settings.BatchCount == 0 {
+		settings.BatchCount = initializedBatchCount
+		updated = true
+	}
+
+	if settings.BatchSize == 0 {
+		settings.BatchSize = initializedBatchSize
+		updated = true
+	}
+
+	if settings.SamplerName == "" {
+		settings.SamplerName = initializedSamplerName
+		updated = true
+	}
+
+	if settings.Steps == 0 {
+		settings.Steps = initializedSteps
+		updated = true
+	}
+
+	if settings.CfgScale == 0 {
+		settings.CfgScale = initializedCfgScale
+		updated = true
+	}
+
+	if settings.RestoreFaces == nil {
+		restoreFaces := initializedRestoreFaces
+		settings.RestoreFaces = &restoreFaces
+		updated = true
+	}
+
+	if settings.DenoisingStrength == 0 {
+		settings.DenoisingStrength = initializedDenoisingStrength
+		updated = true
+	}
+
+	if settings.NegativePrompt == nil {
+		negativePrompt := initializedNegativePrompt
+		settings.NegativePrompt = &negativePrompt
+		updated = true
+	}
+
+	if settings.ShowPreviews == nil {
+		showPreviews := initializedShowPreviews
+		settings.ShowPreviews = &showPreviews
+		updated = true
+	}
+
+	if settings.GridStyle == nil {
+		gridStyle := initializedGridStyle
+		settings.GridStyle = &gridStyle
+		updated = true
+	}
+
+	if settings.AttachmentMode == nil {
+		attachmentMode := initializedAttachmentMode
+		settings.AttachmentMode = &attachmentMode
+		updated = true
+	}
+
+	return settings, updated
+}
+
+func (q *queueImpl) initializeOrGetBotDefaults() (*entities.DefaultSettings, error) {
+	botDefaultSettings, err := q.getBotDefaultSettings()
+	if err != nil && !errors.Is(err, &repositories.NotFoundError{}) {
+		return nil, err
+	}
+
+	botDefaultSettings, updated := q.fillInBotDefaults(botDefaultSettings)
+	if updated {
+		botDefaultSettings, err = q.defaultSettingsRepo.Upsert(context.Background(), botDefaultSettings)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("Initialized bot default settings: %+v\n", botDefaultSettings)
+	} else {
+		log.Printf("Retrieved bot default settings: %+v\n", botDefaultSettings)
+	}
+
+	return botDefaultSettings, nil
+}
+
+// getBotDefaultSettings returns the bot's own settings, which are read from the database once and
+// then kept, as they're used to resolve everyone's settings.
+func (q *queueImpl) getBotDefaultSettings() (*entities.DefaultSettings, error) {
+	q.botDefaultsMu.RLock()
+	botDefaultSettings := q.botDefaultSettings
+	q.botDefaultsMu.RUnlock()
+
+	if botDefaultSettings != nil {
+		return botDefaultSettings, nil
+	}
+
+	defaultSettings, err := q.defaultSettingsRepo.GetByMemberID(context.Background(), botID)
+	if err != nil {
+		return nil, err
+	}
+
+	q.botDefaultsMu.Lock()
+	q.botDefaultSettings = defaultSettings
+	q.botDefaultsMu.Unlock()
+
+	return defaultSettings, nil
+}
+
+// getSettingsLayer returns the settings stored for a single layer, or empty settings when that layer
+// has never been changed.
+func (q *queueImpl) getSettingsLayer(key string) (*entities.DefaultSettings, error) {
+	settings, err := q.defaultSettingsRepo.GetByMemberID(context.Background(), key)
+	if err != nil {
+		if errors.Is(err, &repositories.NotFoundError{}) {
+			return &entities.DefaultSettings{MemberID: key}, nil
+		}
+
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// mergeSettings overrides the base settings with every value that is set in the layer.
+func mergeSettings(base, layer *entities.DefaultSettings) {
+	if layer.Width != 0 && layer.Height != 0 {
+		base.Width = layer.Width
+		base.Height = layer.Height
+	}
+
+	if layer.BatchCount != 0 && layer.BatchSize != 0 {
+		base.BatchCount = layer.BatchCount
+		base.BatchSize = layer.BatchSize
+	}
+
+	if layer.Model != "" {
+		base.Model = layer.Model
+	}
+
+	if layer.SamplerName != "" {
+		base.SamplerName = layer.SamplerName
+	}
+
+	if layer.Steps != 0 {
+		base.Steps = layer.Steps
+	}
+
+	if layer.CfgScale != 0 {
+		base.CfgScale = layer.CfgScale
+	}
+
+	if layer.RestoreFaces != nil {
+		base.RestoreFaces = layer.RestoreFaces
+	}
+
+	if layer.DenoisingStrength != 0 {
+		base.DenoisingStrength = layer.DenoisingStrength
+	}
+
+	if layer.NegativePrompt != nil {
+		base.NegativePrompt = layer.NegativePrompt
+	}
+
+	if layer.ShowPreviews != nil {
+		base.ShowPreviews = layer.ShowPreviews
+	}
+
+	if layer.GridStyle != nil {
+		base.GridStyle = layer.GridStyle
+	}
+
+	if layer.AttachmentMode != nil {
+		base.AttachmentMode = layer.AttachmentMode
+	}
+}
+
+// GetDefaultSettings resolves the settings that apply to the target, starting from the bot's defaults
+// and applying each more specific layer in turn.
+func (q *queueImpl) GetDefaultSettings(target *SettingsTarget) (*entities.DefaultSettings, error) {
+	botDefaultSettings, err := q.getBotDefaultSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *botDefaultSettings
+
+	for _, key := range target.settingsKeys() {
+		layer, layerErr := q.getSettingsLayer(key)
+		if layerErr != nil {
+			return nil, layerErr
+		}
+
+		mergeSettings(&resolved, layer)
+	}
+
+	resolved.MemberID = target.settingsKey()
+
+	return &resolved, nil
+}
+
+// requesterSettings resolves the settings for the member that queued the item, in the channel they queued it in.
+func (q *queueImpl) requesterSettings(imagine *QueueItem) (*entities.DefaultSettings, error) {
+	interaction := imagine.DiscordInteraction
+
+	target := &SettingsTarget{
+		Scope:     SettingsScopeUser,
+		MemberID:  imagine.memberID(),
+		ChannelID: interaction.ChannelID,
+		GuildID:   interaction.GuildID,
+	}
+
+	return q.GetDefaultSettings(target)
+}
+
+// updateSettingsLayer applies the change to the target's own layer, saves it, and returns the newly
+// resolved settings for the target. Updates are made one at a time, so that two changes to the same
+// layer can't overwrite each other.
+func (q *queueImpl) updateSettingsLayer(target *SettingsTarget,
+	change func(layer *entities.DefaultSettings),
+) (*entities.DefaultSettings, error) {
+	if target.settingsKey() == "" {
+		return nil, errors.New("missing member, channel or server to save the settings for")
+	}
+
+	q.settingsMu.Lock()
+	defer q.settingsMu.Unlock()
+
+	layer, err := q.getSettingsLayer(target.settingsKey())
+	if err != nil {
+		return nil, err
+	}
+
+	change(layer)
+
+	_, err = q.defaultSettingsRepo.Upsert(context.Background(), layer)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.GetDefaultSettings(target)
+}
+
+func (q *queueImpl) UpdateDefaultDimensions(target *SettingsTarget, width, height int) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.Width = width
+		layer.Height = height
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default dimensions for %s to: %dx%d\n", target.settingsKey(), width, height)
+
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultBatch(target *SettingsTarget, batchCount, batchSize int) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.BatchCount = batchCount
+		layer.BatchSize = batchSize
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default batch count/size for %s to: %d/%d\n", target.settingsKey(), batchCount, batchSize)
+
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultModel(target *SettingsTarget, model string) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.Model = model
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default model for %s to: %q\n", target.settingsKey(), model)
+
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultSampler(target *SettingsTarget, samplerName string) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.SamplerName = samplerName
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default sampler for %s to: %q\n", target.settingsKey(), samplerName)
+
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultSteps(target *SettingsTarget, steps int) (*entities.DefaultSettings, error) {
+	err := validateSteps(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.Steps = steps
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default steps for %s to: %d\n", target.settingsKey(), steps)
+
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultCfgScale(target *SettingsTarget, cfgScale float64) (*entities.DefaultSettings, error) {
+	err := validateCfgScale(cfgScale)
+	if err != nil {
+		return nil, err
+	}
+
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.CfgScale = cfgScale
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default CFG scale for %s to: %v\n", target.settingsKey(), cfgScale)
+
+	return newDefaultSettings, nil
+}
+
+// UpdateDefaultAdvanced sets the steps, CFG scale and denoising strength together, so that none of
+// them are saved unless they're all valid.
+func (q *queueImpl) UpdateDefaultAdvanced(target *SettingsTarget, steps int, cfgScale, denoisingStrength float64) (*entities.DefaultSettings, error) {
+	err := validateSteps(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateCfgScale(cfgScale)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateDenoisingStrength(denoisingStrength)
+	if err != nil {
+		return nil, err
+	}
+
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.Steps = steps
+		layer.CfgScale = cfgScale
+		layer.DenoisingStrength = denoisingStrength
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default steps/CFG scale/denoising strength for %s to: %d/%v/%v\n",
+		target.settingsKey(), steps, cfgScale, denoisingStrength)
+
+	return newDefaultSettings, nil
+}
+
+func validateSteps(steps int) error {
+	if steps < 1 || steps > maxSteps {
+		return fmt.Errorf("steps must be from 1 to %d", maxSteps)
+	}
+
+	return nil
+}
+
+func validateCfgScale(cfgScale float64) error {
+	if cfgScale < minCfgScale || cfgScale > maxCfgScale {
+		return fmt.Errorf("CFG scale must be from %d to %d", minCfgScale, maxCfgScale)
+	}
+
+	return nil
+}
+
+func validateDenoisingStrength(denoisingStrength float64) error {
+	if denoisingStrength <= 0 || denoisingStrength > 1 {
+		return errors.New("denoising strength must be more than 0, and at most 1")
+	}
+
+	return nil
+}
+
+func (q *queueImpl) UpdateDefaultRestoreFaces(target *SettingsTarget, restoreFaces bool) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.RestoreFaces = &restoreFaces
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default restore faces for %s to: %v\n", target.settingsKey(), restoreFaces)
+
+	return newDefaultSettings, nil
+}
+
+// UpdateDefaultShowPreviews sets whether previews are shown while images are being generated.
+func (q *queueImpl) UpdateDefaultShowPreviews(target *SettingsTarget, showPreviews bool) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.ShowPreviews = &showPreviews
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default show previews for %s to: %v\n", target.settingsKey(), showPreviews)
+
+	return newDefaultSettings, nil
+}
+
+// UpdateDefaultGridStyle sets how much is drawn onto grids, on top of the images.
+func (q *queueImpl) UpdateDefaultGridStyle(target *SettingsTarget, gridStyle entities.GridStyle) (*entities.DefaultSettings, error) {
+	switch gridStyle {
+	case entities.GridStylePlain, entities.GridStyleNumbered, entities.GridStyleCaptioned:
+	default:
+		return nil, fmt.Errorf("unknown grid style %q", gridStyle)
+	}
+
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.GridStyle = &gridStyle
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default grid style for %s to: %v\n", target.settingsKey(), gridStyle)
+
+	return newDefaultSettings, nil
+}
+
+// UpdateDefaultAttachmentMode sets which images are attached to the reply to an imagine.
+func (q *queueImpl) UpdateDefaultAttachmentMode(target *SettingsTarget, attachmentMode entities.AttachmentMode) (*entities.DefaultSettings, error) {
+	switch attachmentMode {
+	case entities.AttachmentModeGrid, entities.AttachmentModeGridAndTiles, entities.AttachmentModeTiles:
+	default:
+		return nil, fmt.Errorf("unknown attachment mode %q", attachmentMode)
+	}
+
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.AttachmentMode = &attachmentMode
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default attachment mode for %s to: %v\n", target.settingsKey(), attachmentMode)
+
+	return newDefaultSettings, nil
+}
+
+func (q *queueImpl) UpdateDefaultDenoisingStrength(target *SettingsTarget, denoisingStrength float64) (*entities.DefaultSettings, error) {
+	err := validateDenoisingStrength(denoisingStrength)
+	if err != nil {
+		return nil, err
+	}
+
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.DenoisingStrength = denoisingStrength
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated default denoising strength for %s to: %v\n", target.settingsKey(), denoisingStrength)
+
+	return newDefaultSettings, nil
+}
+
+// UpdateDefaultNegativePrompt sets the negative prompt for the target's settings. A nil negative prompt
+// goes back to inheriting the one from the wider settings.
+func (q *queueImpl) UpdateDefaultNegativePrompt(target *SettingsTarget, negativePrompt *string) (*entities.DefaultSettings, error) {
+	newDefaultSettings, err := q.updateSettingsLayer(target, func(layer *entities.DefaultSettings) {
+		layer.NegativePrompt = negativePrompt
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if negativePrompt == nil {
+		log.Printf("Reset default negative prompt for %s\n", target.settingsKey())
+	} else {
+		log.Printf("Updated default negative prompt for %s to: %q\n", target.settingsKey(), *negativePrompt)
+	}
+
+	return newDefaultSettings, nil
+}
@@ -0,0 +1,450 @@
+package imagine_queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"stable_diffusion_bot/composite_renderer"
+	"stable_diffusion_bot/entities"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// SweepParameter is the setting that changes from one frame of a sweep to the next.
+type SweepParameter string
+
+const (
+	SweepParameterVariationStrength SweepParameter = "variation_strength"
+	SweepParameterCfgScale          SweepParameter = "cfg_scale"
+	SweepParameterSteps             SweepParameter = "steps"
+	SweepParameterPromptBlend       SweepParameter = "prompt_blend"
+)
+
+const (
+	// MinSweepFrames and MaxSweepFrames are how many frames a sweep can have. Each frame is generated
+	// separately, so a sweep takes about as long as that many imagines.
+	MinSweepFrames     = 2
+	MaxSweepFrames     = 16
+	DefaultSweepFrames = 8
+
+	// minSweepSteps and maxSweepSteps, and the same for the CFG scale, are the ranges the webui allows
+	minSweepSteps    = 1
+	maxSweepSteps    = 150
+	minSweepCfgScale = 1
+	maxSweepCfgScale = 30
+
+	// maxSweepTotalSteps is how many steps all of a sweep's frames can take between them, so that it
+	// can finish before Discord stops the bot from editing its reply
+	maxSweepTotalSteps = 800
+
+	// sweepFinishMargin is the time left for animating and posting the frames, once they're generated
+	sweepFinishMargin = time.Minute
+
+	// sweepFrameDelay is how long each frame of the animation is shown for
+	sweepFrameDelay = 500 * time.Millisecond
+)
+
+// SweepOptions are the settings for an ItemTypeSweep, which generates a frame for each step from From
+// to To of the parameter, keeping everything else the same.
+type SweepOptions struct {
+	Parameter SweepParameter
+	From      float64
+	To        float64
+	Frames    int
+
+	// EndPrompt is what the prompt is blended into by SweepParameterPromptBlend
+	EndPrompt string
+}
+
+// SweepOptionError is returned when a sweep's options can't be used. Its message is meant to be shown
+// to the user as-is.
+type SweepOptionError struct {
+	Reason string
+}
+
+func (e *SweepOptionError) Error() string {
+	return e.Reason
+}
+
+// DefaultSweepRange is the range that the parameter is swept over, unless another is chosen.
+func DefaultSweepRange(parameter SweepParameter) (float64, float64) {
+	switch parameter {
+	case SweepParameterCfgScale:
+		return 3, 15
+	case SweepParameterSteps:
+		return 10, 50
+	default:
+		return 0, 1
+	}
+}
+
+// validateSweep checks the sweep's options. The steps are the generation's, which are only checked
+// against the step budget when they're known, i.e. more than 0.
+func validateSweep(sweep *SweepOptions, steps int) error {
+	if sweep == nil {
+		return &SweepOptionError{Reason: "the sweep is missing its settings"}
+	}
+
+	if sweep.Frames < MinSweepFrames || sweep.Frames > MaxSweepFrames {
+		return &SweepOptionError{Reason: fmt.Sprintf("a sweep can have from %d to %d frames", MinSweepFrames, MaxSweepFrames)}
+	}
+
+	var minValue, maxValue float64
+
+	switch sweep.Parameter {
+	case SweepParameterVariationStrength, SweepParameterPromptBlend:
+		minValue, maxValue = 0, 1
+	case SweepParameterCfgScale:
+		minValue, maxValue = minSweepCfgScale, maxSweepCfgScale
+	case SweepParameterSteps:
+		minValue, maxValue = minSweepSteps, maxSweepSteps
+	default:
+		return &SweepOptionError{Reason: fmt.Sprintf("%q is not a setting I can sweep", sweep.Parameter)}
+	}
+
+	for _, value := range []float64{sweep.From, sweep.To} {
+		if value < minValue || value > maxValue {
+			return &SweepOptionError{Reason: fmt.Sprintf("the %s can only be swept from %s to %s",
+				sweepParameterName(sweep.Parameter), formatSweepValue(minValue), formatSweepValue(maxValue))}
+		}
+	}
+
+	if sweep.Parameter == SweepParameterPromptBlend && sweep.EndPrompt == "" {
+		return &SweepOptionError{Reason: "blending prompts needs a second prompt to blend into"}
+	}
+
+	return validateSweepSteps(sweep, steps)
+}
+
+// validateSweepSteps returns a SweepOptionError if the sweep's frames would take too many steps
+// between them.
+func validateSweepSteps(sweep *SweepOptions, steps int) error {
+	if sweep.Parameter != SweepParameterSteps && steps <= 0 {
+		return nil
+	}
+
+	total := sweepTotalSteps(sweep, steps)
+
+	if total > maxSweepTotalSteps {
+		return &SweepOptionError{Reason: fmt.Sprintf(
+			"the frames would take %d steps between them, and a sweep can take at most %d, so use fewer frames or steps",
+			total, maxSweepTotalSteps)}
+	}
+
+	return nil
+}
+
+// sweepTotalSteps is how many steps all of the sweep's frames take, when each one that isn't sweeping
+// the steps takes the given steps.
+func sweepTotalSteps(sweep *SweepOptions, steps int) int {
+	if sweep.Parameter != SweepParameterSteps {
+		return sweep.Frames * steps
+	}
+
+	total := 0
+
+	for frame := 0; frame < sweep.Frames; frame++ {
+		total += int(sweepValue(sweep, frame))
+	}
+
+	return total
+}
+
+func sweepParameterName(parameter SweepParameter) string {
+	switch parameter {
+	case SweepParameterVariationStrength:
+		return "variation strength"
+	case SweepParameterCfgScale:
+		return "CFG scale"
+	case SweepParameterSteps:
+		return "steps"
+	default:
+		return "prompt blend"
+	}
+}
+
+func formatSweepValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// sweepValue is the parameter's value for the frame, evenly spaced from the start of the range to its end.
+func sweepValue(sweep *SweepOptions, frame int) float64 {
+	value := sweep.From + (sweep.To-sweep.From)*float64(frame)/float64(sweep.Frames-1)
+
+	if sweep.Parameter == SweepParameterSteps {
+		return math.Round(value)
+	}
+
+	return math.Round(value*100) / 100
+}
+
+// sweepFrameGeneration copies the generation for a frame of the sweep, with the parameter set to the
+// frame's value. Prompts are blended with the webui's AND syntax, which weighs each prompt separately.
+func sweepFrameGeneration(generation *entities.ImageGeneration, sweep *SweepOptions, frame int) *entities.ImageGeneration {
+	frameGeneration := *generation
+
+	frameGeneration.SortOrder = frame + 1
+
+	value := sweepValue(sweep, frame)
+
+	switch sweep.Parameter {
+	case SweepParameterVariationStrength:
+		frameGeneration.SubseedStrength = value
+	case SweepParameterCfgScale:
+		frameGeneration.CfgScale = value
+	case SweepParameterSteps:
+		frameGeneration.Steps = int(value)
+	case SweepParameterPromptBlend:
+		frameGeneration.Prompt = fmt.Sprintf("%s :%s AND %s :%s",
+			generation.Prompt, formatSweepValue(math.Round((1-value)*100)/100), sweep.EndPrompt, formatSweepValue(value))
+	}
+
+	return &frameGeneration
+}
+
+// sweepFrameLabel is written onto the frame, so that it's clear which value each frame was generated with.
+func sweepFrameLabel(sweep *SweepOptions, frame int) string {
+	switch sweep.Parameter {
+	case SweepParameterSteps:
+		return fmt.Sprintf("Steps %s", formatSweepValue(sweepValue(sweep, frame)))
+	case SweepParameterCfgScale:
+		return fmt.Sprintf("CFG scale %s", formatSweepValue(sweepValue(sweep, frame)))
+	case SweepParameterVariationStrength:
+		return fmt.Sprintf("Variation %s", formatSweepValue(sweepValue(sweep, frame)))
+	default:
+		return fmt.Sprintf("Blend %s", formatSweepValue(sweepValue(sweep, frame)))
+	}
+}
+
+func sweepMessageContent(generation *entities.ImageGeneration, user *discordgo.User, sweep *SweepOptions, frame int) string {
+	request := fmt.Sprintf("<@%s> asked me to sweep the %s from %s to %s for \"%s\"",
+		user.ID, sweepParameterName(sweep.Parameter), formatSweepValue(sweep.From), formatSweepValue(sweep.To), generation.Prompt)
+
+	if sweep.Parameter == SweepParameterPromptBlend {
+		request = fmt.Sprintf("<@%s> asked me to blend \"%s\" into \"%s\"", user.ID, generation.Prompt, sweep.EndPrompt)
+	}
+
+	if frame < sweep.Frames {
+		return fmt.Sprintf("%s. Currently dreaming up frame %d of %d for them.", request, frame+1, sweep.Frames)
+	}
+
+	return request + ", here is what I imagined for them."
+}
+
+// processImagineSweep generates each frame of the sweep in turn, and posts them as an animated GIF. The
+// first frame's seed is kept for the rest, so that only the swept parameter changes between frames.
+func (q *queueImpl) processImagineSweep(b *backend, newGeneration *entities.ImageGeneration, imagine *QueueItem) error {
+	sweep := imagine.Sweep
+	if sweep == nil {
+		return errors.New("missing sweep options")
+	}
+
+	log.Printf("Processing sweep #%s on %s: %v\n", imagine.DiscordInteraction.ID, b.host(), newGeneration.Prompt)
+
+	// the steps may have come from the settings, which weren't known when the sweep was added
+	err := validateSweepSteps(sweep, newGeneration.Steps)
+	if err != nil {
+		return q.reportSweepProblem(imagine, fmt.Sprintf("I'm sorry, but I can't imagine your sweep, as %v.", err))
+	}
+
+	user := imagine.user()
+
+	newContent := sweepMessageContent(newGeneration, user, sweep, 0)
+
+	message, err := q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+		Content:    &newContent,
+		Components: cancelButtonComponents(imagine),
+	})
+	if err != nil {
+		log.Printf("Error editing interaction: %v", err)
+
+		// without the message, the generations can't be stored or shown
+		return err
+	}
+
+	newGeneration.InteractionID = imagine.DiscordInteraction.ID
+	newGeneration.MessageID = message.ID
+	newGeneration.MemberID = user.ID
+	newGeneration.BatchCount = 1
+	newGeneration.BatchSize = 1
+	newGeneration.Processed = true
+	newGeneration.Backend = b.host()
+
+	frameGenerations := make([]*entities.ImageGeneration, 0, sweep.Frames)
+	frameImages := make([][]byte, 0, sweep.Frames)
+	labels := make([]string, 0, sweep.Frames)
+
+	var longestFrame time.Duration
+
+	for frame := 0; frame < sweep.Frames; frame++ {
+		if q.itemCancelled(imagine) {
+			q.reportCancelled(imagine, message.ID)
+
+			return nil
+		}
+
+		// the reply can only be edited for so long, so the sweep is stopped if the next frame might not
+		// finish in time to post it
+		if interactionTimeLeft(imagine.DiscordInteraction) < longestFrame+sweepFinishMargin {
+			log.Printf("Stopping sweep #%s before frame %d, as the interaction is about to expire\n", imagine.DiscordInteraction.ID, frame+1)
+
+			return q.reportSweepProblem(imagine,
+				"I'm sorry, but your sweep was taking longer than Discord lets me keep my reply open. Try fewer frames or steps.")
+		}
+
+		frameStart := time.Now()
+
+		if frame > 0 {
+			progressContent := sweepMessageContent(newGeneration, user, sweep, frame)
+
+			_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+				Content: &progressContent,
+			})
+			if err != nil {
+				log.Printf("Error editing interaction: %v", err)
+			}
+		}
+
+		frameGeneration := sweepFrameGeneration(newGeneration, sweep, frame)
+
+		resp, err := q.generateImages(b, frameGeneration)
+
+		if time.Since(frameStart) > longestFrame {
+			longestFrame = time.Since(frameStart)
+		}
+
+		// an interrupted generation still returns the image so far, which isn't wanted
+		if q.itemCancelled(imagine) {
+			q.reportCancelled(imagine, message.ID)
+
+			return nil
+		}
+
+		if err == nil && (len(resp.Images) == 0 || len(resp.Seeds) == 0) {
+			err = errors.New("no image was generated")
+		}
+
+		var image []byte
+
+		if err == nil {
+			image, err = base64.StdEncoding.DecodeString(resp.Images[0])
+		}
+
+		if err != nil {
+			log.Printf("Error processing sweep frame %d on %s: %v\n", frame+1, b.host(), err)
+
+			q.recheckBackend(b)
+
+			return q.reportSweepProblem(imagine, apiErrorContent("I'm sorry, but I had a problem imagining your sweep.", err))
+		}
+
+		if frame == 0 {
+			newGeneration.Seed = resp.Seeds[0]
+
+			if len(resp.Subseeds) > 0 {
+				newGeneration.Subseed = resp.Subseeds[0]
+			}
+
+			// record which checkpoint was actually used, so that the info for each frame shows it
+			if newGeneration.Model == "" {
+				newGeneration.Model = resp.ModelName
+			}
+
+			newGeneration.ModelHash = resp.ModelHash
+
+			frameGeneration.Seed = newGeneration.Seed
+			frameGeneration.Subseed = newGeneration.Subseed
+			frameGeneration.Model = newGeneration.Model
+			frameGeneration.ModelHash = newGeneration.ModelHash
+		}
+
+		frameGenerations = append(frameGenerations, frameGeneration)
+		frameImages = append(frameImages, q.embedParameters(image, frameGeneration))
+		labels = append(labels, sweepFrameLabel(sweep, frame))
+	}
+
+	imageBufs := make([]*bytes.Buffer, len(frameImages))
+
+	for idx, image := range frameImages {
+		imageBufs[idx] = bytes.NewBuffer(image)
+	}
+
+	animation, err := q.compositeRenderer.AnimateImages(imageBufs, composite_renderer.AnimationOptions{
+		FrameDelay: sweepFrameDelay,
+		Labels:     labels,
+		MaxBytes:   q.maxUploadBytes,
+	})
+	if err != nil {
+		log.Printf("Error animating images: %v\n", err)
+
+		if errors.Is(err, composite_renderer.ErrOverBudget) {
+			return q.reportSweepProblem(imagine, "I'm sorry, but your sweep is too big to post, even after shrinking it. Try fewer frames.")
+		}
+
+		return err
+	}
+
+	var storedImagePaths []string
+
+	// each frame is stored with its own generation, so that it can be described like the images of a grid
+	for idx, frameGeneration := range frameGenerations {
+		frameGeneration.ImagePath = q.storeImage(frameImages[idx])
+
+		if frameGeneration.ImagePath != "" {
+			storedImagePaths = append(storedImagePaths, frameGeneration.ImagePath)
+		}
+
+		_, createErr := q.imageGenerationRepo.Create(context.Background(), frameGeneration)
+		if createErr != nil {
+			log.Printf("Error creating image generation record: %v\n", createErr)
+		}
+	}
+
+	// the item may have been cancelled while the generations were being stored
+	if q.itemCancelled(imagine) {
+		// the generations are thrown away first, so that only images nothing else uses are deleted
+		q.reportCancelled(imagine, message.ID)
+		q.deleteStoredImages(storedImagePaths)
+
+		return nil
+	}
+
+	finishedContent := sweepMessageContent(newGeneration, user, sweep, sweep.Frames)
+
+	_, err = q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+		Content: &finishedContent,
+		Files: []*discordgo.File{
+			{
+				ContentType: "image/gif",
+				Name:        promptSlug(newGeneration.Prompt) + "-sweep.gif",
+				Reader:      animation,
+			},
+		},
+		Attachments: &[]*discordgo.MessageAttachment{},
+		Components:  &[]discordgo.MessageComponent{},
+	})
+	if err != nil {
+		log.Printf("Error editing interaction: %v\n", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// reportSweepProblem replaces the sweep's reply with the content, which explains why it couldn't be finished.
+func (q *queueImpl) reportSweepProblem(imagine *QueueItem, content string) error {
+	_, err := q.botSession.InteractionResponseEdit(imagine.DiscordInteraction, &discordgo.WebhookEdit{
+		Content:     &content,
+		Components:  &[]discordgo.MessageComponent{},
+		Attachments: &[]*discordgo.MessageAttachment{},
+	})
+
+	return err
+}
@@ -2,26 +2,103 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"stable_diffusion_bot/composite_renderer"
 	"stable_diffusion_bot/databases/sqlite"
 	"stable_diffusion_bot/discord_bot"
+	"stable_diffusion_bot/image_storage"
 	"stable_diffusion_bot/imagine_queue"
 	"stable_diffusion_bot/repositories/default_settings"
 	"stable_diffusion_bot/repositories/image_generations"
+	"stable_diffusion_bot/repositories/queue_items"
+	"stable_diffusion_bot/repositories/user_limits"
 	"stable_diffusion_bot/stable_diffusion_api"
+	"strings"
 )
 
 // Bot parameters
 var (
 	guildID            = flag.String("guild", "", "Guild ID. If not passed - bot registers commands globally")
 	botToken           = flag.String("token", "", "Bot access token")
-	apiHost            = flag.String("host", "", "Host for the Automatic1111 API")
+	apiHost            = flag.String("host", "", "Host for the Automatic1111 API. Separate several hosts with commas to use them all")
 	imagineCommand     = flag.String("imagine", "imagine", "Imagine command name. Default is \"imagine\"")
 	removeCommandsFlag = flag.Bool("remove", false, "Delete all commands when bot exits")
 	devModeFlag        = flag.Bool("dev", false, "Start in development mode, using \"dev_\" prefixed commands instead")
+	maxQueuedFlag      = flag.Int("max-queued", 5, "How many imagines each member can have in the queue at once. 0 means no limit")
+	maxPerHourFlag     = flag.Int("max-per-hour", 0, "How many imagines each member can add per hour. 0 means no limit")
+	apiTimeoutFlag     = flag.Duration("api-timeout", stable_diffusion_api.DefaultTimeout, "How long a request to the Automatic1111 API can take")
+	apiRetriesFlag     = flag.Int("api-retries", stable_diffusion_api.DefaultRetries, "How many times to retry requests to the Automatic1111 API that are safe to repeat")
+	apiUsernameFlag    = flag.String("api-username", "", "Username for the Automatic1111 API's basic auth (--api-auth). Can also be set with "+apiUsernameEnv)
+	apiPasswordFlag    = flag.String("api-password", "", "Password for the Automatic1111 API's basic auth. Can also be set with "+apiPasswordEnv)
+	apiTokenFlag       = flag.String("api-token", "", "Bearer token sent to the Automatic1111 API, e.g. for a reverse proxy. Can also be set with "+apiTokenEnv)
+	apiCAFileFlag      = flag.String("api-ca-file", "", "PEM file of CA certificates to trust for an Automatic1111 API served over HTTPS")
+	apiInsecureFlag    = flag.Bool("api-insecure", false, "Don't check the certificate of an Automatic1111 API served over HTTPS")
+	apiHeaderFlags     headerFlags
+	imageDirFlag       = flag.String("image-dir", "images", "Directory to keep generated images in")
+	imageRetentionFlag = flag.Duration("image-retention", 0, "How long to keep generated images for, e.g. 720h. 0 keeps them forever")
+	uploadFormatFlag   = flag.String("upload-format", uploadFormatPNG, "Format to post grids and upscales in: png or jpeg. JPEGs keep their parameters in a comment")
+	uploadQualityFlag  = flag.Int("upload-quality", composite_renderer.DefaultJPEGQuality, "Quality of the JPEGs posted with -upload-format jpeg, from 1 to 100")
+	uploadLimitFlag    = flag.Float64("upload-limit", defaultUploadLimitMB, "Largest image to post, in MB. Larger images are posted as smaller JPEGs. 0 means no limit")
 )
 
+const (
+	uploadFormatPNG  = "png"
+	uploadFormatJPEG = "jpeg"
+	uploadFormatWebP = "webp"
+
+	// defaultUploadLimitMB is Discord's upload limit for servers without boosts
+	defaultUploadLimitMB = 8
+
+	// uploadParametersBytes is left out of the upload limit for the parameters, which are copied into
+	// images after they're encoded, and are at most a JPEG comment long
+	uploadParametersBytes = 64 * 1024
+)
+
+// The API's secrets can be set with environment variables instead of flags, so that they don't show
+// up in the list of running processes.
+const (
+	apiUsernameEnv = "SD_API_USERNAME"
+	apiPasswordEnv = "SD_API_PASSWORD"
+	apiTokenEnv    = "SD_API_TOKEN"
+)
+
+// headerFlags collects each "Name: value" passed with the -api-header flag.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	name, headerValue, found := strings.Cut(value, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return errors.New("headers must look like \"Name: value\"")
+	}
+
+	h[strings.TrimSpace(name)] = strings.TrimSpace(headerValue)
+
+	return nil
+}
+
+func init() {
+	apiHeaderFlags = make(headerFlags)
+
+	flag.Var(apiHeaderFlags, "api-header", "Header to send with every request to the Automatic1111 API, as \"Name: value\". Can be repeated")
+}
+
+// flagOrEnv returns the flag's value, or the environment variable's if the flag wasn't set.
+func flagOrEnv(flagValue *string, env string) string {
+	if flagValue != nil && *flagValue != "" {
+		return *flagValue
+	}
+
+	return os.Getenv(env)
+}
+
 func main() {
 	flag.Parse()
 
@@ -55,11 +132,42 @@ func main() {
 		removeCommands = *removeCommandsFlag
 	}
 
-	stableDiffusionAPI, err := stable_diffusion_api.New(stable_diffusion_api.Config{
-		Host: *apiHost,
+	var stableDiffusionAPIs []stable_diffusion_api.StableDiffusionAPI
+
+	// the hosts share a client, so that they share its connections
+	apiClient, err := stable_diffusion_api.NewClient(stable_diffusion_api.ClientConfig{
+		Timeout:            *apiTimeoutFlag,
+		CAFile:             *apiCAFileFlag,
+		InsecureSkipVerify: *apiInsecureFlag,
 	})
 	if err != nil {
-		log.Fatalf("Failed to create Stable Diffusion API: %v", err)
+		log.Fatalf("Failed to create Stable Diffusion API client: %v", err)
+	}
+
+	apiCredentials := stable_diffusion_api.Credentials{
+		Username:    flagOrEnv(apiUsernameFlag, apiUsernameEnv),
+		Password:    flagOrEnv(apiPasswordFlag, apiPasswordEnv),
+		BearerToken: flagOrEnv(apiTokenFlag, apiTokenEnv),
+		Headers:     apiHeaderFlags,
+	}
+
+	for _, host := range strings.Split(*apiHost, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		stableDiffusionAPI, err := stable_diffusion_api.New(stable_diffusion_api.Config{
+			Host:        host,
+			Client:      apiClient,
+			Retries:     *apiRetriesFlag,
+			Credentials: apiCredentials,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create Stable Diffusion API: %v", err)
+		}
+
+		stableDiffusionAPIs = append(stableDiffusionAPIs, stableDiffusionAPI)
 	}
 
 	ctx := context.Background()
@@ -79,10 +187,40 @@ func main() {
 		log.Fatalf("Failed to create default settings repository: %v", err)
 	}
 
+	queueItemRepo, err := queue_items.NewRepository(&queue_items.Config{DB: sqliteDB})
+	if err != nil {
+		log.Fatalf("Failed to create queue item repository: %v", err)
+	}
+
+	userLimitsRepo, err := user_limits.NewRepository(&user_limits.Config{DB: sqliteDB})
+	if err != nil {
+		log.Fatalf("Failed to create user limits repository: %v", err)
+	}
+
+	imageStorage, err := image_storage.New(image_storage.Config{
+		Dir:       *imageDirFlag,
+		Retention: *imageRetentionFlag,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create image storage: %v", err)
+	}
+
+	uploadEncoder, err := newUploadEncoder()
+	if err != nil {
+		log.Fatalf("Failed to create upload encoder: %v", err)
+	}
+
 	imagineQueue, err := imagine_queue.New(imagine_queue.Config{
-		StableDiffusionAPI:  stableDiffusionAPI,
+		StableDiffusionAPIs: stableDiffusionAPIs,
 		ImageGenerationRepo: generationRepo,
 		DefaultSettingsRepo: defaultSettingsRepo,
+		QueueItemRepo:       queueItemRepo,
+		UserLimitsRepo:      userLimitsRepo,
+		ImageStorage:        imageStorage,
+		UploadEncoder:       uploadEncoder,
+		MaxUploadBytes:      uploadLimitBytes(),
+		DefaultMaxQueued:    *maxQueuedFlag,
+		DefaultMaxPerHour:   *maxPerHourFlag,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create imagine queue: %v", err)
@@ -104,3 +242,41 @@ func main() {
 
 	log.Println("Gracefully shutting down.")
 }
+
+// newUploadEncoder creates the encoder for posting images, from the upload flags.
+func newUploadEncoder() (composite_renderer.Encoder, error) {
+	var encoder composite_renderer.Encoder
+
+	switch strings.ToLower(*uploadFormatFlag) {
+	case uploadFormatPNG:
+		encoder = composite_renderer.NewPNGEncoder()
+	case uploadFormatJPEG, "jpg":
+		var err error
+
+		encoder, err = composite_renderer.NewJPEGEncoder(*uploadQualityFlag)
+		if err != nil {
+			return nil, err
+		}
+	case uploadFormatWebP:
+		// golang.org/x/image can only decode WebP, and the encoders that exist need cgo and libwebp,
+		// which would stop the bot building as a single static binary
+		return nil, errors.New("webp uploads aren't supported, as the bot can't encode WebP images, use jpeg instead")
+	default:
+		return nil, fmt.Errorf("unknown upload format %q", *uploadFormatFlag)
+	}
+
+	if uploadLimitBytes() == 0 {
+		return encoder, nil
+	}
+
+	return composite_renderer.NewSizeBudgetEncoder(encoder, uploadLimitBytes()-uploadParametersBytes)
+}
+
+// uploadLimitBytes is the -upload-limit flag in bytes, which is 0 when there is no limit.
+func uploadLimitBytes() int {
+	if *uploadLimitFlag <= 0 {
+		return 0
+	}
+
+	return int(*uploadLimitFlag * 1024 * 1024)
+}
@@ -0,0 +1,9 @@
+package png_info
+
+import "stable_diffusion_bot/entities"
+
+type PNGInfo interface {
+	EmbedParameters(image []byte, generation *entities.ImageGeneration) ([]byte, error)
+	ReadParameters(image []byte) (*entities.ImageGeneration, error)
+	CopyParameters(from, to []byte) ([]byte, error)
+}
@@ -0,0 +1,79 @@
+package png_info
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// jpegCommentMarker starts a JPEG comment segment, which is where the parameters are kept in JPEGs
+	jpegCommentMarker = 0xFE
+
+	// jpegStartOfScanMarker starts the image data, after which there are no more comment segments
+	jpegStartOfScanMarker = 0xDA
+
+	// maxJPEGCommentSize is the most text a JPEG comment segment can hold, as its length, which
+	// counts itself, is two bytes
+	maxJPEGCommentSize = 0xFFFF - 2
+)
+
+var jpegSignature = []byte{0xFF, 0xD8}
+
+// setJPEGComment writes the text into a comment segment, straight after the start of the JPEG.
+func setJPEGComment(image []byte, text string) ([]byte, error) {
+	if !bytes.HasPrefix(image, jpegSignature) {
+		return nil, errors.New("not a JPEG image")
+	}
+
+	if len(text) > maxJPEGCommentSize {
+		return nil, errors.New("the parameters are too long for a JPEG comment")
+	}
+
+	header := []byte{0xFF, jpegCommentMarker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(text)+2))
+
+	output := bytes.NewBuffer(make([]byte, 0, len(image)+len(header)+len(text)))
+
+	output.Write(jpegSignature)
+	output.Write(header)
+	output.WriteString(text)
+	output.Write(image[len(jpegSignature):])
+
+	return output.Bytes(), nil
+}
+
+// readJPEGComment returns the text of the first comment segment in the JPEG.
+func readJPEGComment(image []byte) (string, error) {
+	if !bytes.HasPrefix(image, jpegSignature) {
+		return "", errors.New("not a JPEG image")
+	}
+
+	offset := len(jpegSignature)
+
+	for offset+4 <= len(image) {
+		if image[offset] != 0xFF {
+			return "", errors.New("invalid JPEG segment")
+		}
+
+		marker := image[offset+1]
+		if marker == jpegStartOfScanMarker {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(image[offset+2:]))
+		end := offset + 2 + length
+
+		if length < 2 || end > len(image) {
+			return "", errors.New("truncated JPEG segment")
+		}
+
+		if marker == jpegCommentMarker {
+			return string(image[offset+4 : end]), nil
+		}
+
+		offset = end
+	}
+
+	return "", ErrNoParameters
+}
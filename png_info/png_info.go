@@ -0,0 +1,221 @@
+package png_info
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"stable_diffusion_bot/entities"
+	"strconv"
+	"strings"
+)
+
+// parametersKeyword is the text chunk keyword that the webui's PNG Info tab reads the parameters from.
+const parametersKeyword = "parameters"
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngInfoImpl struct{}
+
+type Config struct{}
+
+func New(cfg Config) (PNGInfo, error) {
+	return &pngInfoImpl{}, nil
+}
+
+// EmbedParameters writes the generation's parameters into the PNG, in the same format as the webui,
+// replacing any parameters that were already in it.
+func (p *pngInfoImpl) EmbedParameters(image []byte, generation *entities.ImageGeneration) ([]byte, error) {
+	if generation == nil {
+		return nil, errors.New("missing generation")
+	}
+
+	return setTextChunk(image, parametersKeyword, Parameters(generation))
+}
+
+// CopyParameters writes the parameters from one image into a re-encoded copy of it, so that they're
+// kept when a PNG is posted as a JPEG. JPEGs keep them in a comment.
+func (p *pngInfoImpl) CopyParameters(from, to []byte) ([]byte, error) {
+	text, err := readParametersText(from)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(to, jpegSignature) {
+		return setJPEGComment(to, text)
+	}
+
+	return setTextChunk(to, parametersKeyword, text)
+}
+
+// Parameters formats the generation like the webui does, with the prompt, the negative prompt, and
+// then the rest of the settings on one line.
+func Parameters(generation *entities.ImageGeneration) string {
+	lines := []string{generation.Prompt}
+
+	if generation.NegativePrompt != "" {
+		lines = append(lines, "Negative prompt: "+generation.NegativePrompt)
+	}
+
+	settings := []string{
+		"Steps: " + strconv.Itoa(generation.Steps),
+		"Sampler: " + quoteParameter(generation.SamplerName),
+		"CFG scale: " + formatFloat(generation.CfgScale),
+		"Seed: " + strconv.Itoa(generation.Seed),
+		fmt.Sprintf("Size: %dx%d", generation.Width, generation.Height),
+	}
+
+	if generation.ModelHash != "" {
+		settings = append(settings, "Model hash: "+quoteParameter(generation.ModelHash))
+	}
+
+	if generation.Model != "" {
+		settings = append(settings, "Model: "+quoteParameter(generation.Model))
+	}
+
+	if generation.SubseedStrength > 0 {
+		settings = append(settings,
+			"Variation seed: "+strconv.Itoa(generation.Subseed),
+			"Variation seed strength: "+formatFloat(generation.SubseedStrength),
+		)
+	}
+
+	if generation.EnableHR || generation.InitImageURL != "" {
+		settings = append(settings, "Denoising strength: "+formatFloat(generation.DenoisingStrength))
+	}
+
+	if generation.EnableHR {
+		settings = append(settings, fmt.Sprintf("Hires resize: %dx%d", generation.HiresWidth, generation.HiresHeight))
+
+		if generation.HiresUpscaler != "" {
+			settings = append(settings, "Hires upscaler: "+quoteParameter(generation.HiresUpscaler))
+		}
+	}
+
+	if generation.InitImageURL != "" && generation.MaskBlur > 0 {
+		settings = append(settings, "Mask blur: "+strconv.Itoa(generation.MaskBlur))
+	}
+
+	lines = append(lines, strings.Join(settings, ", "))
+
+	return strings.Join(lines, "\n")
+}
+
+// quoteParameter quotes values that would otherwise be split up when the settings line is read, like
+// the webui does.
+func quoteParameter(value string) string {
+	if !strings.ContainsAny(value, ",:\n\"") {
+		return value
+	}
+
+	return strconv.Quote(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// setTextChunk puts a text chunk with the keyword right after the PNG's header, and takes out any
+// other text chunks with the same keyword. Text that can't be written as Latin-1 goes in an
+// international text chunk instead, like the webui does.
+func setTextChunk(image []byte, keyword, text string) ([]byte, error) {
+	if !bytes.HasPrefix(image, pngSignature) {
+		return nil, errors.New("not a PNG image")
+	}
+
+	output := bytes.NewBuffer(make([]byte, 0, len(image)+len(text)+64))
+	output.Write(pngSignature)
+
+	offset := len(pngSignature)
+
+	for offset < len(image) {
+		if offset+8 > len(image) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+
+		length := int(binary.BigEndian.Uint32(image[offset:]))
+		chunkType := string(image[offset+4 : offset+8])
+		end := offset + 12 + length
+
+		if length < 0 || end > len(image) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+
+		data := image[offset+8 : offset+8+length]
+
+		if !isTextChunkFor(chunkType, data, keyword) {
+			output.Write(image[offset:end])
+		}
+
+		// the new chunk goes straight after the header, which is always the first chunk
+		if chunkType == "IHDR" {
+			writeChunk(output, textChunk(keyword, text))
+		}
+
+		offset = end
+	}
+
+	return output.Bytes(), nil
+}
+
+type chunk struct {
+	chunkType string
+	data      []byte
+}
+
+func textChunk(keyword, text string) chunk {
+	latin1, ok := toLatin1(text)
+	if ok {
+		data := append([]byte(keyword+"\x00"), latin1...)
+
+		return chunk{chunkType: "tEXt", data: data}
+	}
+
+	// uncompressed, with no language tag or translated keyword
+	data := append([]byte(keyword+"\x00\x00\x00\x00\x00"), []byte(text)...)
+
+	return chunk{chunkType: "iTXt", data: data}
+}
+
+func toLatin1(text string) ([]byte, bool) {
+	latin1 := make([]byte, 0, len(text))
+
+	for _, r := range text {
+		if r > 0xff {
+			return nil, false
+		}
+
+		latin1 = append(latin1, byte(r))
+	}
+
+	return latin1, true
+}
+
+// isTextChunkFor is true for any kind of text chunk with the keyword.
+func isTextChunkFor(chunkType string, data []byte, keyword string) bool {
+	switch chunkType {
+	case "tEXt", "zTXt", "iTXt":
+		return bytes.HasPrefix(data, []byte(keyword+"\x00"))
+	default:
+		return false
+	}
+}
+
+func writeChunk(output *bytes.Buffer, c chunk) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(c.data)))
+	copy(header[4:], c.chunkType)
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(c.data)
+
+	output.Write(header)
+	output.Write(c.data)
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, checksum.Sum32())
+
+	output.Write(crc)
+}
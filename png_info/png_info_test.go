@@ -0,0 +1,199 @@
+package png_info
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"stable_diffusion_bot/entities"
+	"testing"
+)
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+
+	buf := new(bytes.Buffer)
+
+	err := png.Encode(buf, img)
+	if err != nil {
+		t.Fatalf("png.Encode returned error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	buf := new(bytes.Buffer)
+
+	err := jpeg.Encode(buf, img, nil)
+	if err != nil {
+		t.Fatalf("jpeg.Encode returned error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestParametersRoundTrip(t *testing.T) {
+	// only the settings that are written into the parameters are set, so that they can be compared
+	// with what is read back
+	tests := []struct {
+		name       string
+		generation entities.ImageGeneration
+	}{
+		{
+			name: "basic",
+			generation: entities.ImageGeneration{
+				Prompt: "a cute kitten", Steps: 20, SamplerName: "Euler a", CfgScale: 7, Seed: 42, Subseed: -1,
+				Width: 512, Height: 768,
+			},
+		},
+		{
+			name: "negative prompt and model",
+			generation: entities.ImageGeneration{
+				Prompt: "a cute kitten\non two lines", NegativePrompt: "blurry, text", Steps: 30, SamplerName: "DPM++ 2M Karras",
+				CfgScale: 6.5, Seed: 1, Subseed: -1, Width: 512, Height: 512, ModelHash: "abcdef12", Model: "v1-5-pruned",
+			},
+		},
+		{
+			name: "quoted values",
+			generation: entities.ImageGeneration{
+				Prompt: "a cute kitten", Steps: 20, SamplerName: "Euler a", CfgScale: 7, Seed: 1, Subseed: -1,
+				Width: 512, Height: 512, Model: `my "best", model: v2`, EnableHR: true, DenoisingStrength: 0.7,
+				HiresWidth: 1024, HiresHeight: 1024, HiresUpscaler: "R-ESRGAN 4x+, Anime6B",
+			},
+		},
+		{
+			name: "variation",
+			generation: entities.ImageGeneration{
+				Prompt: "a cute kitten", Steps: 20, SamplerName: "Euler a", CfgScale: 7, Seed: 1, Subseed: 2,
+				SubseedStrength: 0.25, Width: 512, Height: 512,
+			},
+		},
+		{
+			name: "not latin-1",
+			generation: entities.ImageGeneration{
+				Prompt: "子猫 riding a skateboard", Steps: 20, SamplerName: "Euler a", CfgScale: 7, Seed: 1, Subseed: -1,
+				Width: 512, Height: 512,
+			},
+		},
+	}
+
+	pngInfo, err := New(Config{})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			embedded, err := pngInfo.EmbedParameters(testPNG(t), &test.generation)
+			if err != nil {
+				t.Fatalf("EmbedParameters returned error: %v", err)
+			}
+
+			_, err = png.Decode(bytes.NewReader(embedded))
+			if err != nil {
+				t.Fatalf("the PNG with parameters can't be decoded: %v", err)
+			}
+
+			got, err := pngInfo.ReadParameters(embedded)
+			if err != nil {
+				t.Fatalf("ReadParameters returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(*got, test.generation) {
+				t.Errorf("ReadParameters = %+v, want %+v\nparameters:\n%s", *got, test.generation, Parameters(&test.generation))
+			}
+
+			copied, err := pngInfo.CopyParameters(embedded, testJPEG(t))
+			if err != nil {
+				t.Fatalf("CopyParameters returned error: %v", err)
+			}
+
+			_, err = jpeg.Decode(bytes.NewReader(copied))
+			if err != nil {
+				t.Fatalf("the JPEG with parameters can't be decoded: %v", err)
+			}
+
+			got, err = pngInfo.ReadParameters(copied)
+			if err != nil {
+				t.Fatalf("ReadParameters on the JPEG returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(*got, test.generation) {
+				t.Errorf("ReadParameters on the JPEG = %+v, want %+v", *got, test.generation)
+			}
+		})
+	}
+}
+
+func TestParseWebUIParameters(t *testing.T) {
+	text := "a cute kitten\n" +
+		"Negative prompt: blurry\n" +
+		`Steps: 25, Sampler: DPM++ 2M Karras, CFG scale: 7, Seed: 123, Size: 512x768, Model hash: 6ce0161689, ` +
+		`Model: "my, model", Denoising strength: 0.5, Hires upscale: 2, Hires upscaler: Latent, ` +
+		`Lora hashes: "kitten: 1234, skateboard: 5678", Version: v1.6.0`
+
+	want := entities.ImageGeneration{
+		Prompt: "a cute kitten", NegativePrompt: "blurry", Steps: 25, SamplerName: "DPM++ 2M Karras", CfgScale: 7,
+		Seed: 123, Subseed: -1, Width: 512, Height: 768, ModelHash: "6ce0161689", Model: "my, model",
+		DenoisingStrength: 0.5, EnableHR: true, HiresWidth: 1024, HiresHeight: 1536, HiresUpscaler: "Latent",
+	}
+
+	got, err := ParseParameters(text)
+	if err != nil {
+		t.Fatalf("ParseParameters returned error: %v", err)
+	}
+
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("ParseParameters = %+v, want %+v", *got, want)
+	}
+}
+
+func TestParseParametersErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "no settings", text: "a cute kitten"},
+		{name: "invalid steps", text: "a cute kitten\nSteps: many, Seed: 1"},
+		{name: "invalid size", text: "a cute kitten\nSteps: 20, Size: 512"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseParameters(test.text)
+			if err == nil {
+				t.Errorf("ParseParameters(%q) didn't return an error", test.text)
+			}
+		})
+	}
+}
+
+func TestReadParametersWithoutParameters(t *testing.T) {
+	pngInfo, err := New(Config{})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	images := map[string][]byte{
+		"png":  testPNG(t),
+		"jpeg": testJPEG(t),
+	}
+
+	for name, image := range images {
+		_, err = pngInfo.ReadParameters(image)
+		if !errors.Is(err, ErrNoParameters) {
+			t.Errorf("ReadParameters on a %s without parameters returned %v, want ErrNoParameters", name, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package png_info
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"stable_diffusion_bot/entities"
+	"strconv"
+	"strings"
+)
+
+// maxTextChunkSize caps how much a compressed text chunk can expand to.
+const maxTextChunkSize = 1024 * 1024
+
+// ErrNoParameters is returned when an image doesn't have generation parameters in it.
+var ErrNoParameters = errors.New("the image doesn't have any generation parameters")
+
+// settingRegex matches a "Name: value" pair in the webui's settings line. Values with commas in them
+// are quoted.
+var settingRegex = regexp.MustCompile(`\s*(\w[\w \-/]+):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+
+// ReadParameters reads the generation parameters that the webui, or this bot, wrote into the PNG, or
+// that the bot kept in the comment of a JPEG.
+func (p *pngInfoImpl) ReadParameters(image []byte) (*entities.ImageGeneration, error) {
+	text, err := readParametersText(image)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseParameters(text)
+}
+
+func readParametersText(image []byte) (string, error) {
+	if bytes.HasPrefix(image, jpegSignature) {
+		return readJPEGComment(image)
+	}
+
+	return readTextChunk(image, parametersKeyword)
+}
+
+// ParseParameters reads parameters in the format the webui writes them in, which Parameters also uses.
+func ParseParameters(text string) (*entities.ImageGeneration, error) {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(text), "\r\n", "\n"), "\n")
+
+	settingsLine := lines[len(lines)-1]
+	if !strings.Contains(settingsLine, "Steps: ") {
+		return nil, ErrNoParameters
+	}
+
+	generation := &entities.ImageGeneration{
+		Seed:    -1,
+		Subseed: -1,
+	}
+
+	var promptLines, negativePromptLines []string
+
+	for _, line := range lines[:len(lines)-1] {
+		switch {
+		case strings.HasPrefix(line, "Negative prompt:"):
+			negativePromptLines = append(negativePromptLines, strings.TrimSpace(strings.TrimPrefix(line, "Negative prompt:")))
+		case negativePromptLines != nil:
+			negativePromptLines = append(negativePromptLines, line)
+		default:
+			promptLines = append(promptLines, line)
+		}
+	}
+
+	generation.Prompt = strings.TrimSpace(strings.Join(promptLines, "\n"))
+	generation.NegativePrompt = strings.TrimSpace(strings.Join(negativePromptLines, "\n"))
+
+	var hiresScale float64
+
+	for _, match := range settingRegex.FindAllStringSubmatch(settingsLine, -1) {
+		name := strings.TrimSpace(match[1])
+		value := strings.TrimSpace(match[2])
+
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err == nil {
+				value = unquoted
+			}
+		}
+
+		var err error
+
+		switch name {
+		case "Steps":
+			generation.Steps, err = strconv.Atoi(value)
+		case "Sampler":
+			generation.SamplerName = value
+		case "CFG scale":
+			generation.CfgScale, err = strconv.ParseFloat(value, 64)
+		case "Seed":
+			generation.Seed, err = strconv.Atoi(value)
+		case "Size":
+			generation.Width, generation.Height, err = parseSize(value)
+		case "Model hash":
+			generation.ModelHash = value
+		case "Model":
+			generation.Model = value
+		case "Variation seed":
+			generation.Subseed, err = strconv.Atoi(value)
+		case "Variation seed strength":
+			generation.SubseedStrength, err = strconv.ParseFloat(value, 64)
+		case "Denoising strength":
+			generation.DenoisingStrength, err = strconv.ParseFloat(value, 64)
+		case "Face restoration":
+			generation.RestoreFaces = value != ""
+		case "Hires resize":
+			generation.EnableHR = true
+			generation.HiresWidth, generation.HiresHeight, err = parseSize(value)
+		case "Hires upscale":
+			generation.EnableHR = true
+			hiresScale, err = strconv.ParseFloat(value, 64)
+		case "Hires upscaler":
+			generation.HiresUpscaler = value
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+	}
+
+	// newer versions of the webui only give the scale, rather than the size
+	if generation.EnableHR && generation.HiresWidth == 0 && hiresScale > 0 {
+		generation.HiresWidth = int(float64(generation.Width) * hiresScale)
+		generation.HiresHeight = int(float64(generation.Height) * hiresScale)
+	}
+
+	return generation, nil
+}
+
+func parseSize(value string) (int, int, error) {
+	width, height, found := strings.Cut(value, "x")
+	if !found {
+		return 0, 0, errors.New("missing size separator")
+	}
+
+	widthInt, err := strconv.Atoi(width)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	heightInt, err := strconv.Atoi(height)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return widthInt, heightInt, nil
+}
+
+// readTextChunk finds the text chunk with the keyword, whichever kind of text chunk it is.
+func readTextChunk(image []byte, keyword string) (string, error) {
+	if !bytes.HasPrefix(image, pngSignature) {
+		return "", errors.New("not a PNG image")
+	}
+
+	offset := len(pngSignature)
+
+	for offset+8 <= len(image) {
+		length := int(binary.BigEndian.Uint32(image[offset:]))
+		chunkType := string(image[offset+4 : offset+8])
+		end := offset + 12 + length
+
+		if length < 0 || end > len(image) {
+			return "", errors.New("truncated PNG chunk")
+		}
+
+		data := image[offset+8 : offset+8+length]
+
+		if isTextChunkFor(chunkType, data, keyword) {
+			return decodeTextChunk(chunkType, data[len(keyword)+1:])
+		}
+
+		offset = end
+	}
+
+	return "", ErrNoParameters
+}
+
+// decodeTextChunk decodes the data that follows the keyword of a text chunk.
+func decodeTextChunk(chunkType string, data []byte) (string, error) {
+	switch chunkType {
+	case "tEXt":
+		return fromLatin1(data), nil
+	case "zTXt":
+		if len(data) < 1 {
+			return "", errors.New("truncated text chunk")
+		}
+
+		text, err := inflate(data[1:])
+		if err != nil {
+			return "", err
+		}
+
+		return fromLatin1(text), nil
+	default:
+		// the compression flag and method, then the language tag and translated keyword
+		if len(data) < 2 {
+			return "", errors.New("truncated text chunk")
+		}
+
+		compressed := data[0] == 1
+
+		rest := data[2:]
+
+		for idx := 0; idx < 2; idx++ {
+			separator := bytes.IndexByte(rest, 0)
+			if separator < 0 {
+				return "", errors.New("truncated text chunk")
+			}
+
+			rest = rest[separator+1:]
+		}
+
+		if !compressed {
+			return string(rest), nil
+		}
+
+		text, err := inflate(rest)
+		if err != nil {
+			return "", err
+		}
+
+		return string(text), nil
+	}
+}
+
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return io.ReadAll(io.LimitReader(reader, maxTextChunkSize))
+}
+
+func fromLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+
+	for idx, b := range data {
+		runes[idx] = rune(b)
+	}
+
+	return string(runes)
+}
@@ -11,11 +11,11 @@ import (
 )
 
 const upsertSetting string = `
-INSERT OR REPLACE INTO default_settings (member_id, width, height, batch_count, batch_size) VALUES (?, ?, ?, ?, ?);
+INSERT OR REPLACE INTO default_settings (member_id, width, height, batch_count, batch_size, model, sampler_name, steps, cfg_scale, restore_faces, denoising_strength, negative_prompt, show_previews, grid_style, attachment_mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 `
 
 const getSettingByMemberID string = `
-SELECT member_id, width, height, batch_count, batch_size FROM default_settings WHERE member_id = ?;
+SELECT member_id, width, height, batch_count, batch_size, model, sampler_name, steps, cfg_scale, restore_faces, denoising_strength, negative_prompt, show_previews, grid_style, attachment_mode FROM default_settings WHERE member_id = ?;
 `
 
 type sqliteRepo struct {
@@ -42,7 +42,9 @@ func NewRepository(cfg *Config) (Repository, error) {
 
 func (repo *sqliteRepo) Upsert(ctx context.Context, setting *entities.DefaultSettings) (*entities.DefaultSettings, error) {
 	_, err := repo.dbConn.ExecContext(ctx, upsertSetting,
-		setting.MemberID, setting.Width, setting.Height, setting.BatchCount, setting.BatchSize)
+		setting.MemberID, setting.Width, setting.Height, setting.BatchCount, setting.BatchSize, setting.Model,
+		setting.SamplerName, setting.Steps, setting.CfgScale, setting.RestoreFaces, setting.DenoisingStrength,
+		setting.NegativePrompt, setting.ShowPreviews, setting.GridStyle, setting.AttachmentMode)
 	if err != nil {
 		return nil, err
 	}
@@ -53,8 +55,17 @@ func (repo *sqliteRepo) Upsert(ctx context.Context, setting *entities.DefaultSet
 func (repo *sqliteRepo) GetByMemberID(ctx context.Context, memberID string) (*entities.DefaultSettings, error) {
 	var setting entities.DefaultSettings
 
+	// nullable settings are not set at this layer, and are inherited instead
+	var restoreFaces sql.NullBool
+	var negativePrompt sql.NullString
+	var showPreviews sql.NullBool
+	var gridStyle sql.NullString
+	var attachmentMode sql.NullString
+
 	err := repo.dbConn.QueryRowContext(ctx, getSettingByMemberID, memberID).Scan(
-		&setting.MemberID, &setting.Width, &setting.Height, &setting.BatchCount, &setting.BatchSize)
+		&setting.MemberID, &setting.Width, &setting.Height, &setting.BatchCount, &setting.BatchSize, &setting.Model,
+		&setting.SamplerName, &setting.Steps, &setting.CfgScale, &restoreFaces, &setting.DenoisingStrength,
+		&negativePrompt, &showPreviews, &gridStyle, &attachmentMode)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, repositories.NewNotFoundError(fmt.Sprintf("default setting for member ID %s", memberID))
@@ -63,5 +74,35 @@ func (repo *sqliteRepo) GetByMemberID(ctx context.Context, memberID string) (*en
 		return nil, err
 	}
 
+	setting.RestoreFaces = nullBoolPointer(restoreFaces)
+	setting.NegativePrompt = nullStringPointer(negativePrompt)
+	setting.ShowPreviews = nullBoolPointer(showPreviews)
+
+	if gridStyle.Valid {
+		style := entities.GridStyle(gridStyle.String)
+		setting.GridStyle = &style
+	}
+
+	if attachmentMode.Valid {
+		mode := entities.AttachmentMode(attachmentMode.String)
+		setting.AttachmentMode = &mode
+	}
+
 	return &setting, nil
 }
+
+func nullBoolPointer(value sql.NullBool) *bool {
+	if !value.Valid {
+		return nil
+	}
+
+	return &value.Bool
+}
+
+func nullStringPointer(value sql.NullString) *string {
+	if !value.Valid {
+		return nil
+	}
+
+	return &value.String
+}
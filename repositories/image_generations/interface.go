@@ -9,4 +9,9 @@ type Repository interface {
 	Create(ctx context.Context, generation *entities.ImageGeneration) (*entities.ImageGeneration, error)
 	GetByMessage(ctx context.Context, messageID string) (*entities.ImageGeneration, error)
 	GetByMessageAndSort(ctx context.Context, messageID string, sortOrder int) (*entities.ImageGeneration, error)
+	GetByImagePath(ctx context.Context, imagePath string) (*entities.ImageGeneration, error)
+	SetUpscaledImagePath(ctx context.Context, id int64, path string) error
+	ClearImagePath(ctx context.Context, path string) error
+	CountByImagePath(ctx context.Context, path string) (int, error)
+	DeleteByMessage(ctx context.Context, messageID string) error
 }
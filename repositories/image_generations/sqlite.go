@@ -9,15 +9,47 @@ import (
 )
 
 const insertGenerationQuery string = `
-INSERT INTO image_generations (interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+INSERT INTO image_generations (interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, init_image_url, resize_mode, mask_image_url, mask_tile, mask_blur, inpainting_fill, inpaint_full_res, hires_upscaler, model, model_hash, backend, image_path, upscaled_image_path, init_image_path, mask_image_path, grid_message_id, processed, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 `
 
 const getGenerationByMessageID string = `
-SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, created_at FROM image_generations WHERE message_id = ?;
+SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, init_image_url, resize_mode, mask_image_url, mask_tile, mask_blur, inpainting_fill, inpaint_full_res, hires_upscaler, model, model_hash, backend, image_path, upscaled_image_path, init_image_path, mask_image_path, grid_message_id, processed, created_at FROM image_generations WHERE message_id = ?;
 `
 
 const getGenerationByMessageIDAndSortOrder string = `
-SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, processed, created_at FROM image_generations WHERE message_id = ? AND sort_order = ?;
+SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, init_image_url, resize_mode, mask_image_url, mask_tile, mask_blur, inpainting_fill, inpaint_full_res, hires_upscaler, model, model_hash, backend, image_path, upscaled_image_path, init_image_path, mask_image_path, grid_message_id, processed, created_at FROM image_generations WHERE message_id = ? AND sort_order = ?;
+`
+
+const getGenerationByImagePath string = `
+SELECT id, interaction_id, message_id, member_id, sort_order, prompt, negative_prompt, width, height, restore_faces, enable_hr, hires_width, hires_height, denoising_strength, batch_count, batch_size, seed, subseed, subseed_strength, sampler_name, cfg_scale, steps, init_image_url, resize_mode, mask_image_url, mask_tile, mask_blur, inpainting_fill, inpaint_full_res, hires_upscaler, model, model_hash, backend, image_path, upscaled_image_path, init_image_path, mask_image_path, grid_message_id, processed, created_at FROM image_generations WHERE image_path = ? ORDER BY id DESC LIMIT 1;
+`
+
+const updateGenerationUpscaledImagePath string = `
+UPDATE image_generations SET upscaled_image_path = ? WHERE id = ?;
+`
+
+const clearGenerationImagePath string = `
+UPDATE image_generations SET image_path = '' WHERE image_path = ?;
+`
+
+const clearGenerationUpscaledImagePath string = `
+UPDATE image_generations SET upscaled_image_path = '' WHERE upscaled_image_path = ?;
+`
+
+const clearGenerationInitImagePath string = `
+UPDATE image_generations SET init_image_path = '' WHERE init_image_path = ?;
+`
+
+const clearGenerationMaskImagePath string = `
+UPDATE image_generations SET mask_image_path = '' WHERE mask_image_path = ?;
+`
+
+const countGenerationsByImagePath string = `
+SELECT COUNT(*) FROM image_generations WHERE image_path = ? OR upscaled_image_path = ? OR init_image_path = ? OR mask_image_path = ?;
+`
+
+const deleteGenerationsByMessageID string = `
+DELETE FROM image_generations WHERE message_id = ?;
 `
 
 type sqliteRepo struct {
@@ -50,7 +82,9 @@ func (repo *sqliteRepo) Create(ctx context.Context, generation *entities.ImageGe
 		generation.NegativePrompt, generation.Width, generation.Height, generation.RestoreFaces,
 		generation.EnableHR, generation.HiresWidth, generation.HiresHeight, generation.DenoisingStrength,
 		generation.BatchCount, generation.BatchSize, generation.Seed, generation.Subseed,
-		generation.SubseedStrength, generation.SamplerName, generation.CfgScale, generation.Steps, generation.Processed, generation.CreatedAt)
+		generation.SubseedStrength, generation.SamplerName, generation.CfgScale, generation.Steps,
+		generation.InitImageURL, generation.ResizeMode, generation.MaskImageURL, generation.MaskTile, generation.MaskBlur,
+		generation.InpaintingFill, generation.InpaintFullRes, generation.HiresUpscaler, generation.Model, generation.ModelHash, generation.Backend, generation.ImagePath, generation.UpscaledImagePath, generation.InitImagePath, generation.MaskImagePath, generation.GridMessageID, generation.Processed, generation.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +107,9 @@ func (repo *sqliteRepo) GetByMessage(ctx context.Context, messageID string) (*en
 		&generation.NegativePrompt, &generation.Width, &generation.Height, &generation.RestoreFaces,
 		&generation.EnableHR, &generation.HiresWidth, &generation.HiresHeight, &generation.DenoisingStrength,
 		&generation.BatchCount, &generation.BatchSize, &generation.Seed, &generation.Subseed,
-		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps, &generation.Processed, &generation.CreatedAt)
+		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps,
+		&generation.InitImageURL, &generation.ResizeMode, &generation.MaskImageURL, &generation.MaskTile, &generation.MaskBlur,
+		&generation.InpaintingFill, &generation.InpaintFullRes, &generation.HiresUpscaler, &generation.Model, &generation.ModelHash, &generation.Backend, &generation.ImagePath, &generation.UpscaledImagePath, &generation.InitImagePath, &generation.MaskImagePath, &generation.GridMessageID, &generation.Processed, &generation.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -89,10 +125,70 @@ func (repo *sqliteRepo) GetByMessageAndSort(ctx context.Context, messageID strin
 		&generation.NegativePrompt, &generation.Width, &generation.Height, &generation.RestoreFaces,
 		&generation.EnableHR, &generation.HiresWidth, &generation.HiresHeight, &generation.DenoisingStrength,
 		&generation.BatchCount, &generation.BatchSize, &generation.Seed, &generation.Subseed,
-		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps, &generation.Processed, &generation.CreatedAt)
+		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps,
+		&generation.InitImageURL, &generation.ResizeMode, &generation.MaskImageURL, &generation.MaskTile, &generation.MaskBlur,
+		&generation.InpaintingFill, &generation.InpaintFullRes, &generation.HiresUpscaler, &generation.Model, &generation.ModelHash, &generation.Backend, &generation.ImagePath, &generation.UpscaledImagePath, &generation.InitImagePath, &generation.MaskImagePath, &generation.GridMessageID, &generation.Processed, &generation.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 
 	return &generation, nil
 }
+
+// GetByImagePath finds the latest generation that the stored image was saved for.
+func (repo *sqliteRepo) GetByImagePath(ctx context.Context, imagePath string) (*entities.ImageGeneration, error) {
+	var generation entities.ImageGeneration
+
+	err := repo.dbConn.QueryRowContext(ctx, getGenerationByImagePath, imagePath).Scan(
+		&generation.ID, &generation.InteractionID, &generation.MessageID, &generation.MemberID, &generation.SortOrder, &generation.Prompt,
+		&generation.NegativePrompt, &generation.Width, &generation.Height, &generation.RestoreFaces,
+		&generation.EnableHR, &generation.HiresWidth, &generation.HiresHeight, &generation.DenoisingStrength,
+		&generation.BatchCount, &generation.BatchSize, &generation.Seed, &generation.Subseed,
+		&generation.SubseedStrength, &generation.SamplerName, &generation.CfgScale, &generation.Steps,
+		&generation.InitImageURL, &generation.ResizeMode, &generation.MaskImageURL, &generation.MaskTile, &generation.MaskBlur,
+		&generation.InpaintingFill, &generation.InpaintFullRes, &generation.HiresUpscaler, &generation.Model, &generation.ModelHash, &generation.Backend, &generation.ImagePath, &generation.UpscaledImagePath, &generation.InitImagePath, &generation.MaskImagePath, &generation.GridMessageID, &generation.Processed, &generation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &generation, nil
+}
+
+func (repo *sqliteRepo) SetUpscaledImagePath(ctx context.Context, id int64, path string) error {
+	_, err := repo.dbConn.ExecContext(ctx, updateGenerationUpscaledImagePath, path, id)
+
+	return err
+}
+
+// ClearImagePath forgets a stored image that has been removed, from every generation that used it.
+func (repo *sqliteRepo) ClearImagePath(ctx context.Context, path string) error {
+	for _, query := range []string{
+		clearGenerationImagePath, clearGenerationUpscaledImagePath, clearGenerationInitImagePath, clearGenerationMaskImagePath,
+	} {
+		_, err := repo.dbConn.ExecContext(ctx, query, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CountByImagePath counts the generations that use the stored image, as their image, their upscale,
+// or the source image or mask they were generated from.
+func (repo *sqliteRepo) CountByImagePath(ctx context.Context, path string) (int, error) {
+	var count int
+
+	err := repo.dbConn.QueryRowContext(ctx, countGenerationsByImagePath, path, path, path, path).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (repo *sqliteRepo) DeleteByMessage(ctx context.Context, messageID string) error {
+	_, err := repo.dbConn.ExecContext(ctx, deleteGenerationsByMessageID, messageID)
+
+	return err
+}
@@ -0,0 +1,16 @@
+package queue_items
+
+import (
+	"context"
+	"stable_diffusion_bot/entities"
+	"time"
+)
+
+type Repository interface {
+	Create(ctx context.Context, item *entities.QueueItem) (*entities.QueueItem, error)
+	UpdateStatus(ctx context.Context, id int64, status entities.QueueItemStatus, attempts int) error
+	GetUnfinished(ctx context.Context) ([]*entities.QueueItem, error)
+	CountByMemberSince(ctx context.Context, memberID string, since time.Time) (int, error)
+	DeleteFinishedBefore(ctx context.Context, before time.Time) error
+	Delete(ctx context.Context, id int64) error
+}
@@ -0,0 +1,127 @@
+package queue_items
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"stable_diffusion_bot/clock"
+	"stable_diffusion_bot/entities"
+	"time"
+)
+
+const insertQueueItemQuery string = `
+INSERT INTO queue_items (member_id, payload, status, attempts, created_at) VALUES (?, ?, ?, ?, ?);
+`
+
+const updateQueueItemStatusQuery string = `
+UPDATE queue_items SET status = ?, attempts = ? WHERE id = ?;
+`
+
+const getUnfinishedQueueItemsQuery string = `
+SELECT id, member_id, payload, status, attempts, created_at FROM queue_items WHERE status != ? ORDER BY id;
+`
+
+const countQueueItemsByMemberSinceQuery string = `
+SELECT COUNT(*) FROM queue_items WHERE member_id = ? AND created_at >= ?;
+`
+
+const deleteFinishedQueueItemsBeforeQuery string = `
+DELETE FROM queue_items WHERE status = ? AND created_at < ?;
+`
+
+const deleteQueueItemQuery string = `
+DELETE FROM queue_items WHERE id = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+	clock  clock.Clock
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+		clock:  clock.NewClock(),
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Create(ctx context.Context, item *entities.QueueItem) (*entities.QueueItem, error) {
+	item.CreatedAt = repo.clock.Now()
+
+	res, err := repo.dbConn.ExecContext(ctx, insertQueueItemQuery, item.MemberID, item.Payload, item.Status, item.Attempts, item.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	item.ID = lastID
+
+	return item, nil
+}
+
+func (repo *sqliteRepo) UpdateStatus(ctx context.Context, id int64, status entities.QueueItemStatus, attempts int) error {
+	_, err := repo.dbConn.ExecContext(ctx, updateQueueItemStatusQuery, status, attempts, id)
+
+	return err
+}
+
+func (repo *sqliteRepo) GetUnfinished(ctx context.Context) ([]*entities.QueueItem, error) {
+	rows, err := repo.dbConn.QueryContext(ctx, getUnfinishedQueueItemsQuery, entities.QueueItemStatusFinished)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var items []*entities.QueueItem
+
+	for rows.Next() {
+		var item entities.QueueItem
+
+		err = rows.Scan(&item.ID, &item.MemberID, &item.Payload, &item.Status, &item.Attempts, &item.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &item)
+	}
+
+	return items, rows.Err()
+}
+
+func (repo *sqliteRepo) CountByMemberSince(ctx context.Context, memberID string, since time.Time) (int, error) {
+	var count int
+
+	err := repo.dbConn.QueryRowContext(ctx, countQueueItemsByMemberSinceQuery, memberID, since).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (repo *sqliteRepo) DeleteFinishedBefore(ctx context.Context, before time.Time) error {
+	_, err := repo.dbConn.ExecContext(ctx, deleteFinishedQueueItemsBeforeQuery, entities.QueueItemStatusFinished, before)
+
+	return err
+}
+
+func (repo *sqliteRepo) Delete(ctx context.Context, id int64) error {
+	_, err := repo.dbConn.ExecContext(ctx, deleteQueueItemQuery, id)
+
+	return err
+}
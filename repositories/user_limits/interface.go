@@ -0,0 +1,11 @@
+package user_limits
+
+import (
+	"context"
+	"stable_diffusion_bot/entities"
+)
+
+type Repository interface {
+	Upsert(ctx context.Context, limits *entities.UserLimits) (*entities.UserLimits, error)
+	GetByMemberID(ctx context.Context, memberID string) (*entities.UserLimits, error)
+}
@@ -0,0 +1,79 @@
+package user_limits
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"stable_diffusion_bot/entities"
+	"stable_diffusion_bot/repositories"
+)
+
+const upsertUserLimitsQuery string = `
+INSERT OR REPLACE INTO user_limits (member_id, max_queued, max_per_hour) VALUES (?, ?, ?);
+`
+
+const getUserLimitsByMemberIDQuery string = `
+SELECT member_id, max_queued, max_per_hour FROM user_limits WHERE member_id = ?;
+`
+
+type sqliteRepo struct {
+	dbConn *sql.DB
+}
+
+type Config struct {
+	DB *sql.DB
+}
+
+func NewRepository(cfg *Config) (Repository, error) {
+	if cfg.DB == nil {
+		return nil, errors.New("missing DB parameter")
+	}
+
+	newRepo := &sqliteRepo{
+		dbConn: cfg.DB,
+	}
+
+	return newRepo, nil
+}
+
+func (repo *sqliteRepo) Upsert(ctx context.Context, limits *entities.UserLimits) (*entities.UserLimits, error) {
+	_, err := repo.dbConn.ExecContext(ctx, upsertUserLimitsQuery, limits.MemberID, limits.MaxQueued, limits.MaxPerHour)
+	if err != nil {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+func (repo *sqliteRepo) GetByMemberID(ctx context.Context, memberID string) (*entities.UserLimits, error) {
+	var limits entities.UserLimits
+
+	// a NULL limit uses the bot's default
+	var maxQueued, maxPerHour sql.NullInt64
+
+	err := repo.dbConn.QueryRowContext(ctx, getUserLimitsByMemberIDQuery, memberID).Scan(
+		&limits.MemberID, &maxQueued, &maxPerHour)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repositories.NewNotFoundError(fmt.Sprintf("user limits for member ID %s", memberID))
+		}
+
+		return nil, err
+	}
+
+	limits.MaxQueued = nullIntPointer(maxQueued)
+	limits.MaxPerHour = nullIntPointer(maxPerHour)
+
+	return &limits, nil
+}
+
+func nullIntPointer(value sql.NullInt64) *int {
+	if !value.Valid {
+		return nil
+	}
+
+	intValue := int(value.Int64)
+
+	return &intValue
+}
@@ -0,0 +1,105 @@
+package stable_diffusion_api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Credentials are sent with every request, for webuis started with --api-auth, or that are behind a
+// reverse proxy that needs them.
+type Credentials struct {
+	// Username and Password are sent with HTTP basic auth
+	Username string
+	Password string
+
+	// BearerToken is sent in the Authorization header, e.g. for an API key checked by a proxy
+	BearerToken string
+
+	// Headers are added to every request, e.g. for proxies that check a custom header
+	Headers map[string]string
+}
+
+func (c *Credentials) validate() error {
+	if c.Username == "" && c.Password != "" {
+		return errors.New("missing API username")
+	}
+
+	if c.Username != "" && c.BearerToken != "" {
+		return errors.New("basic auth and a bearer token can't both be used")
+	}
+
+	return nil
+}
+
+// apply adds the credentials to the request.
+func (c *Credentials) apply(request *http.Request) {
+	for name, value := range c.Headers {
+		request.Header.Set(name, value)
+	}
+
+	if c.Username != "" {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
+
+	if c.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+}
+
+type ClientConfig struct {
+	// Timeout is how long a request can take, which is DefaultTimeout if it isn't set
+	Timeout time.Duration
+
+	// CAFile is a PEM file of certificates to trust, for webuis served over HTTPS with a private CA
+	CAFile string
+
+	// InsecureSkipVerify turns off checking the webui's certificate, e.g. for a self-signed one
+	InsecureSkipVerify bool
+}
+
+// NewClient creates a client that can be shared by the APIs.
+func NewClient(cfg ClientConfig) (*http.Client, error) {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	if cfg.CAFile == "" && !cfg.InsecureSkipVerify {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // only when asked for with a flag
+	}
+
+	if cfg.CAFile != "" {
+		caCerts, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+
+		if !rootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, errors.New("no certificates found in the CA file")
+		}
+
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	client.Transport = transport
+
+	return client, nil
+}
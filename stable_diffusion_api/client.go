@@ -0,0 +1,224 @@
+package stable_diffusion_api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a request can take before giving up on it, which has to allow for
+	// large batches and hires fix
+	DefaultTimeout = 10 * time.Minute
+
+	// DefaultRetries is how many times a request that is safe to repeat is retried after failing
+	DefaultRetries = 3
+
+	// retryBackoff is how long to wait before the first retry, which doubles for every retry after that
+	retryBackoff = 500 * time.Millisecond
+)
+
+// APIError is returned when the API answers with a status other than 2xx.
+type APIError struct {
+	StatusCode int
+	Status     string
+
+	// Detail is the reason the webui gave for the error, if it gave one
+	Detail string
+}
+
+func (e *APIError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("stable diffusion API returned %s", e.Status)
+	}
+
+	return fmt.Sprintf("stable diffusion API returned %s: %s", e.Status, e.Detail)
+}
+
+// temporary is true for errors that may go away if the request is retried.
+func (e *APIError) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// jsonErrorResponse is the body the webui sends with errors. Validation errors from FastAPI only
+// have a detail, which is a list rather than a string, so it's decoded separately.
+type jsonErrorResponse struct {
+	Error  string          `json:"error"`
+	Detail json.RawMessage `json:"detail"`
+	Errors string          `json:"errors"`
+}
+
+func newAPIError(response *http.Response, body []byte) *APIError {
+	apiErr := &APIError{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+	}
+
+	errorResponse := &jsonErrorResponse{}
+
+	err := json.Unmarshal(body, errorResponse)
+	if err != nil {
+		apiErr.Detail = strings.TrimSpace(string(body))
+
+		return apiErr
+	}
+
+	var detail string
+
+	if json.Unmarshal(errorResponse.Detail, &detail) != nil {
+		detail = string(errorResponse.Detail)
+	}
+
+	var details []string
+
+	for _, value := range []string{errorResponse.Error, detail, errorResponse.Errors} {
+		if value != "" && !containsString(details, value) {
+			details = append(details, value)
+		}
+	}
+
+	apiErr.Detail = strings.Join(details, ": ")
+
+	return apiErr
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// doRequest sends the request body as JSON, and decodes the response into respBody unless it's nil.
+// Requests that are safe to repeat are retried with backoff when they fail with an error that may
+// go away, like the webui restarting.
+func (api *apiImpl) doRequest(ctx context.Context, method, path string, reqBody, respBody interface{}, repeatable bool) error {
+	var jsonData []byte
+
+	if reqBody != nil {
+		var err error
+
+		jsonData, err = json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+	}
+
+	retries := 0
+	if repeatable {
+		retries = api.retries
+	}
+
+	backoff := retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := api.doRequestOnce(ctx, method, path, jsonData, respBody)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+
+		log.Printf("Retrying %s %s in %v after error: %v", method, path, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+func (api *apiImpl) doRequestOnce(ctx context.Context, method, path string, jsonData []byte, respBody interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, api.host+path, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+
+	if jsonData != nil {
+		request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+
+	api.credentials.apply(request)
+
+	// the host's password isn't logged
+	requestURL := api.safeHost + path
+
+	response, err := api.client.Do(request)
+	if err != nil {
+		log.Printf("API URL: %s", requestURL)
+		log.Printf("Error with API Request: %v", err)
+
+		return err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		log.Printf("API URL: %s", requestURL)
+		log.Printf("Error reading API response: %v", err)
+
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		log.Printf("API URL: %s", requestURL)
+		log.Printf("Unexpected API response: %s", string(body))
+
+		return newAPIError(response, body)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(body, respBody)
+	if err != nil {
+		log.Printf("API URL: %s", requestURL)
+		log.Printf("Unexpected API response: %s", string(body))
+
+		return err
+	}
+
+	return nil
+}
+
+// retryable is true for errors that may go away if the request is sent again, which are failures to
+// reach the API and the statuses it sends while it's busy. Requests that were cancelled, or ran out of
+// time, aren't retried, and neither are responses that couldn't be decoded.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.temporary()
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
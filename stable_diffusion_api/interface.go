@@ -1,7 +1,16 @@
 package stable_diffusion_api
 
+import "context"
+
 type StableDiffusionAPI interface {
-	TextToImage(req *TextToImageRequest) (*TextToImageResponse, error)
-	UpscaleImage(upscaleReq *UpscaleRequest) (*UpscaleResponse, error)
-	GetCurrentProgress() (*ProgressResponse, error)
+	TextToImage(ctx context.Context, req *TextToImageRequest) (*TextToImageResponse, error)
+	ImageToImage(ctx context.Context, req *ImageToImageRequest) (*ImageToImageResponse, error)
+	UpscaleImage(ctx context.Context, upscaleReq *UpscaleRequest) (*UpscaleResponse, error)
+	GetCurrentProgress(ctx context.Context) (*ProgressResponse, error)
+	ListModels(ctx context.Context) ([]*Model, error)
+	SetModel(ctx context.Context, model string) error
+	ListSamplers(ctx context.Context) ([]*Sampler, error)
+	Interrupt(ctx context.Context) error
+	Skip(ctx context.Context) error
+	Host() string
 }
@@ -1,20 +1,33 @@
 package stable_diffusion_api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
-	"log"
 	"net/http"
+	"net/url"
 )
 
 type apiImpl struct {
-	host string
+	host        string
+	safeHost    string
+	client      *http.Client
+	retries     int
+	credentials Credentials
 }
 
 type Config struct {
+	// Host is the webui's address. It can include a username and password for basic auth, e.g. to
+	// give each host its own.
 	Host string
+
+	// Client is shared by the APIs, and made with NewClient's defaults if it isn't set
+	Client *http.Client
+
+	// Retries is how many times requests that are safe to repeat are retried. It can't be negative.
+	Retries int
+
+	Credentials Credentials
 }
 
 func New(cfg Config) (StableDiffusionAPI, error) {
@@ -22,26 +35,74 @@ func New(cfg Config) (StableDiffusionAPI, error) {
 		return nil, errors.New("missing host")
 	}
 
+	hostURL, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Retries < 0 {
+		return nil, errors.New("retries can't be negative")
+	}
+
+	err = cfg.Credentials.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client, err = NewClient(ClientConfig{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &apiImpl{
-		host: cfg.Host,
+		host:        cfg.Host,
+		safeHost:    hostURL.Redacted(),
+		client:      client,
+		retries:     cfg.Retries,
+		credentials: cfg.Credentials,
 	}, nil
 }
 
+// Host is the address of the API, which tells apart the backends when there are several. Any
+// password in it is hidden, as it's logged and shown to users.
+func (api *apiImpl) Host() string {
+	return api.safeHost
+}
+
 type jsonTextToImageResponse struct {
 	Images []string `json:"images"`
 	Info   string   `json:"info"`
 }
 
 type jsonInfoResponse struct {
-	Seed        int   `json:"seed"`
-	AllSeeds    []int `json:"all_seeds"`
-	AllSubseeds []int `json:"all_subseeds"`
+	Seed        int    `json:"seed"`
+	AllSeeds    []int  `json:"all_seeds"`
+	AllSubseeds []int  `json:"all_subseeds"`
+	SDModelName string `json:"sd_model_name"`
+	SDModelHash string `json:"sd_model_hash"`
+}
+
+// info decodes the generation info, which the webui sends as a JSON string inside the response.
+func (resp *jsonTextToImageResponse) info() (*jsonInfoResponse, error) {
+	infoStruct := &jsonInfoResponse{}
+
+	err := json.Unmarshal([]byte(resp.Info), infoStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	return infoStruct, nil
 }
 
 type TextToImageResponse struct {
-	Images   []string `json:"images"`
-	Seeds    []int    `json:"seeds"`
-	Subseeds []int    `json:"subseeds"`
+	Images    []string `json:"images"`
+	Seeds     []int    `json:"seeds"`
+	Subseeds  []int    `json:"subseeds"`
+	ModelName string   `json:"model_name"`
+	ModelHash string   `json:"model_hash"`
 }
 
 type TextToImageRequest struct {
@@ -53,6 +114,7 @@ type TextToImageRequest struct {
 	EnableHR          bool    `json:"enable_hr"`
 	HRResizeX         int     `json:"hr_resize_x"`
 	HRResizeY         int     `json:"hr_resize_y"`
+	HRUpscaler        string  `json:"hr_upscaler,omitempty"`
 	DenoisingStrength float64 `json:"denoising_strength"`
 	BatchSize         int     `json:"batch_size"`
 	Seed              int     `json:"seed"`
@@ -64,71 +126,107 @@ type TextToImageRequest struct {
 	NIter             int     `json:"n_iter"`
 }
 
-func (api *apiImpl) TextToImage(req *TextToImageRequest) (*TextToImageResponse, error) {
+func (api *apiImpl) TextToImage(ctx context.Context, req *TextToImageRequest) (*TextToImageResponse, error) {
 	if req == nil {
 		return nil, errors.New("missing request")
 	}
 
-	postURL := api.host + "/sdapi/v1/txt2img"
+	respStruct := &jsonTextToImageResponse{}
 
-	jsonData, err := json.Marshal(req)
+	// generating isn't retried, as the webui may still be working on the first attempt
+	err := api.doRequest(ctx, http.MethodPost, "/sdapi/v1/txt2img", req, respStruct, false)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonData))
+	infoStruct, err := respStruct.info()
 	if err != nil {
 		return nil, err
 	}
 
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	return &TextToImageResponse{
+		Images:    respStruct.Images,
+		Seeds:     infoStruct.AllSeeds,
+		Subseeds:  infoStruct.AllSubseeds,
+		ModelName: infoStruct.SDModelName,
+		ModelHash: infoStruct.SDModelHash,
+	}, nil
+}
 
-	client := &http.Client{}
+type ImageToImageRequest struct {
+	InitImages        []string `json:"init_images"`
+	ResizeMode        int      `json:"resize_mode"`
+	DenoisingStrength float64  `json:"denoising_strength"`
+	Prompt            string   `json:"prompt"`
+	NegativePrompt    string   `json:"negative_prompt"`
+	Width             int      `json:"width"`
+	Height            int      `json:"height"`
+	RestoreFaces      bool     `json:"restore_faces"`
+	BatchSize         int      `json:"batch_size"`
+	Seed              int      `json:"seed"`
+	Subseed           int      `json:"subseed"`
+	SubseedStrength   float64  `json:"subseed_strength"`
+	SamplerName       string   `json:"sampler_name"`
+	CfgScale          float64  `json:"cfg_scale"`
+	Steps             int      `json:"steps"`
+	NIter             int      `json:"n_iter"`
+
+	// Inpainting options, only used when Mask is set
+	Mask                  string `json:"mask,omitempty"`
+	MaskBlur              int    `json:"mask_blur,omitempty"`
+	InpaintingFill        int    `json:"inpainting_fill,omitempty"`
+	InpaintFullRes        bool   `json:"inpaint_full_res,omitempty"`
+	InpaintFullResPadding int    `json:"inpaint_full_res_padding,omitempty"`
+}
 
-	response, err := client.Do(request)
-	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Error with API Request: %s", string(jsonData))
+type ImageToImageResponse struct {
+	Images    []string `json:"images"`
+	Seeds     []int    `json:"seeds"`
+	Subseeds  []int    `json:"subseeds"`
+	ModelName string   `json:"model_name"`
+	ModelHash string   `json:"model_hash"`
+}
 
-		return nil, err
+func (api *apiImpl) ImageToImage(ctx context.Context, req *ImageToImageRequest) (*ImageToImageResponse, error) {
+	if req == nil {
+		return nil, errors.New("missing request")
 	}
 
-	defer response.Body.Close()
-
-	body, _ := io.ReadAll(response.Body)
+	if len(req.InitImages) == 0 {
+		return nil, errors.New("missing init image")
+	}
 
 	respStruct := &jsonTextToImageResponse{}
 
-	err = json.Unmarshal(body, respStruct)
+	err := api.doRequest(ctx, http.MethodPost, "/sdapi/v1/img2img", req, respStruct, false)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Unexpected API response: %s", string(body))
-
 		return nil, err
 	}
 
-	infoStruct := &jsonInfoResponse{}
-
-	err = json.Unmarshal([]byte(respStruct.Info), infoStruct)
+	infoStruct, err := respStruct.info()
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Unexpected API response: %s", string(body))
-
 		return nil, err
 	}
 
-	return &TextToImageResponse{
-		Images:   respStruct.Images,
-		Seeds:    infoStruct.AllSeeds,
-		Subseeds: infoStruct.AllSubseeds,
+	return &ImageToImageResponse{
+		Images:    respStruct.Images,
+		Seeds:     infoStruct.AllSeeds,
+		Subseeds:  infoStruct.AllSubseeds,
+		ModelName: infoStruct.SDModelName,
+		ModelHash: infoStruct.SDModelHash,
 	}, nil
 }
 
 type UpscaleRequest struct {
-	ResizeMode         int                 `json:"resize_mode"`
-	UpscalingResize    int                 `json:"upscaling_resize"`
-	Upscaler1          string              `json:"upscaler1"`
-	TextToImageRequest *TextToImageRequest `json:"text_to_image_request"`
+	ResizeMode      int    `json:"resize_mode"`
+	UpscalingResize int    `json:"upscaling_resize"`
+	Upscaler1       string `json:"upscaler1"`
+
+	// Image is the base64 encoded image to upscale. Without it, the image is regenerated first, with
+	// whichever of the generation requests is set.
+	Image               string               `json:"image"`
+	TextToImageRequest  *TextToImageRequest  `json:"text_to_image_request"`
+	ImageToImageRequest *ImageToImageRequest `json:"image_to_image_request"`
 }
 
 type upscaleJSONRequest struct {
@@ -142,108 +240,158 @@ type UpscaleResponse struct {
 	Image string `json:"image"`
 }
 
-func (api *apiImpl) UpscaleImage(upscaleReq *UpscaleRequest) (*UpscaleResponse, error) {
+func (api *apiImpl) UpscaleImage(ctx context.Context, upscaleReq *UpscaleRequest) (*UpscaleResponse, error) {
 	if upscaleReq == nil {
 		return nil, errors.New("missing request")
 	}
 
-	textToImageReq := upscaleReq.TextToImageRequest
+	image := upscaleReq.Image
 
-	if textToImageReq == nil {
-		return nil, errors.New("missing text to image request")
-	}
-
-	textToImageReq.NIter = 1
+	if image == "" {
+		regeneratedImage, err := api.regenerateImage(ctx, upscaleReq)
+		if err != nil {
+			return nil, err
+		}
 
-	regeneratedImage, err := api.TextToImage(textToImageReq)
-	if err != nil {
-		return nil, err
+		image = regeneratedImage
 	}
 
 	jsonReq := &upscaleJSONRequest{
 		ResizeMode:      upscaleReq.ResizeMode,
 		UpscalingResize: upscaleReq.UpscalingResize,
 		Upscaler1:       upscaleReq.Upscaler1,
-		Image:           regeneratedImage.Images[0],
+		Image:           image,
 	}
 
-	postURL := api.host + "/sdapi/v1/extra-single-image"
+	respStruct := &UpscaleResponse{}
 
-	jsonData, err := json.Marshal(jsonReq)
+	err := api.doRequest(ctx, http.MethodPost, "/sdapi/v1/extra-single-image", jsonReq, respStruct, false)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
-	}
+	return respStruct, nil
+}
 
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+// regenerateImage recreates the single image that is about to be upscaled, using whichever
+// generation request (text to image, or image to image) originally produced it.
+func (api *apiImpl) regenerateImage(ctx context.Context, upscaleReq *UpscaleRequest) (string, error) {
+	if upscaleReq.ImageToImageRequest != nil {
+		imageToImageReq := upscaleReq.ImageToImageRequest
 
-	client := &http.Client{}
+		imageToImageReq.BatchSize = 1
+		imageToImageReq.NIter = 1
 
-	response, err := client.Do(request)
-	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Error with API Request: %s", string(jsonData))
+		regenerated, err := api.ImageToImage(ctx, imageToImageReq)
+		if err != nil {
+			return "", err
+		}
 
-		return nil, err
+		if len(regenerated.Images) == 0 {
+			return "", errors.New("no image regenerated")
+		}
+
+		return regenerated.Images[0], nil
 	}
 
-	defer response.Body.Close()
+	textToImageReq := upscaleReq.TextToImageRequest
 
-	body, _ := io.ReadAll(response.Body)
+	if textToImageReq == nil {
+		return "", errors.New("missing text to image request")
+	}
 
-	respStruct := &UpscaleResponse{}
+	textToImageReq.NIter = 1
 
-	err = json.Unmarshal(body, respStruct)
+	regenerated, err := api.TextToImage(ctx, textToImageReq)
 	if err != nil {
-		log.Printf("API URL: %s", postURL)
-		log.Printf("Unexpected API response: %s", string(body))
+		return "", err
+	}
 
-		return nil, err
+	if len(regenerated.Images) == 0 {
+		return "", errors.New("no image regenerated")
 	}
 
-	return respStruct, nil
+	return regenerated.Images[0], nil
 }
 
 type ProgressResponse struct {
 	Progress    float64 `json:"progress"`
 	EtaRelative float64 `json:"eta_relative"`
+
+	// CurrentImage is a base64 encoded preview of the image being generated, when the webui has live
+	// previews turned on
+	CurrentImage string `json:"current_image"`
 }
 
-func (api *apiImpl) GetCurrentProgress() (*ProgressResponse, error) {
-	getURL := api.host + "/sdapi/v1/progress"
+func (api *apiImpl) GetCurrentProgress(ctx context.Context) (*ProgressResponse, error) {
+	respStruct := &ProgressResponse{}
 
-	request, err := http.NewRequest("GET", getURL, bytes.NewBuffer([]byte{}))
+	err := api.doRequest(ctx, http.MethodGet, "/sdapi/v1/progress", nil, respStruct, true)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
+	return respStruct, nil
+}
 
-	response, err := client.Do(request)
-	if err != nil {
-		log.Printf("API URL: %s", getURL)
-		log.Printf("Error with API Request: %v", err)
+type Model struct {
+	Title     string `json:"title"`
+	ModelName string `json:"model_name"`
+	Hash      string `json:"hash"`
+	SHA256    string `json:"sha256"`
+	Filename  string `json:"filename"`
+}
 
+func (api *apiImpl) ListModels(ctx context.Context) ([]*Model, error) {
+	respStruct := make([]*Model, 0)
+
+	err := api.doRequest(ctx, http.MethodGet, "/sdapi/v1/sd-models", nil, &respStruct, true)
+	if err != nil {
 		return nil, err
 	}
 
-	defer response.Body.Close()
+	return respStruct, nil
+}
 
-	body, _ := io.ReadAll(response.Body)
+type setModelRequest struct {
+	SDModelCheckpoint string `json:"sd_model_checkpoint"`
+}
 
-	respStruct := &ProgressResponse{}
+// SetModel loads the given checkpoint, by its title or model name. This blocks until the API has
+// finished loading it.
+func (api *apiImpl) SetModel(ctx context.Context, model string) error {
+	if model == "" {
+		return errors.New("missing model")
+	}
 
-	err = json.Unmarshal(body, respStruct)
-	if err != nil {
-		log.Printf("API URL: %s", getURL)
-		log.Printf("Unexpected API response: %s", string(body))
+	// setting the same option again doesn't change anything, so this is safe to retry
+	return api.doRequest(ctx, http.MethodPost, "/sdapi/v1/options", &setModelRequest{SDModelCheckpoint: model}, nil, true)
+}
+
+type Sampler struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+func (api *apiImpl) ListSamplers(ctx context.Context) ([]*Sampler, error) {
+	respStruct := make([]*Sampler, 0)
 
+	err := api.doRequest(ctx, http.MethodGet, "/sdapi/v1/samplers", nil, &respStruct, true)
+	if err != nil {
 		return nil, err
 	}
 
 	return respStruct, nil
 }
+
+// Interrupt stops the generation that the API is working on. The request that started it returns
+// early, with whatever images were generated so far. It isn't retried, as by the time a retry was
+// sent, the API could be working on something else.
+func (api *apiImpl) Interrupt(ctx context.Context) error {
+	return api.doRequest(ctx, http.MethodPost, "/sdapi/v1/interrupt", nil, nil, false)
+}
+
+// Skip stops the current image of a batch, and moves on to the next one. Like Interrupt, it isn't retried.
+func (api *apiImpl) Skip(ctx context.Context) error {
+	return api.doRequest(ctx, http.MethodPost, "/sdapi/v1/skip", nil, nil, false)
+}